@@ -45,6 +45,11 @@ type GenerateRequest struct {
 	KeepAlive *Duration   `json:"keep_alive,omitempty"`
 	Images    []ImageData `json:"images,omitempty"`
 
+	// Logprobs returns the log probability of each generated token, along with the TopLogprobs most likely
+	// tokens at its position
+	Logprobs    bool `json:"logprobs,omitempty"`
+	TopLogprobs int  `json:"top_logprobs,omitempty"`
+
 	Options map[string]interface{} `json:"options"`
 }
 
@@ -55,13 +60,54 @@ type ChatRequest struct {
 	Format    string    `json:"format"`
 	KeepAlive *Duration `json:"keep_alive,omitempty"`
 
+	// Logprobs returns the log probability of each generated token, along with the TopLogprobs most likely
+	// tokens at its position
+	Logprobs    bool `json:"logprobs,omitempty"`
+	TopLogprobs int  `json:"top_logprobs,omitempty"`
+
 	Options map[string]interface{} `json:"options"`
 }
 
 type Message struct {
-	Role    string      `json:"role"` // one of ["system", "user", "assistant"]
+	Role    string      `json:"role"` // one of ["system", "developer", "user", "assistant", "tool", "tool_result", "embed_query", "embed_document"]
 	Content string      `json:"content"`
-	Images  []ImageData `json:"images,omitempty"`
+	Images  []ImageData `json:"images,omitempty"` // on user and system messages
+	// ImageURLs are http, https, or data URLs of images the server fetches for user and system messages. Images
+	// are only fetched over http and https from the hosts in OLLAMA_IMAGE_URL_HOSTS.
+	ImageURLs []string `json:"image_urls,omitempty"`
+
+	// ToolCalls are the functions the model called, their results are sent back in tool_result messages
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	// ToolCallID identifies the tool call a tool_result message is the result of, it is rendered as .ToolCallID
+	ToolCallID string `json:"tool_call_id,omitempty"`
+	// Incomplete marks the content of an assistant message as the start of a response, which the model
+	// continues rather than starting a new response
+	Incomplete bool `json:"incomplete,omitempty"`
+	// Metadata holds hints for the turn the message is part of, such as sampling options like temperature
+	// and top_p for that turn
+	Metadata map[string]any `json:"metadata,omitempty"`
+	// Priority decides which messages are dropped first when the conversation does not fit the context window.
+	// Negative priorities are dropped before normal messages with a priority of zero, and positive priorities
+	// pin the message so it is never dropped.
+	Priority int `json:"priority,omitempty"`
+	// TokenIDs are the tokens of the content of an assistant message, for clients which already have the tokens
+	// of a response. They are counted against the context window instead of encoding the content again, and the
+	// prompt is rendered with the decoded tokens in place of the content.
+	TokenIDs []int `json:"token_ids,omitempty"`
+}
+
+// TokenLogprob is the log probability of a generated token. TopLogprobs are the most likely tokens at its
+// position, which the token may not be one of.
+type TokenLogprob struct {
+	Token       string         `json:"token"`
+	Logprob     float64        `json:"logprob"`
+	TopLogprobs []TokenLogprob `json:"top_logprobs,omitempty"`
+}
+
+// ToolCall is a function invoked by the model
+type ToolCall struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
 }
 
 type ChatResponse struct {
@@ -69,6 +115,9 @@ type ChatResponse struct {
 	CreatedAt time.Time `json:"created_at"`
 	Message   Message   `json:"message"`
 
+	// Logprobs are the log probabilities of the tokens of the message, when requested
+	Logprobs []TokenLogprob `json:"logprobs,omitempty"`
+
 	Done bool `json:"done"`
 
 	Metrics
@@ -233,6 +282,9 @@ type GenerateResponse struct {
 	CreatedAt time.Time `json:"created_at"`
 	Response  string    `json:"response"`
 
+	// Logprobs are the log probabilities of the tokens of the response, when requested
+	Logprobs []TokenLogprob `json:"logprobs,omitempty"`
+
 	Done    bool  `json:"done"`
 	Context []int `json:"context,omitempty"`
 
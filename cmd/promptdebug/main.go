@@ -0,0 +1,119 @@
+// Command promptdebug renders a prompt template locally, for testing the TEMPLATE of a Modelfile without
+// creating a model. A single prompt is rendered from the --system, --prompt, and --response flags, or a chat
+// from the messages in the file given by --messages-json.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/server"
+)
+
+// charsPerToken estimates the number of tokens of a chat, since no tokenizer is loaded
+const charsPerToken = 4
+
+func estimateTokens(s string) ([]int, error) {
+	return make([]int, (len(s)+charsPerToken-1)/charsPerToken), nil
+}
+
+func run(cmd *cobra.Command, _ []string) error {
+	tmpl, _ := cmd.Flags().GetString("template")
+	system, _ := cmd.Flags().GetString("system")
+	prompt, _ := cmd.Flags().GetString("prompt")
+	response, _ := cmd.Flags().GetString("response")
+	cut, _ := cmd.Flags().GetBool("cut")
+	messagesFile, _ := cmd.Flags().GetString("messages-json")
+	explain, _ := cmd.Flags().GetBool("explain")
+	numCtx, _ := cmd.Flags().GetInt("num-ctx")
+	wrap, _ := cmd.Flags().GetInt("wrap")
+
+	output := func(rendered string) {
+		if wrap > 0 {
+			rendered = server.WrapPromptForDisplay(rendered, wrap)
+		}
+
+		fmt.Print(rendered)
+	}
+
+	if messagesFile != "" {
+		if explain {
+			return errors.New("--explain can not be used with --messages-json")
+		}
+
+		data, err := os.ReadFile(messagesFile)
+		if err != nil {
+			return err
+		}
+
+		var messages []api.Message
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return fmt.Errorf("invalid messages: %w", err)
+		}
+
+		chat, err := (&server.Model{Template: tmpl}).ChatPrompts(messages, system)
+		if err != nil {
+			return err
+		}
+
+		rendered, err := chat.Render(tmpl, numCtx, estimateTokens)
+		if err != nil {
+			return err
+		}
+
+		output(rendered)
+		return nil
+	}
+
+	if explain {
+		explained, err := server.ExplainPrompt(tmpl, system, prompt, response)
+		if err != nil {
+			return err
+		}
+
+		fmt.Print(explained.ColorString())
+		return nil
+	}
+
+	rendered, err := server.NewPromptBuilder().
+		WithTemplate(tmpl).
+		WithSystem(system).
+		WithPrompt(prompt).
+		WithResponse(response).
+		WithCut(cut).
+		Build()
+	if err != nil {
+		return err
+	}
+
+	output(rendered)
+	return nil
+}
+
+func main() {
+	cmd := &cobra.Command{
+		Use:          "promptdebug",
+		Short:        "Render a prompt template",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE:         run,
+	}
+
+	cmd.Flags().String("template", "", "Prompt template to render")
+	cmd.Flags().String("system", "", "System message")
+	cmd.Flags().String("prompt", "", "User prompt")
+	cmd.Flags().String("response", "", "Model response")
+	cmd.Flags().Bool("cut", false, "Only render the template before the response")
+	cmd.Flags().String("messages-json", "", "JSON file of chat messages to render instead of a single prompt")
+	cmd.Flags().Int("num-ctx", 2048, "Context window the chat messages are truncated to, tokens are estimated from their length")
+	cmd.Flags().Int("wrap", 0, "Wrap lines longer than this many columns, except with --explain")
+	cmd.Flags().Bool("explain", false, "Colour the system message, prompt, response, and template text of the output")
+	cmd.MarkFlagRequired("template")
+
+	cobra.CheckErr(cmd.Execute())
+}
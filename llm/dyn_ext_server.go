@@ -194,6 +194,10 @@ func (llm *dynExtServer) Predict(ctx context.Context, predict PredictOpts, fn fu
 		request["grammar"] = jsonGrammar
 	}
 
+	if n := predict.numProbs(); n > 0 {
+		request["n_probs"] = n
+	}
+
 	retryDelay := 100 * time.Microsecond
 	for retries := 0; retries < maxRetries; retries++ {
 		if retries > 0 {
@@ -254,10 +258,12 @@ func (llm *dynExtServer) Predict(ctx context.Context, predict PredictOpts, fn fu
 
 				if p.Content != "" {
 					fn(PredictResult{
-						Content: p.Content,
+						Content:  p.Content,
+						Logprobs: logprobs(p.CompletionProbabilities, predict.TopLogprobs),
 					})
 				}
 
+				// the final result repeats the probabilities of every generated token, so they are not sent again
 				if p.Stop {
 					fn(PredictResult{
 						Done:               true,
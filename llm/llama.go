@@ -3,6 +3,7 @@ package llm
 import (
 	_ "embed"
 	"fmt"
+	"math"
 	"time"
 
 	"github.com/jmorganca/ollama/api"
@@ -39,6 +40,17 @@ ws ::= ([ \t\n] ws)?
 type ImageData struct {
 	Data []byte `json:"data"`
 	ID   int    `json:"id"`
+
+	// Tokens is the number of tokens used by the image in the context, if known
+	Tokens int `json:"-"`
+
+	// Width and Height are the dimensions of the image in pixels, if known
+	Width  int `json:"-"`
+	Height int `json:"-"`
+
+	// URL is an http, https, or data URL the image is fetched from when Data is not set, from the image_urls
+	// of a chat message
+	URL string `json:"-"`
 }
 
 var payloadMissing = fmt.Errorf("expected dynamic library payloads not included in this build of ollama")
@@ -49,6 +61,10 @@ type prediction struct {
 	Prompt  string `json:"prompt"`
 	Stop    bool   `json:"stop"`
 
+	// CompletionProbabilities are the most likely tokens at the position of each generated token, they are only
+	// set when n_probs is requested
+	CompletionProbabilities []tokenProbs `json:"completion_probabilities"`
+
 	Timings struct {
 		PredictedN  int     `json:"predicted_n"`
 		PredictedMS float64 `json:"predicted_ms"`
@@ -57,17 +73,52 @@ type prediction struct {
 	}
 }
 
+// tokenProbs is a generated token along with the probabilities of the most likely tokens at its position
+type tokenProbs struct {
+	Content string `json:"content"`
+	Probs   []struct {
+		TokStr string  `json:"tok_str"`
+		Prob   float64 `json:"prob"`
+	} `json:"probs"`
+}
+
 const maxRetries = 3
 
+const (
+	// minLogprobCandidates is the fewest probabilities requested for each token, so the probability of the
+	// generated token is usually found among them even when few top log probabilities are requested
+	minLogprobCandidates = 5
+
+	// minLogprob stands in for the log probability of a token with a probability of zero, which can't be encoded
+	// as JSON
+	minLogprob = -9999.0
+)
+
 type PredictOpts struct {
 	Prompt  string
 	Format  string
 	Images  []ImageData
 	Options api.Options
+
+	// RequestLogprobs asks the sampler for the log probability of each generated token, along with the
+	// TopLogprobs most likely tokens at its position
+	RequestLogprobs bool
+	TopLogprobs     int
+}
+
+// numProbs returns the number of probabilities to request for each token, or zero if log probabilities are not
+// requested
+func (p PredictOpts) numProbs() int {
+	if !p.RequestLogprobs {
+		return 0
+	}
+
+	return max(p.TopLogprobs, minLogprobCandidates)
 }
 
 type PredictResult struct {
 	Content            string
+	Logprobs           []api.TokenLogprob
 	Done               bool
 	PromptEvalCount    int
 	PromptEvalDuration time.Duration
@@ -98,3 +149,29 @@ type EmbeddingRequest struct {
 type EmbeddingResponse struct {
 	Embedding []float64 `json:"embedding"`
 }
+
+// logprobs converts the probabilities of the generated tokens to log probabilities. The log probability of a token
+// which is not one of the most likely tokens is not known, so it is set to that of the least likely of them to
+// give an upper bound.
+func logprobs(probs []tokenProbs, top int) []api.TokenLogprob {
+	var logprobs []api.TokenLogprob
+	for _, p := range probs {
+		logprob := api.TokenLogprob{Token: p.Content, Logprob: minLogprob}
+
+		var found bool
+		for i, candidate := range p.Probs {
+			lp := max(math.Log(candidate.Prob), minLogprob)
+			if !found && (candidate.TokStr == p.Content || i == len(p.Probs)-1) {
+				logprob.Logprob, found = lp, true
+			}
+
+			if i < top {
+				logprob.TopLogprobs = append(logprob.TopLogprobs, api.TokenLogprob{Token: candidate.TokStr, Logprob: lp})
+			}
+		}
+
+		logprobs = append(logprobs, logprob)
+	}
+
+	return logprobs
+}
@@ -0,0 +1,55 @@
+package llm
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestLogprobs(t *testing.T) {
+	var p prediction
+	err := json.Unmarshal([]byte(`{
+		"content": " abra",
+		"completion_probabilities": [
+			{"content": " abra", "probs": [{"tok_str": " abra", "prob": 0.5}, {"tok_str": " hocus", "prob": 0.25}, {"tok_str": " ala", "prob": 0}]},
+			{"content": "cad", "probs": [{"tok_str": "kad", "prob": 0.5}, {"tok_str": "ca", "prob": 0.125}]}
+		]
+	}`), &p)
+	assert.NoError(t, err)
+
+	got := logprobs(p.CompletionProbabilities, 2)
+	assert.Equal(t, []api.TokenLogprob{
+		{
+			Token:   " abra",
+			Logprob: math.Log(0.5),
+			TopLogprobs: []api.TokenLogprob{
+				{Token: " abra", Logprob: math.Log(0.5)},
+				{Token: " hocus", Logprob: math.Log(0.25)},
+			},
+		},
+		{
+			// the token is not one of the most likely, so the least likely of them is an upper bound
+			Token:   "cad",
+			Logprob: math.Log(0.125),
+			TopLogprobs: []api.TokenLogprob{
+				{Token: "kad", Logprob: math.Log(0.5)},
+				{Token: "ca", Logprob: math.Log(0.125)},
+			},
+		},
+	}, got)
+
+	// a probability of zero can still be encoded
+	got = logprobs(p.CompletionProbabilities[:1], 3)
+	assert.Equal(t, minLogprob, got[0].TopLogprobs[2].Logprob)
+
+	_, err = json.Marshal(got)
+	assert.NoError(t, err)
+
+	assert.Equal(t, 0, PredictOpts{TopLogprobs: 10}.numProbs())
+	assert.Equal(t, minLogprobCandidates, PredictOpts{RequestLogprobs: true}.numProbs())
+	assert.Equal(t, 10, PredictOpts{RequestLogprobs: true, TopLogprobs: 10}.numProbs())
+}
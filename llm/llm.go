@@ -19,6 +19,38 @@ type LLM interface {
 	Close()
 }
 
+// ClampContextWindow limits the requested context window to the context length the model was trained with,
+// warning when it is larger. A model which does not set its context length is not limited.
+func ClampContextWindow(requested int, modelMaxContext int) int {
+	if modelMaxContext > 0 && requested > modelMaxContext {
+		slog.Warn(fmt.Sprintf("requested context length is greater than model's max context length (%d > %d), using %d instead", requested, modelMaxContext, modelMaxContext))
+		return modelMaxContext
+	}
+
+	return requested
+}
+
+// EstimateContextWindow returns the context length the model at modelPath was trained with, read from the
+// <architecture>.context_length key of its GGUF metadata, such as llama.context_length
+func EstimateContextWindow(modelPath string) (int, error) {
+	f, err := os.Open(modelPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	ggml, err := DecodeGGML(f)
+	if err != nil {
+		return 0, err
+	}
+
+	if ggml.model == nil || ggml.NumCtx() == 0 {
+		return 0, fmt.Errorf("%s does not set a context length", modelPath)
+	}
+
+	return int(ggml.NumCtx()), nil
+}
+
 func New(workDir, model string, adapters, projectors []string, opts api.Options) (LLM, error) {
 	if _, err := os.Stat(model); err != nil {
 		return nil, err
@@ -35,10 +67,7 @@ func New(workDir, model string, adapters, projectors []string, opts api.Options)
 		return nil, err
 	}
 
-	if opts.NumCtx > int(ggml.NumCtx()) {
-		slog.Warn(fmt.Sprintf("requested context length is greater than model's max context length (%d > %d), using %d instead", opts.NumCtx, ggml.NumCtx(), ggml.NumCtx()))
-		opts.NumCtx = int(ggml.NumCtx())
-	}
+	opts.NumCtx = ClampContextWindow(opts.NumCtx, int(ggml.NumCtx()))
 
 	if opts.NumCtx < 4 {
 		opts.NumCtx = 4
@@ -0,0 +1,87 @@
+package llm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClampContextWindow(t *testing.T) {
+	tests := []struct {
+		name            string
+		requested       int
+		modelMaxContext int
+		want            int
+	}{
+		{name: "Within Model", requested: 2048, modelMaxContext: 4096, want: 2048},
+		{name: "Clamped", requested: 8192, modelMaxContext: 4096, want: 4096},
+		{name: "Unknown Model Context", requested: 8192, want: 8192},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClampContextWindow(tt.requested, tt.modelMaxContext); got != tt.want {
+				t.Errorf("ClampContextWindow() got = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// writeGGUF writes a GGUF file without tensors with the string and uint32 metadata
+func writeGGUF(t *testing.T, kv map[string]any) string {
+	var b bytes.Buffer
+	write := func(v any) {
+		if err := binary.Write(&b, binary.LittleEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeString := func(s string) {
+		write(uint64(len(s)))
+		b.WriteString(s)
+	}
+
+	write(uint32(FILE_MAGIC_GGUF_LE))
+	write(uint32(3))
+	write(uint64(0))
+	write(uint64(len(kv)))
+	for k, v := range kv {
+		writeString(k)
+		switch v := v.(type) {
+		case string:
+			write(ggufTypeString)
+			writeString(v)
+		case uint32:
+			write(ggufTypeUint32)
+			write(v)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "model.gguf")
+	if err := os.WriteFile(path, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestEstimateContextWindow(t *testing.T) {
+	got, err := EstimateContextWindow(writeGGUF(t, map[string]any{"general.architecture": "llama", "llama.context_length": uint32(4096)}))
+	if err != nil {
+		t.Fatalf("EstimateContextWindow() error = %v", err)
+	}
+
+	if got != 4096 {
+		t.Errorf("EstimateContextWindow() got = %d, want 4096", got)
+	}
+
+	if _, err := EstimateContextWindow(writeGGUF(t, map[string]any{"general.architecture": "llama"})); err == nil {
+		t.Errorf("EstimateContextWindow() expected an error for a model without a context length")
+	}
+
+	if _, err := EstimateContextWindow(filepath.Join(t.TempDir(), "missing.gguf")); err == nil {
+		t.Errorf("EstimateContextWindow() expected an error for a missing model")
+	}
+}
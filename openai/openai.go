@@ -31,15 +31,21 @@ type Message struct {
 }
 
 type Choice struct {
-	Index        int     `json:"index"`
-	Message      Message `json:"message"`
-	FinishReason *string `json:"finish_reason"`
+	Index        int       `json:"index"`
+	Message      Message   `json:"message"`
+	Logprobs     *Logprobs `json:"logprobs,omitempty"`
+	FinishReason *string   `json:"finish_reason"`
 }
 
 type ChunkChoice struct {
-	Index        int     `json:"index"`
-	Delta        Message `json:"delta"`
-	FinishReason *string `json:"finish_reason"`
+	Index        int       `json:"index"`
+	Delta        Message   `json:"delta"`
+	Logprobs     *Logprobs `json:"logprobs,omitempty"`
+	FinishReason *string   `json:"finish_reason"`
+}
+
+type Logprobs struct {
+	Content []api.TokenLogprob `json:"content"`
 }
 
 type Usage struct {
@@ -64,6 +70,8 @@ type ChatCompletionRequest struct {
 	PresencePenalty  *float64        `json:"presence_penalty_penalty"`
 	TopP             *float64        `json:"top_p"`
 	ResponseFormat   *ResponseFormat `json:"response_format"`
+	Logprobs         bool            `json:"logprobs"`
+	TopLogprobs      int             `json:"top_logprobs"`
 }
 
 type ChatCompletion struct {
@@ -107,8 +115,9 @@ func toChatCompletion(id string, r api.ChatResponse) ChatCompletion {
 		Model:             r.Model,
 		SystemFingerprint: "fp_ollama",
 		Choices: []Choice{{
-			Index:   0,
-			Message: Message{Role: r.Message.Role, Content: r.Message.Content},
+			Index:    0,
+			Message:  Message{Role: r.Message.Role, Content: r.Message.Content},
+			Logprobs: toLogprobs(r.Logprobs),
 			FinishReason: func(done bool) *string {
 				if done {
 					reason := "stop"
@@ -135,8 +144,9 @@ func toChunk(id string, r api.ChatResponse) ChatCompletionChunk {
 		SystemFingerprint: "fp_ollama",
 		Choices: []ChunkChoice{
 			{
-				Index: 0,
-				Delta: Message{Role: "assistant", Content: r.Message.Content},
+				Index:    0,
+				Delta:    Message{Role: "assistant", Content: r.Message.Content},
+				Logprobs: toLogprobs(r.Logprobs),
 				FinishReason: func(done bool) *string {
 					if done {
 						reason := "stop"
@@ -149,6 +159,14 @@ func toChunk(id string, r api.ChatResponse) ChatCompletionChunk {
 	}
 }
 
+func toLogprobs(logprobs []api.TokenLogprob) *Logprobs {
+	if len(logprobs) == 0 {
+		return nil
+	}
+
+	return &Logprobs{Content: logprobs}
+}
+
 func fromRequest(r ChatCompletionRequest) api.ChatRequest {
 	var messages []api.Message
 	for _, msg := range r.Messages {
@@ -207,11 +225,13 @@ func fromRequest(r ChatCompletionRequest) api.ChatRequest {
 	}
 
 	return api.ChatRequest{
-		Model:    r.Model,
-		Messages: messages,
-		Format:   format,
-		Options:  options,
-		Stream:   &r.Stream,
+		Model:       r.Model,
+		Messages:    messages,
+		Format:      format,
+		Options:     options,
+		Stream:      &r.Stream,
+		Logprobs:    r.Logprobs,
+		TopLogprobs: r.TopLogprobs,
 	}
 }
 
@@ -0,0 +1,1107 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/exp/slices"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+// promptInfo stores the variables used to template a prompt, and the token length of the resulting template for some model
+type promptInfo struct {
+	vars     PromptVars
+	tokenLen int
+
+	// index is the position of the prompt in the chat history
+	index int
+}
+
+// defaultImageTokenCost is the estimated number of tokens used by an image when the cost is not known
+const defaultImageTokenCost = 768
+
+// ChatPromptOptions configures how a prompt is built from a chat history
+type ChatPromptOptions struct {
+	// ImageTokenCost is the estimated number of tokens used by an image. When it is not set the cost
+	// is estimated from the size of the image and the model, see TokenCostForImage. Images which carry
+	// their own token count use that instead.
+	ImageTokenCost int
+
+	// AssistantPrefix is appended verbatim after the last turn, for models which expect the prompt
+	// to end with the start of the assistant's turn when the template does not include it, or to seed
+	// the response. Its tokens are counted as part of the most recent turn.
+	AssistantPrefix string
+
+	// ResponseReservation is the number of tokens of the context window to leave free for the response.
+	// It is limited to half of the context window.
+	ResponseReservation int
+
+	// StopSequences end generation, responses in the chat history are cut at the first stop sequence
+	// so they do not end the next response early
+	StopSequences []string
+
+	// Budget tracks the tokens of the context window in use by other requests, when it is set the
+	// prompt is limited to the remaining budget
+	Budget *TokenBudgetManager
+
+	// Truncation shortens the messages the chat history was built from, and the chat history is built again from
+	// the result before it is built into a prompt. The prompt is still truncated to fit the context window
+	// afterwards, so this is only needed to change how messages which do not fit are handled.
+	Truncation TruncationStrategy
+
+	// Renderer renders each prompt of the chat history, when it is not set the model template is used
+	Renderer PromptRenderer
+
+	// MaxImages limits the number of images in the prompt, zero for no limit. Images of older turns are
+	// dropped first, ErrTooManyImages is returned when the most recent turns alone have more images.
+	MaxImages int
+
+	// CompressionLevel compresses the content of the chat messages when they do not fit the context window,
+	// before older messages are dropped. Level 1 replaces repeated phrases with aliases, level 2 also
+	// normalizes whitespace and removes repeated sentences. Compression is lossy, zero disables it.
+	CompressionLevel int
+
+	// ImageHTTPClient fetches images which have a URL but no data, http.DefaultClient is used when it is not set.
+	// Each image is fetched within ImageFetchTimeout and must not be larger than MaxImageFetchSize bytes, they
+	// default to 30 seconds and 20 MiB. Images are only fetched over http and https, including redirects, from
+	// the hosts in ImageURLHosts, so requests can't reach other hosts the server has access to. Data URLs are
+	// always allowed.
+	ImageHTTPClient   *http.Client
+	ImageFetchTimeout time.Duration
+	MaxImageFetchSize int64
+	ImageURLHosts     []string
+
+	// ImagePreprocessor transforms the data of each image before its token cost is estimated, such as to resize
+	// or convert images for the model. Images are preprocessed concurrently.
+	ImagePreprocessor func([]byte) ([]byte, error)
+
+	// RoleLimits is the most tokens the content of a single message of each role can use, such as "system",
+	// "user", or "assistant". Longer messages are cut to fit instead of being dropped.
+	RoleLimits map[string]int
+
+	// ThinkingEnabled starts the response of reasoning models with a <think> tag, after the assistant prefix.
+	// The thinking blocks of earlier responses are removed from the history.
+	ThinkingEnabled bool
+
+	// TokenCache remembers the number of tokens of each turn between prompts of the same conversation, so only
+	// the turns which changed are tokenized again
+	TokenCache *CachedChatHistory
+
+	// SystemPromptCache holds the tokens of system prompts warmed up for the model, so the system prompt at the start
+	// of a prompt is not encoded again, see SystemPromptCache.WarmUp
+	SystemPromptCache *SystemPromptCache
+
+	// SummarizeThreshold is the fraction of the window the messages the chat history was built from can use before
+	// the oldest of them are replaced with a summary by Summarizer, see SummarizeConversation. The summary is done
+	// before the truncation strategy is applied. Tokens are estimated from the length of the messages. Zero
+	// disables summarization.
+	SummarizeThreshold float64
+	Summarizer         func(string) (string, error)
+
+	// PIIRedactor replaces personal information in the content of the messages before they are tokenized or
+	// rendered, see NewRegexPIIRedactor. The messages themselves are not changed.
+	PIIRedactor PIIRedactor
+
+	// MaxMessageContentBytes cuts the content of each message to at most this many bytes before it is tokenized,
+	// so a single very long message is shortened before it uses up the context window. Cut content ends with
+	// "… [truncated]". Zero is no limit.
+	MaxMessageContentBytes int
+
+	// ConversationID identifies the conversation the prompt is built for. A warning is logged when the template
+	// of the model has changed since the last prompt of the same conversation, see TemplateVersion.
+	ConversationID string
+
+	// NormalizeWhitespace removes the whitespace at the end of each line of each turn and collapses runs of
+	// blank lines, see NormalizePromptWhitespace. It is off by default since some models are sensitive to the
+	// exact whitespace of their template.
+	NormalizeWhitespace bool
+
+	// DecodeTokenIDs decodes the token ids of assistant messages which have them, the decoded text is rendered in
+	// place of the content of the message and the token ids are counted instead of encoding it. When it is not set
+	// the token ids are ignored and the content is encoded, since they can't be checked against the content.
+	DecodeTokenIDs func([]int) (string, error)
+
+	// TokenizeMessages sets the messages of the result with the number of tokens of each message. The
+	// content of each message is encoded again, so it is only done when requested.
+	TokenizeMessages bool
+}
+
+// renderer returns the renderer for the prompts of the model
+func (opts ChatPromptOptions) renderer(model *Model) PromptRenderer {
+	renderer := opts.Renderer
+	if renderer == nil {
+		renderer = NewGoTemplateRenderer(model.Template)
+	}
+
+	if opts.NormalizeWhitespace {
+		return whitespaceRenderer{renderer}
+	}
+
+	return renderer
+}
+
+// truncatesMessages reports whether the messages are summarized or shortened by the truncation strategy before
+// they are built into a prompt
+func (opts ChatPromptOptions) truncatesMessages() bool {
+	return opts.Truncation != nil || (opts.SummarizeThreshold > 0 && opts.Summarizer != nil)
+}
+
+// preparedHistory returns a copy of the chat history with the token ids of its responses decoded and its content
+// redacted and clipped. When the messages are summarized or truncated, this is done to the messages the chat
+// history was built from instead, and it is built again from the truncated messages.
+func (opts ChatPromptOptions) preparedHistory(chat *ChatHistory, window int) (*ChatHistory, error) {
+	if opts.truncatesMessages() && chat.messages != nil {
+		msgs, err := opts.truncateMessages(chat.messages, window)
+		if err != nil {
+			return nil, err
+		}
+
+		return chat.rebuilt(msgs)
+	}
+
+	chat, err := chat.decodedResponses(opts.DecodeTokenIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.PIIRedactor != nil {
+		chat = chat.redacted(opts.PIIRedactor)
+	}
+
+	if opts.MaxMessageContentBytes > 0 {
+		chat = chat.clipped(opts.MaxMessageContentBytes)
+	}
+
+	return chat, nil
+}
+
+// truncateMessages summarizes the messages when they pass the summarize threshold and applies the truncation
+// strategy to them, if either is set
+func (opts ChatPromptOptions) truncateMessages(msgs []api.Message, maxTokens int) ([]api.Message, error) {
+	if !opts.truncatesMessages() {
+		return msgs, nil
+	}
+
+	// the summarizer and strategy may send the messages elsewhere, so they are given them redacted and clipped
+	msgs, err := opts.preparedMessages(msgs)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.SummarizeThreshold > 0 && opts.Summarizer != nil {
+		if msgs, err = opts.summarizeMessages(msgs, maxTokens); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Truncation == nil {
+		return msgs, nil
+	}
+
+	return opts.Truncation.Truncate(msgs, maxTokens)
+}
+
+// preparedMessages returns copies of the messages with the token ids of assistant messages decoded and their
+// content redacted and clipped. The token ids of a message are dropped when its content is changed, so the
+// content which is rendered is the content which is counted.
+func (opts ChatPromptOptions) preparedMessages(msgs []api.Message) ([]api.Message, error) {
+	decoded := make([]api.Message, len(msgs))
+	for i, msg := range msgs {
+		if msg.TokenIDs != nil && opts.DecodeTokenIDs == nil {
+			msg.TokenIDs = nil
+		} else if msg.TokenIDs != nil && strings.EqualFold(msg.Role, "assistant") {
+			content, err := opts.DecodeTokenIDs(msg.TokenIDs)
+			if err != nil {
+				return nil, fmt.Errorf("%w: decode response tokens: %w", ErrTokenization, err)
+			}
+
+			msg.Content = content
+		}
+
+		decoded[i] = msg
+	}
+
+	prepared := decoded
+	if opts.PIIRedactor != nil {
+		prepared = redactMessages(prepared, opts.PIIRedactor)
+	}
+
+	if opts.MaxMessageContentBytes > 0 {
+		prepared = clipMessages(prepared, opts.MaxMessageContentBytes)
+	}
+
+	for i := range prepared {
+		if prepared[i].Content != decoded[i].Content {
+			prepared[i].TokenIDs = nil
+		}
+	}
+
+	return prepared, nil
+}
+
+// window returns the number of tokens of the context window available to the prompt
+func (opts ChatPromptOptions) window(numCtx int) int {
+	window := numCtx - min(max(opts.ResponseReservation, 0), numCtx/2)
+	if opts.Budget != nil {
+		window = min(window, opts.Budget.Remaining())
+	}
+
+	return window
+}
+
+// imageTokens returns the estimated number of tokens used by the image for the named model
+func (opts ChatPromptOptions) imageTokens(image llm.ImageData, model string) int {
+	switch {
+	case image.Tokens > 0:
+		return image.Tokens
+	case opts.ImageTokenCost > 0:
+		return opts.ImageTokenCost
+	default:
+		return TokenCostForImage(image.Width, image.Height, model)
+	}
+}
+
+// ChatPromptResult is the prompt built from a chat history along with details of what was removed
+// from the history to fit the prompt within the context window
+type ChatPromptResult struct {
+	Prompt string
+	// Images are the images left in the prompt after truncation, in the order their placeholders appear in it
+	Images []llm.ImageData
+
+	// TruncatedPrompts is the number of prompts from the chat history which were dropped
+	TruncatedPrompts int
+	// TruncatedImages is the number of images which were dropped, including those of dropped prompts
+	TruncatedImages int
+	// SystemPreserved reports whether the most recent system message is included in the prompt
+	SystemPreserved bool
+	// Tokens is the number of tokens of the prompt and its images, counted one turn at a time so it can differ
+	// slightly from encoding the whole prompt
+	Tokens int
+
+	// TurnMetadata is the metadata of each turn included in the prompt, oldest first, such as per-turn
+	// sampling options. A turn without metadata has a nil entry, and it is nil when no turn has metadata.
+	TurnMetadata []map[string]any
+
+	// Messages are the messages included in the prompt, oldest first, with the number of tokens of each.
+	// They are only set when ChatPromptOptions.TokenizeMessages is set.
+	Messages []TokenizedMessage
+}
+
+// TokenizedMessage is a message of a chat prompt along with its number of tokens. The tokens count the
+// content and images of the message, but not the template around it.
+type TokenizedMessage struct {
+	api.Message
+	Tokens int
+}
+
+// trimmedPrompt builds a prompt to send to a running model. It ensures the prompt fits within a context window of
+// numCtx tokens, counted with encode, while preserving the most recent system message.
+func trimmedPrompt(ctx context.Context, chat *ChatHistory, model *Model, numCtx int, encode func(string) ([]int, error), opts ChatPromptOptions) (ChatPromptResult, error) {
+	it, err := NewChatPromptIterator(ctx, chat, model, numCtx, encode, opts)
+	if err != nil {
+		return ChatPromptResult{}, err
+	}
+
+	return renderChatPrompt(it)
+}
+
+// ChatPromptStats describes the work done to build a chat prompt
+type ChatPromptStats struct {
+	// TokenizationDuration is the time spent encoding text. Turns are encoded concurrently, so it can be longer
+	// than the time taken to build the prompt.
+	TokenizationDuration time.Duration
+	TotalTokens          int
+	MessagesDropped      int
+	ImagesDropped        int
+}
+
+// ChatPromptWithStats builds a prompt in the same way as trimmedPrompt, along with statistics of how it was built
+func ChatPromptWithStats(ctx context.Context, chat *ChatHistory, model *Model, numCtx int, encode func(string) ([]int, error), opts ChatPromptOptions) (ChatPromptResult, ChatPromptStats, error) {
+	var elapsed atomic.Int64
+	timed := func(s string) ([]int, error) {
+		start := time.Now()
+		defer func() { elapsed.Add(int64(time.Since(start))) }()
+		return encode(s)
+	}
+
+	result, err := trimmedPrompt(ctx, chat, model, numCtx, timed, opts)
+	if err != nil {
+		return ChatPromptResult{}, ChatPromptStats{}, err
+	}
+
+	return result, ChatPromptStats{
+		TokenizationDuration: time.Duration(elapsed.Load()),
+		TotalTokens:          result.Tokens,
+		MessagesDropped:      result.TruncatedPrompts,
+		ImagesDropped:        result.TruncatedImages,
+	}, nil
+}
+
+// renderChatPrompt renders every turn of the iterator into a single prompt
+func renderChatPrompt(it *ChatPromptIterator) (ChatPromptResult, error) {
+	result := it.Result()
+
+	var sb strings.Builder
+	for {
+		turn, ok := it.Next()
+		if !ok {
+			break
+		}
+		sb.WriteString(turn)
+	}
+
+	if err := it.Err(); err != nil {
+		return ChatPromptResult{}, err
+	}
+
+	result.Prompt = sb.String()
+	return result, nil
+}
+
+// Errors returned when building a chat prompt, they are wrapped with the details of the failure
+var (
+	// ErrInvalidRole is returned for a message with a role which is not supported
+	ErrInvalidRole = errors.New("invalid role")
+	// ErrTemplateExecution is returned when the template of the model cannot be rendered with a prompt
+	ErrTemplateExecution = errors.New("template execution failed")
+	// ErrTokenization is returned when a prompt cannot be encoded, it may succeed if retried
+	ErrTokenization = errors.New("tokenization failed")
+	// ErrContextWindowExhausted is returned when no tokens of the context window are left for the prompt, such as
+	// when the budget has been used by other requests
+	ErrContextWindowExhausted = errors.New("context window exhausted")
+	// ErrEmptyPrompt is returned when none of the messages have any content to render
+	ErrEmptyPrompt = errors.New("empty prompt")
+	// ErrTooManyImages is returned when the prompt has more images than ChatPromptOptions.MaxImages allows
+	ErrTooManyImages = errors.New("too many images")
+)
+
+// truncatePrompts selects the most recent prompts of the chat history which fit within the window of tokens,
+// returning them with the most recent prompt first
+func truncatePrompts(ctx context.Context, chat *ChatHistory, model *Model, window int, encode func(string) ([]int, error), opts ChatPromptOptions) ([]promptInfo, error) {
+	// the most recent prompt is kept even if it is longer than the window, but not if there is no room at all
+	if window <= 0 {
+		return nil, fmt.Errorf("%w: %d tokens available", ErrContextWindowExhausted, window)
+	}
+
+	prompts := make([]promptInfo, len(chat.Prompts))
+	for i, prompt := range chat.Prompts {
+		prompt.Response = CutAtStopSequence(prompt.Response, opts.StopSequences)
+		prompts[i] = promptInfo{vars: prompt, index: i}
+	}
+
+	// the most recent user prompt, and any prompts after it, are always kept along with their images so the
+	// latest question is not lost, older prompts are dropped instead. Their images are only dropped if an
+	// image does not fit within the context window by itself.
+	keep := len(prompts) - 1
+	for i := len(prompts) - 1; i >= 0; i-- {
+		if prompts[i].vars.Prompt != "" {
+			keep = i
+			break
+		}
+	}
+
+	// prompts with a priority are dropped in order of their priority rather than their age, so all of them are
+	// counted rather than only those which fit
+	prioritized := slices.ContainsFunc(prompts, func(p promptInfo) bool { return p.vars.Priority != 0 })
+	limit := window
+	if prioritized {
+		limit = math.MaxInt
+	}
+
+	if err := countTokensBatch(ctx, opts.renderer(model), prompts, encode, opts.TokenCache, opts.SystemPromptCache, keep, limit); err != nil {
+		return nil, err
+	}
+
+	// the assistant prefix is appended to the most recent prompt, so it takes up room in the window too
+	var prefixTokens int
+	if opts.AssistantPrefix != "" {
+		var err error
+		if prefixTokens, err = countTokens(encode, opts.AssistantPrefix); err != nil {
+			return nil, err
+		}
+
+		prompts[len(prompts)-1].tokenLen += prefixTokens
+	}
+
+	var dropped []bool
+	if prioritized {
+		var err error
+		if dropped, err = dropByPriority(encode, chat, prompts, keep, window); err != nil {
+			return nil, err
+		}
+	}
+
+	var promptsToAdd []promptInfo
+	var totalTokenLength, imageCount int
+
+	// reverse iterate through the prompts to build the prompt string in a way that fits the max context length
+	for i := len(prompts) - 1; i >= 0; i-- {
+		prompt, tokenLen := prompts[i].vars, prompts[i].tokenLen
+		if dropped != nil && dropped[i] {
+			continue
+		}
+
+		if dropped == nil && totalTokenLength+tokenLen > window && i < keep {
+			break // reached max context length, stop adding more prompts
+		}
+
+		var images []llm.ImageData
+		for j := range prompt.Images {
+			imageTokens := opts.imageTokens(prompt.Images[j], model.Name)
+			tooMany := opts.MaxImages > 0 && imageCount >= opts.MaxImages
+			if (i < keep && (totalTokenLength+imageTokens > window || tooMany)) || imageTokens > window {
+				// this decreases the token length but overestimating is fine
+				// placeholders without the image id are the same for every image, so only one is removed
+				model.removeImagePlaceholder(&prompt, prompt.Images[j].ID)
+				continue
+			}
+
+			totalTokenLength += imageTokens
+			imageCount++
+			images = append(images, prompt.Images[j])
+		}
+		prompt.Images = images
+
+		if opts.MaxImages > 0 && imageCount > opts.MaxImages {
+			return nil, fmt.Errorf("%w: %d images, the limit is %d", ErrTooManyImages, imageCount, opts.MaxImages)
+		}
+
+		totalTokenLength += tokenLen
+		promptsToAdd = append(promptsToAdd, promptInfo{vars: prompt, tokenLen: tokenLen, index: i})
+	}
+
+	promptsToAdd, err := propagateSystemPrompt(ctx, encode, chat, prompts, promptsToAdd, window, totalTokenLength, prioritized)
+	if err != nil {
+		return nil, err
+	}
+
+	kept := make(map[int]bool, len(promptsToAdd))
+	for _, prompt := range promptsToAdd {
+		kept[prompt.index] = true
+	}
+
+	for i := range prompts {
+		if !kept[i] {
+			observer().OnTruncateMessage(i)
+		}
+	}
+
+	promptsToAdd[len(promptsToAdd)-1].vars.First = true
+
+	if len(promptsToAdd) == 1 {
+		promptsToAdd[0].tokenLen -= prefixTokens
+		if err := fitPromptToWindow(ctx, &promptsToAdd[0], model, window-prefixTokens, encode, opts); err != nil {
+			return nil, err
+		}
+
+		promptsToAdd[0].tokenLen += prefixTokens
+	}
+
+	return promptsToAdd, nil
+}
+
+// fitPromptToWindow shortens the only prompt kept from the chat history when it is still longer than the window.
+// Its images are dropped first, then its content is cut to the longest prefix which fits, found by encoding
+// shorter prefixes. The prompt is left as it is if the template does not fit without any content.
+func fitPromptToWindow(ctx context.Context, info *promptInfo, model *Model, window int, encode func(string) ([]int, error), opts ChatPromptOptions) error {
+	imageTokens := func() (n int) {
+		for _, image := range info.vars.Images {
+			n += opts.imageTokens(image, model.Name)
+		}
+		return n
+	}
+
+	for len(info.vars.Images) > 0 && info.tokenLen+imageTokens() > window {
+		last := info.vars.Images[len(info.vars.Images)-1]
+		model.removeImagePlaceholder(&info.vars, last.ID)
+		info.vars.Images = info.vars.Images[:len(info.vars.Images)-1]
+	}
+
+	if info.tokenLen+imageTokens() <= window {
+		return nil
+	}
+
+	renderer := opts.renderer(model)
+	count := func(content string) (int, error) {
+		vars := info.vars
+		vars.Prompt = content
+
+		text, err := promptString(ctx, renderer, vars, true)
+		if err != nil {
+			return 0, err
+		}
+
+		return countPromptTokens(encode, opts.SystemPromptCache, renderer, vars, text)
+	}
+
+	// counted again since the images dropped above also removed their placeholders
+	tokens, err := count(info.vars.Prompt)
+	if err != nil || tokens <= window {
+		info.tokenLen = tokens
+		return err
+	}
+
+	empty, err := count("")
+	if err != nil {
+		return err
+	}
+
+	if empty > window {
+		slog.Warn("prompt template does not fit within the context window", "tokens", empty, "window", window)
+		info.tokenLen = tokens
+		return nil
+	}
+
+	// the prefix of lo runes fits and the prefix of hi runes does not
+	runes := []rune(info.vars.Prompt)
+	lo, hi, fit := 0, len(runes), empty
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		n, err := count(string(runes[:mid]))
+		if err != nil {
+			return err
+		}
+
+		if n <= window {
+			lo, fit = mid, n
+		} else {
+			hi = mid
+		}
+	}
+
+	slog.Warn("prompt content truncated to fit within the context window", "tokens", tokens, "window", window)
+	info.vars.Prompt = string(runes[:lo])
+	info.tokenLen = fit
+	return nil
+}
+
+// ChatPromptIterator renders a prompt built from a chat history one turn at a time, starting from the oldest turn.
+// The chat history is truncated to fit the context window when the iterator is created, but each turn is only
+// rendered when it is requested.
+type ChatPromptIterator struct {
+	ctx   context.Context
+	model *Model
+	opts  ChatPromptOptions
+
+	// prompts are the prompts which fit within the context window, most recent first
+	prompts []promptInfo
+	next    int
+
+	result ChatPromptResult
+	err    error
+}
+
+// NewChatPromptIterator truncates the chat history to fit a context window of numCtx tokens, counted with
+// encode, and returns an iterator over the turns of the resulting prompt
+func NewChatPromptIterator(ctx context.Context, chat *ChatHistory, model *Model, numCtx int, encode func(string) ([]int, error), opts ChatPromptOptions) (*ChatPromptIterator, error) {
+	window := opts.window(numCtx)
+	it := &ChatPromptIterator{ctx: ctx, model: model, opts: opts, next: -1}
+	if opts.ConversationID != "" {
+		checkTemplateVersion(opts.ConversationID, model.templateVersion())
+	}
+
+	if len(chat.Prompts) == 0 {
+		return it, nil
+	}
+
+	chat, err := opts.preparedHistory(chat, window)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(chat.Prompts) == 0 {
+		return nil, ErrEmptyPrompt
+	}
+
+	spanCtx, span := startPromptSpan(ctx, "ollama.chat_prompt")
+	defer span.End()
+	span.SetInt("message_count", len(chat.Prompts))
+	span.SetInt("window_size", window)
+
+	if chat, err = opts.fetchImages(spanCtx, chat); err != nil {
+		return nil, err
+	}
+
+	if opts.ImagePreprocessor != nil {
+		var err error
+		if chat, err = chat.preprocessedImages(opts.ImagePreprocessor); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(opts.RoleLimits) > 0 {
+		var err error
+		if chat, err = chat.limitedToRoles(opts.RoleLimits, encode); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.ThinkingEnabled {
+		chat = chat.withoutThinking()
+	}
+
+	prompts, err := truncatePrompts(spanCtx, chat, model, window, encode, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.CompressionLevel > 0 && len(prompts) < len(chat.Prompts) {
+		chat = chat.compressed(opts.CompressionLevel)
+		prompts, err = truncatePrompts(spanCtx, chat, model, window, encode, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var totalTokens int
+	for _, prompt := range prompts {
+		totalTokens += prompt.tokenLen
+	}
+
+	span.SetInt("truncated_messages", len(chat.Prompts)-len(prompts))
+	span.SetInt("total_tokens", totalTokens)
+
+	it.prompts = prompts
+	it.next = len(prompts) - 1
+	it.result.TruncatedPrompts = len(chat.Prompts) - len(prompts)
+
+	it.result.Tokens = totalTokens
+	// the prompts are ordered from the most recent, the images are in the order the turns are rendered
+	for i := len(prompts) - 1; i >= 0; i-- {
+		prompt := prompts[i]
+		for _, image := range prompt.vars.Images {
+			it.result.Tokens += opts.imageTokens(image, model.Name)
+		}
+
+		it.result.Images = append(it.result.Images, prompt.vars.Images...)
+		it.result.SystemPreserved = it.result.SystemPreserved || (chat.LastSystem != "" && prompt.vars.System == chat.LastSystem)
+	}
+
+	// images of dropped prompts are counted as truncated along with those dropped to save space
+	for _, prompt := range chat.Prompts {
+		it.result.TruncatedImages += len(prompt.Images)
+	}
+	it.result.TruncatedImages -= len(it.result.Images)
+
+	if slices.ContainsFunc(prompts, func(p promptInfo) bool { return len(p.vars.Metadata) > 0 }) {
+		for i := len(prompts) - 1; i >= 0; i-- {
+			it.result.TurnMetadata = append(it.result.TurnMetadata, prompts[i].vars.Metadata)
+		}
+	}
+
+	if opts.TokenizeMessages {
+		for i := len(prompts) - 1; i >= 0; i-- {
+			msgs, err := tokenizeMessages(prompts[i].vars, model, encode, opts)
+			if err != nil {
+				return nil, err
+			}
+
+			it.result.Messages = append(it.result.Messages, msgs...)
+		}
+	}
+
+	return it, nil
+}
+
+// tokenizeMessages returns the messages which make up the prompt in the order they are usually rendered,
+// with the number of tokens of each
+func tokenizeMessages(vars PromptVars, model *Model, encode func(string) ([]int, error), opts ChatPromptOptions) ([]TokenizedMessage, error) {
+	parts := []struct {
+		role, content string
+		images        []llm.ImageData
+	}{
+		{"system", vars.System, nil},
+		{"developer", vars.Developer, nil},
+		{"user", vars.Prompt, vars.Images},
+		{"tool", vars.Tool, nil},
+		{"tool_result", vars.ToolResult, nil},
+		{"assistant", vars.Response, nil},
+	}
+
+	var msgs []TokenizedMessage
+	for _, part := range parts {
+		if part.content == "" && len(part.images) == 0 {
+			continue
+		}
+
+		// the token ids of a response are counted as they are
+		ids, ok := vars.responseTokenIDs()
+		tokens := len(ids)
+		if !ok || part.role != "assistant" {
+			var err error
+			if tokens, err = countTokens(encode, part.content); err != nil {
+				return nil, err
+			}
+		}
+
+		msg := TokenizedMessage{Message: api.Message{Role: part.role, Content: part.content}, Tokens: tokens}
+		for _, image := range part.images {
+			msg.Images = append(msg.Images, image.Data)
+			msg.Tokens += opts.imageTokens(image, model.Name)
+		}
+
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
+// Next renders the next turn of the prompt. It returns false when there are no more turns or rendering
+// a turn fails, Err reports which.
+func (it *ChatPromptIterator) Next() (string, bool) {
+	if it.err != nil || it.next < 0 {
+		return "", false
+	}
+
+	mostRecent := it.next == 0
+	turn, err := promptString(it.ctx, it.opts.renderer(it.model), it.prompts[it.next].vars, mostRecent)
+	if err != nil {
+		it.err = err
+		return "", false
+	}
+
+	if mostRecent {
+		turn += it.opts.AssistantPrefix
+		if it.opts.ThinkingEnabled && it.prompts[it.next].vars.Response == "" {
+			turn += thinkingStart + "\n"
+		}
+	}
+
+	it.next--
+	return turn, true
+}
+
+// Err returns the error which stopped the iteration, if any
+func (it *ChatPromptIterator) Err() error {
+	return it.err
+}
+
+// Result returns the images and truncation details of the prompt. The prompt itself is left empty, its
+// turns are returned by Next.
+func (it *ChatPromptIterator) Result() ChatPromptResult {
+	return it.result
+}
+
+// countTokensBatch renders each prompt, the last being the most recent, and sets its token length. Prompts are
+// tokenized from the most recent in batches of up to GOMAXPROCS, except for those whose token length is in the
+// cache. Tokenizing stops once the prompts from keep onwards are counted and the total is past the window, the
+// older prompts are left with no token length as they would not fit anyway.
+func countTokensBatch(ctx context.Context, renderer PromptRenderer, prompts []promptInfo, encode func(string) ([]int, error), cache *CachedChatHistory, system *SystemPromptCache, keep, window int) error {
+	cache.use(renderer)
+
+	count := func(i int) (err error) {
+		_, span := startPromptSpan(ctx, "ollama.count_tokens")
+		defer span.End()
+
+		observer().OnTokenizeStart(i)
+		start := time.Now()
+		defer func() { observer().OnTokenizeEnd(i, prompts[i].tokenLen, time.Since(start)) }()
+
+		text, err := promptString(ctx, renderer, prompts[i].vars, i == len(prompts)-1)
+		if err != nil {
+			return err
+		}
+
+		var cached bool
+		if prompts[i].tokenLen, cached = cache.lookup(text); !cached {
+			if prompts[i].tokenLen, err = countTurnTokens(ctx, encode, system, renderer, prompts[i].vars, text, i == len(prompts)-1); err != nil {
+				return err
+			}
+			cache.store(text, prompts[i].tokenLen)
+		}
+
+		span.SetInt("tokens", prompts[i].tokenLen)
+		return nil
+	}
+
+	batch := runtime.GOMAXPROCS(0)
+	var total int
+	for end := len(prompts); end > 0; end -= batch {
+		// stop early if the request has been cancelled, the remaining prompts may take a while to tokenize
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		begin := max(end-batch, 0)
+		errs := make([]error, end-begin)
+
+		var wg sync.WaitGroup
+		for i := begin; i < end; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i-begin] = count(i)
+			}(i)
+		}
+		wg.Wait()
+
+		// report the error of the most recent prompt, as tokenizing one at a time would
+		for i := len(errs) - 1; i >= 0; i-- {
+			if errs[i] != nil {
+				return errs[i]
+			}
+		}
+
+		for i := begin; i < end; i++ {
+			total += prompts[i].tokenLen
+		}
+
+		if begin <= keep && total > window {
+			break
+		}
+	}
+
+	return nil
+}
+
+// countTokens returns the number of tokens in the text when encoded
+func countTokens(encode func(string) ([]int, error), text string) (int, error) {
+	tokens, err := encode(text)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrTokenization, err)
+	}
+
+	if len(tokens) == 0 && len(text) > 10 {
+		// a tokenizer should not return nothing for this much text, estimate rather than letting the prompt grow unchecked
+		slog.Warn("encoding returned no tokens, estimating token count", "length", len(text))
+		return len(text) / 4, nil
+	}
+
+	return len(tokens), nil
+}
+
+// promptString applies the renderer to the prompt. The most recent prompt is cut before the end of the response,
+// so the model continues from it.
+func promptString(ctx context.Context, renderer PromptRenderer, vars PromptVars, isMostRecent bool) (string, error) {
+	if r, ok := renderer.(whitespaceRenderer); ok {
+		return r.render(ctx, vars, isMostRecent)
+	}
+
+	var p string
+	var err error
+	if r, ok := renderer.(goTemplateRenderer); ok {
+		// templates are rendered in the same way, but can be stopped early if ctx is done
+		p, err = PromptWithContext(ctx, r.template, vars, isMostRecent)
+	} else {
+		p, err = renderer.Render(vars, isMostRecent)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", err
+		}
+		if isMostRecent {
+			return "", fmt.Errorf("%w: pre-response template: %w", ErrTemplateExecution, err)
+		}
+		return "", fmt.Errorf("%w: %w", ErrTemplateExecution, err)
+	}
+	return p, nil
+}
+
+// propagateSystemPrompt carries the system and developer messages of the dropped prompts forward to the prompts
+// which were kept, given oldest first and most recent first respectively. The system message is the most recent one
+// of the chat history, or of the dropped prompts for a chat history which was not built from messages. It is only
+// carried forward if none of the kept prompts has its own, and older prompts are dropped to make room for it. The
+// most recent developer message of the dropped prompts is then added to the earliest kept prompt, if none of the
+// kept prompts has one and it fits within the window, no prompts are dropped to make room for it. When the prompts
+// were chosen by priority, room for both is already reserved, so they are added to the earliest kept prompt
+// without dropping any of the prompts chosen.
+func propagateSystemPrompt(ctx context.Context, encode func(string) ([]int, error), chat *ChatHistory, prompts, promptsToAdd []promptInfo, window, totalTokenLength int, prioritized bool) ([]promptInfo, error) {
+	kept := func(field func(PromptVars) string) bool {
+		return slices.ContainsFunc(promptsToAdd, func(p promptInfo) bool { return field(p.vars) != "" })
+	}
+
+	// dropped returns the most recent value of the field among the prompts dropped before the earliest kept prompt
+	dropped := func(field func(PromptVars) string) string {
+		for i := promptsToAdd[len(promptsToAdd)-1].index - 1; i >= 0; i-- {
+			if value := field(prompts[i].vars); value != "" {
+				return value
+			}
+		}
+
+		return ""
+	}
+
+	system := func(p PromptVars) string { return p.System }
+	if !kept(system) {
+		systemPrompt := chat.LastSystem
+		if systemPrompt == "" {
+			systemPrompt = dropped(system)
+		}
+
+		if systemPrompt != "" {
+			// the images of the system message are left with the prompt it was part of
+			systemPrompt = chat.withoutSystemImages(systemPrompt)
+
+			if prioritized {
+				tokens, err := countTokens(encode, systemPrompt)
+				if err != nil {
+					return nil, err
+				}
+
+				earliest := &promptsToAdd[len(promptsToAdd)-1]
+				earliest.vars.System = systemPrompt
+				earliest.tokenLen += tokens
+				totalTokenLength += tokens
+			} else {
+				// the total changes by the system prompt and the prompts dropped for it
+				before := promptTokens(promptsToAdd)
+
+				var err error
+				if promptsToAdd, err = includeSystemPrompt(ctx, encode, systemPrompt, window, totalTokenLength, promptsToAdd); err != nil {
+					return nil, err
+				}
+
+				totalTokenLength += promptTokens(promptsToAdd) - before
+			}
+		}
+	}
+
+	developer := func(p PromptVars) string { return p.Developer }
+	if !kept(developer) {
+		if developerPrompt := dropped(developer); developerPrompt != "" {
+			tokens, err := countTokens(encode, developerPrompt)
+			if err != nil {
+				return nil, err
+			}
+
+			if prioritized || totalTokenLength+tokens <= window {
+				earliest := &promptsToAdd[len(promptsToAdd)-1]
+				earliest.vars.Developer = developerPrompt
+				earliest.tokenLen += tokens
+			}
+		}
+	}
+
+	return promptsToAdd, nil
+}
+
+// dropByPriority chooses which prompts to drop so the prompts fit within the window, along with the most recent
+// system and developer messages which may need to be carried forward. Prompts with the lowest priority are dropped first, and the
+// oldest of those with the same priority. Pinned prompts, with a positive priority, and the prompts from the most
+// recent user prompt at keep onwards are never dropped.
+func dropByPriority(encode func(string) ([]int, error), chat *ChatHistory, prompts []promptInfo, keep, window int) ([]bool, error) {
+	// the system and developer prompts are carried into the kept prompts unless one of the prompts which are never
+	// dropped has its own, so room is reserved for them
+	own := func(field func(PromptVars) string) bool {
+		for i, prompt := range prompts {
+			if (i >= keep || prompt.vars.Priority > 0) && field(prompt.vars) != "" {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	var reserved int
+	if chat.LastSystem != "" && !own(func(p PromptVars) string { return p.System }) {
+		var err error
+		if reserved, err = countTokens(encode, chat.LastSystem); err != nil {
+			return nil, err
+		}
+	}
+
+	if !own(func(p PromptVars) string { return p.Developer }) {
+		for i := keep - 1; i >= 0; i-- {
+			if developer := prompts[i].vars.Developer; developer != "" {
+				tokens, err := countTokens(encode, developer)
+				if err != nil {
+					return nil, err
+				}
+
+				reserved += tokens
+				break
+			}
+		}
+	}
+
+	var total, pinned int
+	var candidates []int
+	for i, prompt := range prompts {
+		total += prompt.tokenLen
+		switch {
+		case prompt.vars.Priority > 0:
+			pinned += prompt.tokenLen
+		case i < keep:
+			candidates = append(candidates, i)
+		}
+	}
+
+	if pinned > window {
+		return nil, fmt.Errorf("%w: pinned messages use %d tokens, the window is %d", ErrContextWindowExhausted, pinned, window)
+	}
+
+	// the carried system and developer prompts are added without dropping pinned prompts, so they must fit too
+	if pinned+reserved > window {
+		return nil, fmt.Errorf("%w: pinned messages use %d tokens and the system and developer messages %d, the window is %d", ErrContextWindowExhausted, pinned, reserved, window)
+	}
+
+	// the sort is stable so the oldest prompts of each priority are dropped first
+	slices.SortStableFunc(candidates, func(a, b int) int {
+		return cmp.Compare(prompts[a].vars.Priority, prompts[b].vars.Priority)
+	})
+
+	dropped := make([]bool, len(prompts))
+	for _, i := range candidates {
+		if total+reserved <= window {
+			break
+		}
+
+		dropped[i] = true
+		total -= prompts[i].tokenLen
+	}
+
+	return dropped, nil
+}
+
+// promptTokens returns the total token length of the prompts, not counting their images
+func promptTokens(prompts []promptInfo) (n int) {
+	for _, prompt := range prompts {
+		n += prompt.tokenLen
+	}
+
+	return n
+}
+
+// includeSystemPrompt adjusts the prompts to include the system prompt.
+func includeSystemPrompt(ctx context.Context, encode func(string) ([]int, error), systemPrompt string, window, totalTokenLength int, promptsToAdd []promptInfo) ([]promptInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	systemTokens, err := countTokens(encode, systemPrompt)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(promptsToAdd) - 1; i >= 0; i-- {
+		if totalTokenLength+systemTokens <= window {
+			promptsToAdd[i].vars.System = systemPrompt
+			promptsToAdd[i].tokenLen += systemTokens
+			return promptsToAdd[:i+1], nil
+		}
+		totalTokenLength -= promptsToAdd[i].tokenLen
+	}
+
+	// if got here, system did not fit anywhere, so return the most recent user prompt, along with any prompts after
+	// it, with the system message set
+	recent := 0
+	for recent < len(promptsToAdd)-1 && promptsToAdd[recent].vars.Prompt == "" {
+		recent++
+	}
+
+	promptsToAdd[recent].vars.System = systemPrompt
+	promptsToAdd[recent].tokenLen += systemTokens
+	return promptsToAdd[:recent+1], nil
+}
@@ -0,0 +1,1463 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+func Test_ChatPrompt(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		chat     *ChatHistory
+		numCtx   int
+		runner   MockLLM
+		want     string
+		wantErr  string
+	}{
+		{
+			name:     "Single Message",
+			template: "[INST] {{ .System }} {{ .Prompt }} [/INST]",
+			chat: &ChatHistory{
+				Prompts: []PromptVars{
+					{
+						System: "You are a Wizard.",
+						Prompt: "What are the potion ingredients?",
+						First:  true,
+					},
+				},
+				LastSystem: "You are a Wizard.",
+			},
+			numCtx: 1,
+			runner: MockLLM{
+				encoding: []int{1}, // fit the ctxLen
+			},
+			want: "[INST] You are a Wizard. What are the potion ingredients? [/INST]",
+		},
+		{
+			name:     "First Message",
+			template: "[INST] {{if .First}}Hello!{{end}} {{ .System }} {{ .Prompt }} [/INST]",
+			chat: &ChatHistory{
+				Prompts: []PromptVars{
+					{
+						System:   "You are a Wizard.",
+						Prompt:   "What are the potion ingredients?",
+						Response: "eye of newt",
+						First:    true,
+					},
+					{
+						Prompt: "Anything else?",
+					},
+				},
+				LastSystem: "You are a Wizard.",
+			},
+			numCtx: 2,
+			runner: MockLLM{
+				encoding: []int{1}, // fit the ctxLen
+			},
+			want: "[INST] Hello! You are a Wizard. What are the potion ingredients? [/INST]eye of newt[INST]   Anything else? [/INST]",
+		},
+		{
+			name:     "Message History",
+			template: "[INST] {{ .System }} {{ .Prompt }} [/INST]",
+			chat: &ChatHistory{
+				Prompts: []PromptVars{
+					{
+						System:   "You are a Wizard.",
+						Prompt:   "What are the potion ingredients?",
+						Response: "sugar",
+						First:    true,
+					},
+					{
+						Prompt: "Anything else?",
+					},
+				},
+				LastSystem: "You are a Wizard.",
+			},
+			numCtx: 4,
+			runner: MockLLM{
+				encoding: []int{1}, // fit the ctxLen, 1 for each message
+			},
+			want: "[INST] You are a Wizard. What are the potion ingredients? [/INST]sugar[INST]  Anything else? [/INST]",
+		},
+		{
+			name:     "Assistant Only",
+			template: "[INST] {{ .System }} {{ .Prompt }} [/INST]",
+			chat: &ChatHistory{
+				Prompts: []PromptVars{
+					{
+						Response: "everything nice",
+						First:    true,
+					},
+				},
+			},
+			numCtx: 1,
+			runner: MockLLM{
+				encoding: []int{1},
+			},
+			want: "[INST]   [/INST]everything nice",
+		},
+		{
+			name:     "Message History Truncated, No System",
+			template: "[INST] {{ .System }} {{ .Prompt }} [/INST]",
+			chat: &ChatHistory{
+				Prompts: []PromptVars{
+					{
+						Prompt:   "What are the potion ingredients?",
+						Response: "sugar",
+						First:    true,
+					},
+					{
+						Prompt:   "Anything else?",
+						Response: "spice",
+					},
+					{
+						Prompt: "... and?",
+					},
+				},
+			},
+			numCtx: 2, // only 1 message from history and most recent message
+			runner: MockLLM{
+				encoding: []int{1},
+			},
+			want: "[INST]  Anything else? [/INST]spice[INST]  ... and? [/INST]",
+		},
+		{
+			name:     "System is Preserved when Truncated",
+			template: "[INST] {{ .System }} {{ .Prompt }} [/INST]",
+			chat: &ChatHistory{
+				Prompts: []PromptVars{
+					{
+						Prompt:   "What are the magic words?",
+						Response: "abracadabra",
+					},
+					{
+						Prompt: "What is the spell for invisibility?",
+					},
+				},
+				LastSystem: "You are a wizard.",
+			},
+			numCtx: 2,
+			runner: MockLLM{
+				encoding: []int{1},
+			},
+			want: "[INST] You are a wizard. What is the spell for invisibility? [/INST]",
+		},
+		{
+			name:     "System is Preserved when Length Exceeded",
+			template: "[INST] {{ .System }} {{ .Prompt }} [/INST]",
+			chat: &ChatHistory{
+				Prompts: []PromptVars{
+					{
+						Prompt:   "What are the magic words?",
+						Response: "abracadabra",
+					},
+					{
+						Prompt: "What is the spell for invisibility?",
+					},
+				},
+				LastSystem: "You are a wizard.",
+			},
+			numCtx: 1,
+			runner: MockLLM{
+				encoding: []int{1},
+			},
+			want: "[INST] You are a wizard. What is the spell for invisibility? [/INST]",
+		},
+		{
+			name:     "First is Preserved when Truncated",
+			template: "[INST] {{ if .First }}{{ .System }} {{ end }}{{ .Prompt }} [/INST]",
+
+			chat: &ChatHistory{
+				Prompts: []PromptVars{
+					// first message omitted for test
+					{
+						Prompt:   "Do you have a magic hat?",
+						Response: "Of course.",
+					},
+					{
+						Prompt: "What is the spell for invisibility?",
+					},
+				},
+				LastSystem: "You are a wizard.",
+			},
+			numCtx: 3, // two most recent messages and room for system message
+			runner: MockLLM{
+				encoding: []int{1},
+			},
+			want: "[INST] You are a wizard. Do you have a magic hat? [/INST]Of course.[INST] What is the spell for invisibility? [/INST]",
+		},
+		{
+			name:     "Template Actions in Messages are not Executed",
+			template: "[INST] {{ .System }} {{ .Prompt }} [/INST]",
+			chat: &ChatHistory{
+				Prompts: []PromptVars{
+					{
+						System:   "You are a Wizard.",
+						Prompt:   "What is {{.System}}?",
+						Response: "{{ .Prompt }}",
+						First:    true,
+					},
+					{
+						Prompt: "{{ if .First }}Hello!{{ end }}",
+					},
+				},
+				LastSystem: "You are a Wizard.",
+			},
+			numCtx: 2,
+			runner: MockLLM{
+				encoding: []int{1},
+			},
+			want: "[INST] You are a Wizard. What is {{.System}}? [/INST]{{ .Prompt }}[INST]  {{ if .First }}Hello!{{ end }} [/INST]",
+		},
+		{
+			name:     "Most recent message is returned when longer than ctxLen",
+			template: "[INST] {{ .Prompt }} [/INST]",
+
+			chat: &ChatHistory{
+				Prompts: []PromptVars{
+					{
+						Prompt: "What is the spell for invisibility?",
+						First:  true,
+					},
+				},
+			},
+			numCtx: 1, // two most recent messages
+			runner: MockLLM{
+				encoding: []int{1, 2},
+			},
+			want: "[INST] What is the spell for invisibility? [/INST]",
+		},
+	}
+
+	for _, testCase := range tests {
+		tt := testCase
+		m := &Model{
+			Template: tt.template,
+		}
+		t.Run(tt.name, func(t *testing.T) {
+			encode := func(s string) ([]int, error) {
+				return tt.runner.Encode(context.Background(), s)
+			}
+			// TODO: add tests for trimming images
+			result, err := trimmedPrompt(context.Background(), tt.chat, m, tt.numCtx, encode, ChatPromptOptions{})
+			got := result.Prompt
+			if tt.wantErr != "" {
+				if err == nil {
+					t.Errorf("ChatPrompt() expected error, got nil")
+				}
+				if !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("ChatPrompt() error = %v, wantErr %v", err, tt.wantErr)
+				}
+			}
+			if got != tt.want {
+				t.Errorf("ChatPrompt() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_ChatPromptTruncation(t *testing.T) {
+	m := &Model{Template: "[INST] {{ .System }} {{ .Prompt }} [/INST]"}
+
+	chat := &ChatHistory{
+		Prompts: []PromptVars{
+			{
+				Prompt:   "What are the magic words? [img-0]",
+				Response: "abracadabra",
+				Images:   []llm.ImageData{{ID: 0}},
+				First:    true,
+			},
+			{
+				Prompt:   "Do you have a magic hat?",
+				Response: "Of course.",
+			},
+			{
+				Prompt: "What is the spell for invisibility?",
+			},
+		},
+		LastSystem: "You are a wizard.",
+	}
+
+	encode, numCtx := mockEncode(1), 3
+
+	result, err := trimmedPrompt(context.Background(), chat, m, numCtx, encode, ChatPromptOptions{})
+	if err != nil {
+		t.Fatalf("ChatPrompt() error = %v", err)
+	}
+
+	want := ChatPromptResult{
+		Prompt:           "[INST] You are a wizard. Do you have a magic hat? [/INST]Of course.[INST]  What is the spell for invisibility? [/INST]",
+		TruncatedPrompts: 1,
+		TruncatedImages:  1,
+		SystemPreserved:  true,
+		Tokens:           3,
+	}
+
+	assert.Equal(t, want, result)
+}
+
+func Test_ChatPromptPriority(t *testing.T) {
+	m := &Model{Template: "[INST] {{ .System }}{{ .Prompt }} [/INST]{{ .Response }}"}
+
+	messages := func(pinned int) []api.Message {
+		return []api.Message{
+			{Role: "system", Content: "You are a wizard."},
+			{Role: "user", Content: "Remember that my name is Merlin.", Priority: 1},
+			{Role: "assistant", Content: "I will."},
+			{Role: "user", Content: "What are the magic words?", Priority: pinned},
+			{Role: "assistant", Content: "abracadabra"},
+			{Role: "user", Content: "What is the weather?", Priority: -1},
+			{Role: "assistant", Content: "Sunny."},
+			{Role: "user", Content: "Do you have a magic hat?"},
+			{Role: "assistant", Content: "Of course."},
+			{Role: "user", Content: "What is the spell for invisibility?"},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		messages []api.Message
+		numCtx   int
+		want     string
+		wantErr  error
+	}{
+		{
+			name:     "Ephemeral Dropped First",
+			messages: messages(0),
+			numCtx:   4,
+			want:     "[INST] You are a wizard.Remember that my name is Merlin. [/INST]I will.[INST] What are the magic words? [/INST]abracadabra[INST] Do you have a magic hat? [/INST]Of course.[INST] What is the spell for invisibility? [/INST]",
+		},
+		{
+			name:     "Pinned Kept",
+			messages: messages(0),
+			numCtx:   2,
+			want:     "[INST] You are a wizard.Remember that my name is Merlin. [/INST]I will.[INST] What is the spell for invisibility? [/INST]",
+		},
+		{
+			name:     "Pinned Too Long",
+			messages: messages(1),
+			numCtx:   1,
+			wantErr:  ErrContextWindowExhausted,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chat, err := m.ChatPrompts(tt.messages, "")
+			if err != nil {
+				t.Fatalf("ChatPrompts() error = %v", err)
+			}
+
+			result, err := trimmedPrompt(context.Background(), chat, m, tt.numCtx, mockEncode(1), ChatPromptOptions{})
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, result.Prompt)
+		})
+	}
+}
+
+func Test_ChatPromptSystemImages(t *testing.T) {
+	m := &Model{
+		Template:       "[INST] {{ .System }}|{{ .Prompt }} [/INST]{{ .Response }}",
+		ProjectorPaths: []string{"projector"},
+	}
+
+	msgs := []api.Message{
+		{Role: "system", Content: "You answer questions about the chart.", Images: []api.ImageData{api.ImageData("chart")}},
+		{Role: "user", Content: "What is in this image?", Images: []api.ImageData{api.ImageData("cat")}},
+		{Role: "assistant", Content: "A cat."},
+		{Role: "user", Content: "Is it on the chart?"},
+	}
+
+	tests := []struct {
+		name       string
+		numCtx     int
+		want       string
+		wantImages []int
+		wantTokens int
+	}{
+		{
+			name:       "System Images Kept",
+			numCtx:     8,
+			want:       "[INST] You answer questions about the chart. [img-0]|What is in this image? [img-1] [/INST]A cat.[INST] |Is it on the chart? [/INST]",
+			wantImages: []int{0, 1},
+			wantTokens: 6,
+		},
+		{
+			name:       "Older Images Dropped",
+			numCtx:     2,
+			want:       "[INST] You answer questions about the chart.|What is in this image? [/INST]A cat.[INST] |Is it on the chart? [/INST]",
+			wantTokens: 2,
+		},
+		{
+			name:       "System Carried Without Images",
+			numCtx:     1,
+			want:       "[INST] You answer questions about the chart.|Is it on the chart? [/INST]",
+			wantTokens: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chat, err := m.ChatPrompts(msgs, "")
+			if err != nil {
+				t.Fatalf("ChatPrompts() error = %v", err)
+			}
+
+			result, err := trimmedPrompt(context.Background(), chat, m, tt.numCtx, mockEncode(1), ChatPromptOptions{ImageTokenCost: 2})
+			if err != nil {
+				t.Fatalf("ChatPrompt() error = %v", err)
+			}
+
+			var images []int
+			for _, image := range result.Images {
+				images = append(images, image.ID)
+			}
+
+			assert.Equal(t, tt.want, result.Prompt)
+			assert.Equal(t, tt.wantImages, images)
+			assert.Equal(t, tt.wantTokens, result.Tokens)
+		})
+	}
+}
+
+func Test_ChatPromptSystemAlwaysIncluded(t *testing.T) {
+	m := &Model{
+		Template: "[INST] {{ if .System }}<<SYS>>{{ .System }}<</SYS>> {{ end }}{{ .Prompt }} [/INST] {{ .Response }}",
+		System:   "You are a wizard.",
+	}
+
+	tests := []struct {
+		name          string
+		defaultSystem string
+		msgs          []api.Message
+		want          string
+	}{
+		{
+			name: "Model System",
+			msgs: []api.Message{{Role: "user", Content: "What are the magic words?"}},
+			want: "You are a wizard.",
+		},
+		{
+			name:          "Default System",
+			defaultSystem: "You are a witch.",
+			msgs:          []api.Message{{Role: "user", Content: "What are the magic words?"}},
+			want:          "You are a witch.",
+		},
+		{
+			name: "System After User",
+			msgs: []api.Message{
+				{Role: "user", Content: "What are the magic words?"},
+				{Role: "system", Content: "You are a witch."},
+			},
+			want: "You are a witch.",
+		},
+		{
+			name: "System Between Turns",
+			msgs: []api.Message{
+				{Role: "user", Content: "What are the magic words?"},
+				{Role: "assistant", Content: "abracadabra"},
+				{Role: "system", Content: "You are a witch."},
+				{Role: "user", Content: "Do you have a magic hat?"},
+			},
+			want: "You are a witch.",
+		},
+		{
+			name: "System Last",
+			msgs: []api.Message{
+				{Role: "user", Content: "What are the magic words?"},
+				{Role: "assistant", Content: "abracadabra"},
+				{Role: "user", Content: "Do you have a magic hat?"},
+				{Role: "system", Content: "You are a witch."},
+			},
+			want: "You are a witch.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chat, err := m.ChatPrompts(tt.msgs, tt.defaultSystem)
+			if err != nil {
+				t.Fatalf("ChatPrompts() error = %v", err)
+			}
+
+			// only the most recent turn fits, so the system prompt has to be carried into it
+			for _, numCtx := range []int{512, 1} {
+				result, err := trimmedPrompt(context.Background(), chat, m, numCtx, mockEncode(1), ChatPromptOptions{})
+				if err != nil {
+					t.Fatalf("ChatPrompt() error = %v", err)
+				}
+
+				assert.Contains(t, result.Prompt, "<<SYS>>"+tt.want+"<</SYS>>")
+				assert.True(t, result.SystemPreserved)
+			}
+		})
+	}
+}
+
+func Test_ChatPromptSystemPropagation(t *testing.T) {
+	m := &Model{Template: "[INST] {{ .System }}|{{ .Developer }}|{{ .Prompt }}{{ .ToolResult }} [/INST]{{ .Response }}"}
+
+	tests := []struct {
+		name   string
+		chat   *ChatHistory
+		numCtx int
+		want   string
+	}{
+		{
+			name: "From Dropped Prompts",
+			chat: &ChatHistory{
+				Prompts: []PromptVars{
+					{System: "You are a wizard.", Developer: "Answer briefly.", Prompt: "What are the magic words?", Response: "abracadabra", First: true},
+					{System: "You are a cat.", Prompt: "Meow?", Response: "Meow."},
+					{Prompt: "Do you have a magic hat?", Response: "Of course."},
+					{Prompt: "Can you make me invisible?", Response: "Yes."},
+					{Prompt: "What is the spell for invisibility?"},
+				},
+			},
+			// there is no room left for the developer prompt once the system prompt is carried forward
+			numCtx: 3,
+			want:   "[INST] You are a cat.||Can you make me invisible? [/INST]Yes.[INST] ||What is the spell for invisibility? [/INST]",
+		},
+		{
+			name: "Kept Prompt Has Its Own",
+			chat: &ChatHistory{
+				Prompts: []PromptVars{
+					{System: "You are a wizard.", Developer: "Answer briefly.", Prompt: "What are the magic words?", Response: "abracadabra", First: true},
+					{System: "You are a cat.", Developer: "Answer in rhyme.", Prompt: "Meow?", Response: "Meow."},
+					{Prompt: "What is the spell for invisibility?"},
+				},
+			},
+			numCtx: 2,
+			want:   "[INST] You are a cat.|Answer in rhyme.|Meow? [/INST]Meow.[INST] ||What is the spell for invisibility? [/INST]",
+		},
+		{
+			name: "System Does Not Fit",
+			chat: &ChatHistory{
+				Prompts: []PromptVars{
+					{Prompt: "Do you have a magic hat?", Response: "Of course.", First: true},
+					{Prompt: "What is the spell for invisibility?", Tool: "spells"},
+					{ToolResult: "Invisibilitas!"},
+				},
+				LastSystem: "You are a wizard.",
+			},
+			numCtx: 1,
+			want:   "[INST] You are a wizard.||What is the spell for invisibility? [/INST][INST] ||Invisibilitas! [/INST]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := trimmedPrompt(context.Background(), tt.chat, m, tt.numCtx, mockEncode(1), ChatPromptOptions{})
+			if err != nil {
+				t.Fatalf("ChatPrompt() error = %v", err)
+			}
+
+			assert.Equal(t, tt.want, result.Prompt)
+		})
+	}
+}
+
+func Test_ChatPromptDeveloperPropagation(t *testing.T) {
+	m := &Model{Template: "[INST] {{ .System }}|{{ .Developer }}|{{ .Prompt }} [/INST]{{ .Response }}"}
+	chat := &ChatHistory{
+		Prompts: []PromptVars{
+			{Developer: "Answer briefly.", Prompt: "What are the magic words?", Response: "abracadabra", First: true},
+			{Prompt: "Hat?", Response: "Yes."},
+			{Prompt: "Spell?"},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		numCtx int
+		want   string
+	}{
+		{
+			name:   "Fits",
+			numCtx: 8,
+			want:   "[INST] |Answer briefly.|Hat? [/INST]Yes.[INST] ||Spell? [/INST]",
+		},
+		{
+			name:   "Does Not Fit",
+			numCtx: 7,
+			want:   "[INST] ||Hat? [/INST]Yes.[INST] ||Spell? [/INST]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := trimmedPrompt(context.Background(), chat, m, tt.numCtx, NewMockEncoder(), ChatPromptOptions{})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, result.Prompt)
+		})
+	}
+}
+
+func Test_ChatPromptPinnedSystemPropagation(t *testing.T) {
+	m := &Model{Template: "[INST] {{ .System }}{{ .Prompt }} [/INST]{{ .Response }}"}
+
+	messages := []api.Message{
+		{Role: "user", Content: "Remember that my name is Merlin.", Priority: 1},
+		{Role: "assistant", Content: "I will."},
+		{Role: "system", Content: "You are a cat."},
+		{Role: "user", Content: "What are the magic words?"},
+		{Role: "assistant", Content: "abracadabra"},
+		{Role: "user", Content: "Do you have a magic hat?"},
+	}
+
+	tests := []struct {
+		name    string
+		numCtx  int
+		want    string
+		wantErr error
+	}{
+		{
+			name:   "Reserved",
+			numCtx: 3,
+			want:   "[INST] You are a cat.Remember that my name is Merlin. [/INST]I will.[INST] Do you have a magic hat? [/INST]",
+		},
+		{
+			// the pinned prompt is kept along with the system prompt, even though the most recent prompt does not fit
+			name:   "System Does Not Fit",
+			numCtx: 2,
+			want:   "[INST] You are a cat.Remember that my name is Merlin. [/INST]I will.[INST] Do you have a magic hat? [/INST]",
+		},
+		{
+			name:    "Pinned And System Too Long",
+			numCtx:  1,
+			wantErr: ErrContextWindowExhausted,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chat, err := m.ChatPrompts(messages, "")
+			if err != nil {
+				t.Fatalf("ChatPrompts() error = %v", err)
+			}
+
+			result, err := trimmedPrompt(context.Background(), chat, m, tt.numCtx, mockEncode(1), ChatPromptOptions{})
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, result.Prompt)
+		})
+	}
+}
+
+func Test_ChatPromptSingleMessageTruncation(t *testing.T) {
+	m := &Model{Template: "[INST] {{ .Prompt }} [/INST]"}
+	chat := &ChatHistory{
+		Prompts: []PromptVars{
+			{
+				Prompt: "What is the spell for invisibility? [img-0]",
+				Images: []llm.ImageData{{ID: 0}},
+				First:  true,
+			},
+		},
+	}
+
+	encode := NewMockEncoder()
+
+	result, err := trimmedPrompt(context.Background(), chat, m, 5, encode, ChatPromptOptions{ImageTokenCost: 4})
+	if err != nil {
+		t.Fatalf("ChatPrompt() error = %v", err)
+	}
+
+	assert.Equal(t, "[INST] What is the  [/INST]", result.Prompt)
+	assert.Empty(t, result.Images)
+	assert.Equal(t, 1, result.TruncatedImages)
+	assert.Equal(t, 5, result.Tokens)
+}
+
+func Test_ChatPromptIncompleteResponse(t *testing.T) {
+	m := &Model{Template: "[INST] {{ .Prompt }} [/INST] {{ .Response }}</s>"}
+
+	tests := []struct {
+		name       string
+		incomplete bool
+		want       string
+	}{
+		{
+			name:       "Incomplete",
+			incomplete: true,
+			want:       "[INST] What are the magic words? [/INST] abraca",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := "abracadabra"
+			if tt.incomplete {
+				response = "abraca"
+			}
+
+			chat, err := m.ChatPrompts([]api.Message{
+				{Role: "user", Content: "What are the magic words?"},
+				{Role: "assistant", Content: response, Incomplete: tt.incomplete},
+			}, "")
+			if err != nil {
+				t.Fatalf("ChatPrompts() error = %v", err)
+			}
+
+			result, err := trimmedPrompt(context.Background(), chat, m, 512, mockEncode(1), ChatPromptOptions{})
+			if err != nil {
+				t.Fatalf("ChatPrompt() error = %v", err)
+			}
+
+			assert.Equal(t, tt.want, result.Prompt)
+		})
+	}
+}
+
+func Test_ChatPromptTurnMetadata(t *testing.T) {
+	m := &Model{Template: "[INST] {{ .System }} {{ .Prompt }} [/INST] {{ .Response }}</s>"}
+
+	system := map[string]any{"temperature": 0.0}
+	chat, err := m.ChatPrompts([]api.Message{
+		{Role: "system", Content: "You are a wizard.", Metadata: system},
+		{Role: "user", Content: "What are the magic words?", Metadata: map[string]any{"top_p": 0.5}},
+		{Role: "assistant", Content: "abracadabra"},
+		{Role: "user", Content: "Say them again", Metadata: map[string]any{"temperature": 0.8}},
+	}, "")
+	if err != nil {
+		t.Fatalf("ChatPrompts() error = %v", err)
+	}
+
+	result, err := trimmedPrompt(context.Background(), chat, m, 512, mockEncode(1), ChatPromptOptions{})
+	if err != nil {
+		t.Fatalf("ChatPrompt() error = %v", err)
+	}
+
+	assert.Equal(t, []map[string]any{
+		{"temperature": 0.0, "top_p": 0.5},
+		{"temperature": 0.8},
+	}, result.TurnMetadata)
+
+	// the metadata of a message is copied rather than changed by later messages of the same turn
+	assert.Equal(t, map[string]any{"temperature": 0.0}, system)
+}
+
+func Test_ChatPromptImageTokenCost(t *testing.T) {
+	m := &Model{Template: "[INST] {{ .Prompt }} [/INST]"}
+
+	tests := []struct {
+		name       string
+		opts       ChatPromptOptions
+		images     []llm.ImageData
+		wantImages []int
+	}{
+		{
+			name:   "Default Cost",
+			images: []llm.ImageData{{ID: 0}},
+		},
+		{
+			name:       "Configured Cost",
+			opts:       ChatPromptOptions{ImageTokenCost: 256},
+			images:     []llm.ImageData{{ID: 0}},
+			wantImages: []int{0},
+		},
+		{
+			name:       "Image Cost Overrides Configured Cost",
+			opts:       ChatPromptOptions{ImageTokenCost: 256},
+			images:     []llm.ImageData{{ID: 0, Tokens: 1024}, {ID: 1, Tokens: 128}},
+			wantImages: []int{1},
+		},
+	}
+
+	encode, numCtx := mockEncode(1), 512
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chat := &ChatHistory{
+				Prompts: []PromptVars{
+					{
+						Prompt: "What is in these images? [img-0] [img-1]",
+						Images: tt.images,
+						First:  true,
+					},
+				},
+			}
+
+			result, err := trimmedPrompt(context.Background(), chat, m, numCtx, encode, tt.opts)
+			if err != nil {
+				t.Fatalf("ChatPrompt() error = %v", err)
+			}
+
+			var got []int
+			for _, image := range result.Images {
+				got = append(got, image.ID)
+			}
+
+			assert.Equal(t, tt.wantImages, got)
+		})
+	}
+}
+
+func Test_ChatPromptRecentImages(t *testing.T) {
+	m := &Model{Template: "[INST] {{ .Prompt }} [/INST]{{ .ToolResult }}"}
+	chat := &ChatHistory{
+		Prompts: []PromptVars{
+			{
+				Prompt:   "What is in this image? [img-0]",
+				Response: "A hat.",
+				Images:   []llm.ImageData{{ID: 0}},
+				First:    true,
+			},
+			{
+				Prompt: "And in this one? [img-1]",
+				Images: []llm.ImageData{{ID: 1}},
+			},
+			{
+				ToolResult: "A rabbit.",
+			},
+		},
+	}
+
+	// each image fills the context window, so only the images of the most recent user prompt fit
+	encode, numCtx := mockEncode(1), 8
+	result, err := trimmedPrompt(context.Background(), chat, m, numCtx, encode, ChatPromptOptions{ImageTokenCost: 8})
+	if err != nil {
+		t.Fatalf("ChatPrompt() error = %v", err)
+	}
+
+	assert.Equal(t, "[INST] And in this one? [img-1] [/INST][INST]  [/INST]A rabbit.", result.Prompt)
+	assert.Equal(t, []llm.ImageData{{ID: 1}}, result.Images)
+	assert.Equal(t, 1, result.TruncatedPrompts)
+}
+
+func Test_ChatPromptMaxImages(t *testing.T) {
+	m := &Model{Template: "[INST] {{ .Prompt }} [/INST]"}
+	chat := &ChatHistory{
+		Prompts: []PromptVars{
+			{
+				Prompt: "What is in these images? [img-0] [img-1]",
+				Images: []llm.ImageData{{ID: 0}, {ID: 1}},
+				First:  true,
+			},
+			{
+				Prompt: "And in these? [img-2] [img-3]",
+				Images: []llm.ImageData{{ID: 2}, {ID: 3}},
+			},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		maxImages  int
+		wantPrompt string
+		wantImages []int
+		wantErr    error
+	}{
+		{
+			name:       "Unlimited",
+			wantPrompt: "[INST] What is in these images? [img-0] [img-1] [/INST][INST] And in these? [img-2] [img-3] [/INST]",
+			wantImages: []int{0, 1, 2, 3},
+		},
+		{
+			name:       "Older Images Dropped",
+			maxImages:  3,
+			wantPrompt: "[INST] What is in these images? [img-0] [/INST][INST] And in these? [img-2] [img-3] [/INST]",
+			wantImages: []int{0, 2, 3},
+		},
+		{
+			name:      "Recent Images Over Limit",
+			maxImages: 1,
+			wantErr:   ErrTooManyImages,
+		},
+	}
+
+	encode, numCtx := mockEncode(1), 512
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := trimmedPrompt(context.Background(), chat, m, numCtx, encode, ChatPromptOptions{ImageTokenCost: 1, MaxImages: tt.maxImages})
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("ChatPrompt() error = %v", err)
+			}
+
+			var got []int
+			for _, image := range result.Images {
+				got = append(got, image.ID)
+			}
+
+			assert.Equal(t, tt.wantPrompt, result.Prompt)
+			assert.Equal(t, tt.wantImages, got)
+		})
+	}
+}
+
+func Test_ChatPromptCompression(t *testing.T) {
+	m := &Model{Template: "[INST] {{ .Prompt }} [/INST] {{ .Response }}"}
+	chat := &ChatHistory{
+		Prompts: []PromptVars{
+			{
+				Prompt:   "Summarize this log.",
+				Response: "It is the same line repeated.",
+				First:    true,
+			},
+			{
+				Prompt: strings.Repeat("error: connection refused by host ", 4),
+			},
+		},
+	}
+
+	encode := NewMockEncoder()
+
+	tests := []struct {
+		name          string
+		level         int
+		want          string
+		wantTruncated int
+	}{
+		{
+			name:          "Disabled",
+			want:          "[INST] error: connection refused by host error: connection refused by host error: connection refused by host error: connection refused by host  [/INST] ",
+			wantTruncated: 1,
+		},
+		{
+			name:  "Aliases",
+			level: 1,
+			want:  "[INST] Summarize this log. [/INST] It is the same line repeated.[INST] §1 = error: connection refused by host\n\n§1 §1 §1 §1  [/INST] ",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := trimmedPrompt(context.Background(), chat, m, 32, encode, ChatPromptOptions{CompressionLevel: tt.level})
+			if err != nil {
+				t.Fatalf("ChatPrompt() error = %v", err)
+			}
+
+			assert.Equal(t, tt.want, result.Prompt)
+			assert.Equal(t, tt.wantTruncated, result.TruncatedPrompts)
+		})
+	}
+}
+
+func Test_ChatPromptWithStats(t *testing.T) {
+	m := &Model{Template: "[INST] {{ .Prompt }} [/INST] {{ .Response }}"}
+	chat := &ChatHistory{
+		Prompts: []PromptVars{
+			{Prompt: "What are the magic words? [img-0]", Response: "abracadabra", Images: []llm.ImageData{{ID: 0}}, First: true},
+			{Prompt: "Do you have a magic hat?"},
+		},
+	}
+
+	var calls []string
+	encode := NewMockEncoder(WithLatency(time.Millisecond), WithCallRecorder(&calls))
+
+	result, stats, err := ChatPromptWithStats(context.Background(), chat, m, 10, encode, ChatPromptOptions{})
+	if err != nil {
+		t.Fatalf("ChatPromptWithStats() error = %v", err)
+	}
+
+	assert.Equal(t, "[INST] Do you have a magic hat? [/INST] ", result.Prompt)
+	assert.Equal(t, ChatPromptStats{
+		TokenizationDuration: stats.TokenizationDuration,
+		TotalTokens:          8,
+		MessagesDropped:      1,
+		ImagesDropped:        1,
+	}, stats)
+	assert.GreaterOrEqual(t, stats.TokenizationDuration, time.Duration(len(calls))*time.Millisecond)
+}
+
+func Test_ChatPromptErrors(t *testing.T) {
+	chat := &ChatHistory{Prompts: []PromptVars{{Prompt: "What are the magic words?", First: true}}}
+
+	tests := []struct {
+		name     string
+		template string
+		encode   func(string) ([]int, error)
+		opts     ChatPromptOptions
+		wantErr  error
+	}{
+		{
+			name:     "Template Execution",
+			template: "[INST] {{ .Prompt.Missing }} [/INST]",
+			encode:   mockEncode(1),
+			wantErr:  ErrTemplateExecution,
+		},
+		{
+			name:     "Tokenization",
+			template: "[INST] {{ .Prompt }} [/INST]",
+			encode: func(string) ([]int, error) {
+				return nil, errors.New("runner unavailable")
+			},
+			wantErr: ErrTokenization,
+		},
+		{
+			name:     "Context Window Exhausted",
+			template: "[INST] {{ .Prompt }} [/INST]",
+			encode:   mockEncode(1),
+			opts:     ChatPromptOptions{Budget: NewTokenBudgetManager(0)},
+			wantErr:  ErrContextWindowExhausted,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := trimmedPrompt(context.Background(), chat, &Model{Template: tt.template}, 512, tt.encode, tt.opts)
+			assert.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+
+	m := &Model{Template: "[INST] {{ .Prompt }} [/INST]"}
+
+	_, err := m.ChatPrompts([]api.Message{{Role: "narrator", Content: "Once upon a time"}}, "")
+	assert.ErrorIs(t, err, ErrInvalidRole)
+
+	_, err = m.ChatPrompts([]api.Message{{Role: "user"}}, "")
+	assert.ErrorIs(t, err, ErrEmptyPrompt)
+}
+
+func Test_ChatPromptImagePlaceholder(t *testing.T) {
+	tests := []struct {
+		name       string
+		format     string
+		wantChat   string
+		wantPrompt string
+	}{
+		{
+			name:       "Default Format",
+			wantChat:   "What is in these images? [img-0] [img-1]",
+			wantPrompt: "What is in these images? [img-1]",
+		},
+		{
+			name:       "Format Without Id",
+			format:     "<image>",
+			wantChat:   "What is in these images? <image> <image>",
+			wantPrompt: "What is in these images? <image>",
+		},
+		{
+			name:       "Format With Id",
+			format:     "<|image_%d|>",
+			wantChat:   "What is in these images? <|image_0|> <|image_1|>",
+			wantPrompt: "What is in these images? <|image_1|>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Model{
+				Template:               "{{ .Prompt }}",
+				ProjectorPaths:         []string{"projector"},
+				ImagePlaceholderFormat: tt.format,
+			}
+
+			chat, err := m.ChatPrompts([]api.Message{
+				{Role: "user", Content: "What is in these images?", Images: []api.ImageData{[]byte("image"), []byte("image")}},
+			}, "")
+			if err != nil {
+				t.Fatalf("ChatPrompts() error = %v", err)
+			}
+
+			assert.Equal(t, tt.wantChat, chat.Prompts[0].Prompt)
+
+			// the first image is too large for the context window, so it and its placeholder are dropped
+			chat.Prompts[0].Images[0].Tokens = 1024
+			chat.Prompts[0].Images[1].Tokens = 1
+
+			result, err := trimmedPrompt(context.Background(), chat, m, 512, mockEncode(1), ChatPromptOptions{})
+			if err != nil {
+				t.Fatalf("ChatPrompt() error = %v", err)
+			}
+
+			assert.Equal(t, tt.wantPrompt, result.Prompt)
+			assert.Len(t, result.Images, 1)
+		})
+	}
+}
+
+func Test_ChatPromptAssistantPrefix(t *testing.T) {
+	m := &Model{Template: "<|user|>\n{{ .Prompt }}<|end|>\n"}
+
+	tests := []struct {
+		name       string
+		numCtx     int
+		want       string
+		wantTokens int
+	}{
+		{
+			name:       "Fits",
+			numCtx:     4,
+			want:       "<|user|>\nWhat are the magic words?<|end|>\nabracadabra<|user|>\nWhat is the spell for invisibility?<|end|>\n<|assistant|>\n",
+			wantTokens: 3,
+		},
+		{
+			name:       "Prefix Counted",
+			numCtx:     2,
+			want:       "<|user|>\nWhat is the spell for invisibility?<|end|>\n<|assistant|>\n",
+			wantTokens: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chat := &ChatHistory{
+				Prompts: []PromptVars{
+					{
+						Prompt:   "What are the magic words?",
+						Response: "abracadabra",
+						First:    true,
+					},
+					{
+						Prompt: "What is the spell for invisibility?",
+					},
+				},
+			}
+
+			result, err := trimmedPrompt(context.Background(), chat, m, tt.numCtx, mockEncode(1), ChatPromptOptions{AssistantPrefix: "<|assistant|>\n"})
+			if err != nil {
+				t.Fatalf("ChatPrompt() error = %v", err)
+			}
+
+			assert.Equal(t, tt.want, result.Prompt)
+			assert.True(t, strings.HasSuffix(result.Prompt, "<|assistant|>\n"))
+			assert.Equal(t, tt.wantTokens, result.Tokens)
+		})
+	}
+}
+
+func Test_ChatPromptThinking(t *testing.T) {
+	m := &Model{Template: "<|User|>{{ .Prompt }}<|Assistant|>{{ .Response }}<|end|>"}
+	chat := &ChatHistory{
+		Prompts: []PromptVars{
+			{
+				Prompt:   "What are the magic words?",
+				Response: "<think>\nThe user wants a spell.\n</think>\n\nabracadabra",
+				First:    true,
+			},
+			{
+				Prompt: "What is the spell for invisibility?",
+			},
+		},
+	}
+
+	result, err := trimmedPrompt(context.Background(), chat, m, 512, mockEncode(1), ChatPromptOptions{ThinkingEnabled: true})
+	if err != nil {
+		t.Fatalf("ChatPrompt() error = %v", err)
+	}
+
+	want := "<|User|>What are the magic words?<|Assistant|>abracadabra<|end|><|User|>What is the spell for invisibility?<|Assistant|><think>\n"
+	assert.Equal(t, want, result.Prompt)
+
+	// the chat history is not changed
+	assert.Contains(t, chat.Prompts[0].Response, "<think>")
+}
+
+func Test_ChatPromptEmptyEncoding(t *testing.T) {
+	m := &Model{Template: "[INST] {{ .Prompt }} [/INST]"}
+	chat := &ChatHistory{
+		Prompts: []PromptVars{
+			{
+				Prompt:   "What are the magic words?",
+				Response: "abracadabra",
+				First:    true,
+			},
+			{
+				Prompt: "What is the spell for invisibility?",
+			},
+		},
+	}
+
+	// a broken tokenizer that never returns any tokens
+	encode, numCtx := mockEncode(), 16
+
+	result, err := trimmedPrompt(context.Background(), chat, m, numCtx, encode, ChatPromptOptions{})
+	if err != nil {
+		t.Fatalf("ChatPrompt() error = %v", err)
+	}
+
+	// each prompt is estimated at over 10 tokens, so only the most recent prompt fits
+	assert.Equal(t, "[INST] What is the spell for invisibility? [/INST]", result.Prompt)
+	assert.Equal(t, 1, result.TruncatedPrompts)
+}
+
+func Test_ChatPromptResponseReservation(t *testing.T) {
+	m := &Model{Template: "[INST] {{ .Prompt }} [/INST]"}
+	chat := &ChatHistory{
+		Prompts: []PromptVars{
+			{
+				Prompt:   "What are the magic words?",
+				Response: "abracadabra",
+				First:    true,
+			},
+			{
+				Prompt:   "Do you have a magic hat?",
+				Response: "Of course.",
+			},
+			{
+				Prompt: "What is the spell for invisibility?",
+			},
+		},
+	}
+
+	// half of the context window is in use by another request
+	budget := NewTokenBudgetManager(4)
+	budget.Reserve(2)
+
+	tests := []struct {
+		name        string
+		reservation int
+		budget      *TokenBudgetManager
+		want        int
+	}{
+		{"No Reservation", 0, nil, 0},
+		{"Reservation", 2, nil, 1},
+		{"Negative Reservation", -2, nil, 0},
+		{"Reservation Limited to Half the Context", 8, nil, 1},
+		{"Remaining Budget", 0, budget, 1},
+		{"Reservation Within Remaining Budget", 1, budget, 1},
+	}
+
+	encode, numCtx := mockEncode(1), 4
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := trimmedPrompt(context.Background(), chat, m, numCtx, encode, ChatPromptOptions{ResponseReservation: tt.reservation, Budget: tt.budget})
+			if err != nil {
+				t.Fatalf("ChatPrompt() error = %v", err)
+			}
+
+			assert.Equal(t, tt.want, result.TruncatedPrompts)
+		})
+	}
+}
+
+func Test_ChatPromptIterator(t *testing.T) {
+	m := &Model{Template: "[INST] {{ .System }} {{ .Prompt }} [/INST]"}
+	chat := &ChatHistory{
+		Prompts: []PromptVars{
+			{
+				Prompt:   "What are the magic words?",
+				Response: "abracadabra",
+				First:    true,
+			},
+			{
+				Prompt:   "Do you have a magic hat?",
+				Response: "Of course.",
+			},
+			{
+				Prompt: "What is the spell for invisibility?",
+			},
+		},
+		LastSystem: "You are a wizard.",
+	}
+
+	encode, numCtx := mockEncode(1), 3
+
+	it, err := NewChatPromptIterator(context.Background(), chat, m, numCtx, encode, ChatPromptOptions{})
+	if err != nil {
+		t.Fatalf("NewChatPromptIterator() error = %v", err)
+	}
+
+	var turns []string
+	for {
+		turn, ok := it.Next()
+		if !ok {
+			break
+		}
+		turns = append(turns, turn)
+	}
+
+	assert.Nil(t, it.Err())
+	assert.Equal(t, []string{
+		"[INST] You are a wizard. Do you have a magic hat? [/INST]Of course.",
+		"[INST]  What is the spell for invisibility? [/INST]",
+	}, turns)
+	assert.Equal(t, 1, it.Result().TruncatedPrompts)
+
+	// the iterator is exhausted
+	_, ok := it.Next()
+	assert.False(t, ok)
+}
+
+func Test_ChatPromptStopSequences(t *testing.T) {
+	m := &Model{Template: "[INST] {{ .Prompt }} [/INST]"}
+	chat := &ChatHistory{
+		Prompts: []PromptVars{
+			{
+				Prompt:   "What are the magic words?",
+				Response: "abracadabra[INST] say it back [/INST]",
+				First:    true,
+			},
+			{
+				Prompt: "What is the spell for invisibility?",
+			},
+		},
+	}
+
+	encode, numCtx := mockEncode(1), 2
+
+	result, err := trimmedPrompt(context.Background(), chat, m, numCtx, encode, ChatPromptOptions{StopSequences: []string{"[INST]"}})
+	if err != nil {
+		t.Fatalf("ChatPrompt() error = %v", err)
+	}
+
+	assert.Equal(t, "[INST] What are the magic words? [/INST]abracadabra[INST] What is the spell for invisibility? [/INST]", result.Prompt)
+}
+
+func Test_ChatPromptCancelled(t *testing.T) {
+	m := &Model{Template: "[INST] {{ .Prompt }} [/INST]"}
+	chat := &ChatHistory{
+		Prompts: []PromptVars{
+			{
+				Prompt: "What is the spell for invisibility?",
+				First:  true,
+			},
+		},
+	}
+
+	encode, numCtx := mockEncode(1), 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := trimmedPrompt(ctx, chat, m, numCtx, encode, ChatPromptOptions{})
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+// upperRenderer renders prompts in upper case, with the response when cut is false
+type upperRenderer struct{}
+
+func (upperRenderer) Render(p PromptVars, cut bool) (string, error) {
+	if cut {
+		return strings.ToUpper(p.Prompt) + "\n", nil
+	}
+
+	return strings.ToUpper(p.Prompt) + "\n" + p.Response + "\n", nil
+}
+
+func Test_ChatPromptRenderer(t *testing.T) {
+	m := &Model{Template: "[INST] {{ .Prompt }} [/INST]"}
+	chat := &ChatHistory{
+		Prompts: []PromptVars{
+			{
+				Prompt:   "What are the magic words?",
+				Response: "abracadabra",
+				First:    true,
+			},
+			{
+				Prompt: "Do you have a magic hat?",
+			},
+		},
+	}
+
+	encode, numCtx := mockEncode(1), 16
+
+	result, err := trimmedPrompt(context.Background(), chat, m, numCtx, encode, ChatPromptOptions{Renderer: upperRenderer{}})
+	assert.NoError(t, err)
+	assert.Equal(t, "WHAT ARE THE MAGIC WORDS?\nabracadabra\nDO YOU HAVE A MAGIC HAT?\n", result.Prompt)
+
+	result, err = trimmedPrompt(context.Background(), chat, m, numCtx, encode, ChatPromptOptions{Renderer: NewGoTemplateRenderer(m.Template)})
+	assert.NoError(t, err)
+	assert.Equal(t, "[INST] What are the magic words? [/INST]abracadabra[INST] Do you have a magic hat? [/INST]", result.Prompt)
+}
+
+func Test_ChatPromptTokenizeMessages(t *testing.T) {
+	m := &Model{Template: "[INST] {{ .System }} {{ .Prompt }} [/INST]"}
+	chat := &ChatHistory{
+		Prompts: []PromptVars{
+			{
+				System:   "You are a wizard.",
+				Prompt:   "What are the magic words?",
+				Response: "abracadabra",
+				First:    true,
+			},
+			{
+				Prompt: "What is in this image? [img-0]",
+				Images: []llm.ImageData{{ID: 0, Data: []byte("image"), Tokens: 10}},
+			},
+		},
+		LastSystem: "You are a wizard.",
+	}
+
+	encode := NewMockEncoder()
+
+	result, err := trimmedPrompt(context.Background(), chat, m, 64, encode, ChatPromptOptions{TokenizeMessages: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []TokenizedMessage{
+		{Message: api.Message{Role: "system", Content: "You are a wizard."}, Tokens: 4},
+		{Message: api.Message{Role: "user", Content: "What are the magic words?"}, Tokens: 5},
+		{Message: api.Message{Role: "assistant", Content: "abracadabra"}, Tokens: 1},
+		{Message: api.Message{Role: "user", Content: "What is in this image? [img-0]", Images: []api.ImageData{[]byte("image")}}, Tokens: 16},
+	}, result.Messages)
+
+	result, err = trimmedPrompt(context.Background(), chat, m, 64, encode, ChatPromptOptions{})
+	assert.NoError(t, err)
+	assert.Nil(t, result.Messages)
+}
+
+// mockEncode returns an encode function which encodes any text as the tokens
+func mockEncode(tokens ...int) func(string) ([]int, error) {
+	return func(string) ([]int, error) {
+		return tokens, nil
+	}
+}
+
+func Test_CountTokensBatch(t *testing.T) {
+	m := &Model{Template: "[INST] {{ .Prompt }} [/INST]"}
+
+	var prompts []promptInfo
+	for i := 0; i < 40; i++ {
+		prompts = append(prompts, promptInfo{vars: PromptVars{Prompt: strings.Repeat("word ", i)}})
+	}
+
+	encode := NewMockEncoder()
+
+	err := countTokensBatch(context.Background(), NewGoTemplateRenderer(m.Template), prompts, encode, nil, nil, 0, math.MaxInt)
+	assert.NoError(t, err)
+
+	for i, prompt := range prompts {
+		assert.Equal(t, i+2, prompt.tokenLen, "prompt %d", i)
+	}
+
+	// only the most recent prompts are tokenized once they are past the window, in batches of GOMAXPROCS
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(2))
+
+	var encoded []string
+	for i := range prompts {
+		prompts[i].tokenLen = 0
+	}
+
+	err = countTokensBatch(context.Background(), NewGoTemplateRenderer(m.Template), prompts, NewMockEncoder(WithCallRecorder(&encoded)), nil, nil, 39, 100)
+	assert.NoError(t, err)
+	assert.Len(t, encoded, 4)
+	assert.Equal(t, 41, prompts[39].tokenLen)
+	assert.Equal(t, 38, prompts[36].tokenLen)
+	assert.Zero(t, prompts[35].tokenLen)
+
+	failing := func(s string) ([]int, error) {
+		return nil, fmt.Errorf("tokenize %q", s)
+	}
+
+	err = countTokensBatch(context.Background(), NewGoTemplateRenderer(m.Template), prompts[:3], failing, nil, nil, 0, math.MaxInt)
+	assert.ErrorIs(t, err, ErrTokenization)
+	assert.EqualError(t, err, fmt.Sprintf("tokenization failed: tokenize %q", "[INST] word word  [/INST]"))
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	// maxCompressionAliases is the most phrases replaced with an alias, aliases are numbered with a single digit
+	maxCompressionAliases = 9
+
+	// phrases of between minAliasWords and maxAliasWords words repeated at least minAliasRepeats times are
+	// replaced with an alias
+	minAliasWords   = 3
+	maxAliasWords   = 8
+	minAliasRepeats = 3
+
+	// maxAliasBytes is the longest text searched for repeated phrases, longer text is left for the other steps
+	maxAliasBytes = 64 << 10
+
+	compressionAlias = "§"
+)
+
+// compressionLevels are the steps used to compress text at each compression level, a level also uses the steps
+// of the levels before it. The first level replaces repeated phrases with aliases, the second normalizes
+// whitespace and removes repeated sentences.
+var compressionLevels = [][]func(string) string{
+	{aliasRepeatedPhrases},
+	{normalizeWhitespace, removeDuplicateSentences},
+}
+
+// CompressedPrompt shortens a rendered prompt which does not fit within targetTokens, counted with encode. Repeated
+// phrases are replaced with aliases first, then if the prompt is still too long its whitespace is normalized and
+// repeated sentences are removed. Compression is lossy and the result may still not fit, so callers should count
+// its tokens again.
+func CompressedPrompt(rendered string, targetTokens int, encode func(string) ([]int, error)) (string, error) {
+	for _, steps := range compressionLevels {
+		tokens, err := countTokens(encode, rendered)
+		if err != nil {
+			return "", err
+		}
+
+		if tokens <= targetTokens {
+			break
+		}
+
+		for _, step := range steps {
+			rendered = step(rendered)
+		}
+	}
+
+	return rendered, nil
+}
+
+// compressText applies the compression steps up to and including the level to s
+func compressText(s string, level int) string {
+	for _, steps := range compressionLevels[:min(level, len(compressionLevels))] {
+		for _, step := range steps {
+			s = step(s)
+		}
+	}
+
+	return s
+}
+
+// compressed returns a copy of the chat history with the content of its messages compressed, system messages are
+// kept as they are
+func (h *ChatHistory) compressed(level int) *ChatHistory {
+	c := *h
+	c.Prompts = make([]PromptVars, len(h.Prompts))
+	for i, prompt := range h.Prompts {
+		prompt.Prompt = compressText(prompt.Prompt, level)
+		prompt.Response = compressText(prompt.Response, level)
+		prompt.ToolResult = compressText(prompt.ToolResult, level)
+		c.Prompts[i] = prompt
+	}
+
+	return &c
+}
+
+// aliasRepeatedPhrases replaces the phrases repeated most often in s with short aliases, which are defined at the
+// start of the text
+func aliasRepeatedPhrases(s string) string {
+	// aliases could be confused with the text otherwise
+	if len(s) > maxAliasBytes || strings.Contains(s, compressionAlias) {
+		return s
+	}
+
+	var legend strings.Builder
+	for i := 1; i <= maxCompressionAliases; i++ {
+		alias := fmt.Sprintf("%s%d", compressionAlias, i)
+		phrase := mostRepeatedPhrase(s, alias)
+		if phrase == "" {
+			break
+		}
+
+		s = strings.ReplaceAll(s, phrase, alias)
+		fmt.Fprintf(&legend, "%s = %s\n", alias, phrase)
+	}
+
+	if legend.Len() == 0 {
+		return s
+	}
+
+	return legend.String() + "\n" + s
+}
+
+// mostRepeatedPhrase returns the repeated phrase of s which saves the most bytes when replaced with alias, or an
+// empty string if no phrase is worth replacing
+func mostRepeatedPhrase(s, alias string) string {
+	// the offsets of each word, phrases are taken from s so they keep the whitespace between their words
+	var starts, ends []int
+	inWord := false
+	for i, r := range s {
+		switch space := unicode.IsSpace(r); {
+		case !space && !inWord:
+			starts = append(starts, i)
+		case space && inWord:
+			ends = append(ends, i)
+		}
+		inWord = !unicode.IsSpace(r)
+	}
+
+	if inWord {
+		ends = append(ends, len(s))
+	}
+
+	type occurrences struct {
+		count, end int
+	}
+
+	var best string
+	var bestSaving int
+	for n := maxAliasWords; n >= minAliasWords; n-- {
+		counts := make(map[string]*occurrences)
+		for i := 0; i+n <= len(starts); i++ {
+			start, end := starts[i], ends[i+n-1]
+			phrase := s[start:end]
+
+			o, ok := counts[phrase]
+			if !ok {
+				o = &occurrences{}
+				counts[phrase] = o
+			}
+
+			// overlapping occurrences are not replaced, so they are not counted
+			if start >= o.end {
+				o.count++
+				o.end = end
+			}
+		}
+
+		for phrase, o := range counts {
+			if o.count < minAliasRepeats || strings.Contains(phrase, compressionAlias) {
+				continue
+			}
+
+			// each replacement shortens the text, but the phrase is written again in the legend
+			saving := o.count*(len(phrase)-len(alias)) - len(alias) - len(phrase) - len(" = \n")
+			if saving > bestSaving || (saving == bestSaving && saving > 0 && phrase < best) {
+				best, bestSaving = phrase, saving
+			}
+		}
+	}
+
+	return best
+}
+
+// normalizeWhitespace replaces runs of spaces and tabs with a single space and removes repeated blank lines
+func normalizeWhitespace(s string) string {
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.Join(strings.Fields(line), " ")
+		if line == "" && len(lines) > 0 && lines[len(lines)-1] == "" {
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// removeDuplicateSentences removes sentences which are repeated from earlier in s, keeping the first of each
+func removeDuplicateSentences(s string) string {
+	seen := make(map[string]bool)
+
+	var sb strings.Builder
+	for _, sentence := range splitSentences(s) {
+		key := strings.Join(strings.Fields(sentence), " ")
+		if key != "" && seen[key] {
+			continue
+		}
+
+		seen[key] = true
+		sb.WriteString(sentence)
+	}
+
+	return sb.String()
+}
+
+// splitSentences splits s into sentences, each ending with its punctuation and the whitespace after it. A sentence
+// ends with '.', '!', or '?' followed by whitespace, or at the end of a line.
+func splitSentences(s string) []string {
+	var sentences []string
+
+	start := 0
+	for i := 0; i < len(s); i++ {
+		end := s[i] == '\n'
+		if strings.ContainsRune(".!?", rune(s[i])) && (i+1 == len(s) || s[i+1] == ' ' || s[i+1] == '\n') {
+			end = true
+		}
+
+		if !end {
+			continue
+		}
+
+		// include the whitespace after the sentence
+		for i+1 < len(s) && (s[i+1] == ' ' || s[i+1] == '\n') {
+			i++
+		}
+
+		sentences = append(sentences, s[start:i+1])
+		start = i + 1
+	}
+
+	if start < len(s) {
+		sentences = append(sentences, s[start:])
+	}
+
+	return sentences
+}
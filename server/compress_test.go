@@ -0,0 +1,72 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompressedPrompt(t *testing.T) {
+	encode := NewMockEncoder()
+
+	repeated := strings.Repeat("the quick brown fox jumps over the lazy dog ", 4)
+
+	tests := []struct {
+		name     string
+		rendered string
+		target   int
+		want     string
+	}{
+		{
+			name:     "Fits",
+			rendered: repeated,
+			target:   36,
+			want:     repeated,
+		},
+		{
+			name:     "Aliases",
+			rendered: repeated,
+			target:   20,
+			want:     "§1 = quick brown fox jumps over the lazy dog\n\nthe §1 the §1 the §1 the §1 ",
+		},
+		{
+			name:     "Too Long To Alias",
+			rendered: strings.Repeat("the quick brown fox ", maxAliasBytes/16),
+			target:   20,
+			want:     strings.TrimSpace(strings.Repeat("the quick brown fox ", maxAliasBytes/16)),
+		},
+		{
+			name:     "Duplicate Sentences",
+			rendered: "The fox is quick.  The dog is lazy.\n\n\nThe fox is quick. The end.",
+			target:   8,
+			want:     "The fox is quick. The dog is lazy.\n\nThe end.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := CompressedPrompt(tt.rendered, tt.target, encode)
+			if err != nil {
+				t.Fatalf("CompressedPrompt() error = %v", err)
+			}
+
+			if got != tt.want {
+				t.Errorf("CompressedPrompt() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitSentences(t *testing.T) {
+	got := splitSentences("Hello there. How are you?\nFine thanks! Version 1.2 is out")
+	want := []string{"Hello there. ", "How are you?\n", "Fine thanks! ", "Version 1.2 is out"}
+
+	if len(got) != len(want) {
+		t.Fatalf("splitSentences() got = %q, want %q", got, want)
+	}
+
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("splitSentences()[%d] got = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
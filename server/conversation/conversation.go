@@ -0,0 +1,79 @@
+// Package conversation holds a chat conversation together with the model configuration it is rendered with
+package conversation
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/exp/slices"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/server"
+)
+
+var errNoEncoder = errors.New("conversation has no encoder")
+
+// Conversation is the messages of a chat along with the template, system message, and context window of the
+// model they are rendered for
+type Conversation struct {
+	ModelTemplate string
+	// DefaultSystem is the system message of the prompt unless the messages set their own
+	DefaultSystem string
+	Messages      []api.Message
+	// WindowSize is the number of tokens the rendered prompt is truncated to, counted with Encoder
+	WindowSize int
+	Encoder    func(string) ([]int, error)
+}
+
+// New returns an empty conversation for a model
+func New(tmpl, system string, windowSize int, encode func(string) ([]int, error)) *Conversation {
+	return &Conversation{
+		ModelTemplate: tmpl,
+		DefaultSystem: system,
+		WindowSize:    windowSize,
+		Encoder:       encode,
+	}
+}
+
+// AddMessage adds a message of any role to the end of the conversation
+func (c *Conversation) AddMessage(msg api.Message) {
+	c.Messages = append(c.Messages, msg)
+}
+
+// AddUserMessage adds a user message with the content and images to the end of the conversation
+func (c *Conversation) AddUserMessage(content string, images ...api.ImageData) {
+	c.AddMessage(api.Message{Role: "user", Content: content, Images: images})
+}
+
+// AddAssistantMessage adds a response of the model to the end of the conversation
+func (c *Conversation) AddAssistantMessage(content string) {
+	c.AddMessage(api.Message{Role: "assistant", Content: content})
+}
+
+// Render renders the prompt for the conversation with the model template, truncated to fit the window in the
+// same way as a chat request
+func (c *Conversation) Render() (string, error) {
+	if c.Encoder == nil {
+		return "", errNoEncoder
+	}
+
+	var sb strings.Builder
+	if err := server.StreamChatPrompt(&sb, c.ModelTemplate, c.DefaultSystem, c.Messages, c.WindowSize, c.Encoder); err != nil {
+		return "", err
+	}
+
+	return sb.String(), nil
+}
+
+// Clone returns a copy of the conversation which messages can be added to without changing the original. The
+// content of the messages, such as their images, is shared.
+func (c *Conversation) Clone() *Conversation {
+	clone := *c
+	clone.Messages = slices.Clone(c.Messages)
+	return &clone
+}
+
+// Reset removes all messages from the conversation, keeping the model configuration
+func (c *Conversation) Reset() {
+	c.Messages = nil
+}
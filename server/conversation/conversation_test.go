@@ -0,0 +1,54 @@
+package conversation
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// encodeWords encodes each word as a token
+func encodeWords(s string) ([]int, error) {
+	return make([]int, len(strings.Fields(s))), nil
+}
+
+func TestConversation(t *testing.T) {
+	c := New("[INST] {{ .System }} {{ .Prompt }} [/INST] {{ .Response }}", "You are a wizard.", 512, encodeWords)
+	c.AddUserMessage("What are the magic words?")
+	c.AddAssistantMessage("abracadabra")
+	c.AddMessage(api.Message{Role: "user", Content: "Do you have a hat?"})
+
+	got, err := c.Render()
+	if err != nil {
+		t.Fatalf("Render() error = %v", err)
+	}
+
+	want := "[INST] You are a wizard. What are the magic words? [/INST] abracadabra[INST]  Do you have a hat? [/INST] "
+	if got != want {
+		t.Errorf("Render() got = %q, want %q", got, want)
+	}
+
+	// the clone does not share the messages of the conversation
+	clone := c.Clone()
+	clone.AddAssistantMessage("Yes, a pointed one.")
+	if len(c.Messages) != 3 || len(clone.Messages) != 4 {
+		t.Errorf("Clone() got %d messages, the original has %d", len(clone.Messages), len(c.Messages))
+	}
+
+	// only the most recent turn fits in a smaller window, the system message is kept
+	c.WindowSize = 12
+	if got, err := c.Render(); err != nil || got != "[INST] You are a wizard. Do you have a hat? [/INST] " {
+		t.Errorf("Render() got = %q, %v", got, err)
+	}
+
+	c.Reset()
+	if len(c.Messages) != 0 || c.ModelTemplate == "" || c.DefaultSystem != "You are a wizard." {
+		t.Errorf("Reset() got = %+v", c)
+	}
+
+	c.Encoder = nil
+	if _, err := c.Render(); !errors.Is(err, errNoEncoder) {
+		t.Errorf("Render() error = %v, want %v", err, errNoEncoder)
+	}
+}
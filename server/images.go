@@ -8,6 +8,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
 	"log"
 	"log/slog"
@@ -51,6 +54,43 @@ type Model struct {
 	Size           int64
 	Options        map[string]interface{}
 	Messages       []Message
+
+	// ImagePlaceholderFormat is the text added to a prompt for each of its images, formatted with the
+	// id of the image. Formats without a verb, such as "<image>", are used as is. It defaults to
+	// defaultImagePlaceholderFormat.
+	ImagePlaceholderFormat string
+
+	// TemplateVersion identifies the template, so a conversation can tell when it changes. When it is not set
+	// it is computed from the template.
+	TemplateVersion TemplateVersion
+}
+
+const defaultImagePlaceholderFormat = "[img-%d]"
+
+// imagePlaceholder returns the text which refers to the image with the given id in a prompt
+func (m *Model) imagePlaceholder(id int) string {
+	format := defaultImagePlaceholderFormat
+	if m != nil && m.ImagePlaceholderFormat != "" {
+		format = m.ImagePlaceholderFormat
+	}
+
+	if !strings.Contains(format, "%") {
+		return format
+	}
+
+	return fmt.Sprintf(format, id)
+}
+
+// removeImagePlaceholder removes the placeholder of a dropped image from the prompt, or from the system message
+// for the images of a system message
+func (m *Model) removeImagePlaceholder(p *PromptVars, id int) {
+	placeholder := " " + m.imagePlaceholder(id)
+	if strings.Contains(p.Prompt, placeholder) {
+		p.Prompt = strings.Replace(p.Prompt, placeholder, "", 1)
+		return
+	}
+
+	p.System = strings.Replace(p.System, placeholder, "", 1)
 }
 
 type Message struct {
@@ -59,49 +99,308 @@ type Message struct {
 }
 
 type PromptVars struct {
-	System   string
-	Prompt   string
-	Response string
-	First    bool
-	Images   []llm.ImageData
+	System     string
+	Prompt     string
+	Response   string
+	Tool       string
+	ToolResult string
+	First      bool
+
+	// ToolCallID identifies the tool call the tool result is the result of, when the tool_result message set it
+	ToolCallID string
+
+	// Incomplete reports whether the response is only the start of a response, which the model continues, so the
+	// response of the most recent prompt is left as it is rather than clipped or stripped of thinking
+	Incomplete bool
+
+	// Developer is the content of developer messages, it is only set for templates which reference
+	// .Developer, otherwise developer messages are treated as system messages
+	Developer string
+	Images    []llm.ImageData
+
+	// Metadata is the metadata of the messages of the prompt, merged in order so later messages override
+	// earlier ones
+	Metadata map[string]any
+
+	// Priority is the highest priority set on the messages of the prompt, see api.Message
+	Priority int
+
+	// StructuredOutput is a JSON schema the response should match, an instruction to respond
+	// with JSON matching the schema is added to the system message when it is set, or before the
+	// prompt for templates without a system message
+	StructuredOutput *json.RawMessage
+
+	// responseTokens are the token ids the assistant message gave for the response, see responseTokenIDs
+	responseTokens *responseTokens
+
+	// TemplateHook is called with the variables of the template before it is executed, so variables such as
+	// the time of the request can be added, changed, or removed. An error from the hook stops the prompt.
+	TemplateHook func(vars map[string]any) error
+}
+
+// isFieldNode checks if the node is an action that references the named template variable
+func isFieldNode(node parse.Node, name string) bool {
+	action, ok := node.(*parse.ActionNode)
+	if !ok {
+		return false
+	}
+
+	for _, cmd := range action.Pipe.Cmds {
+		for _, arg := range cmd.Args {
+			switch arg := arg.(type) {
+			case *parse.FieldNode:
+				if len(arg.Ident) > 0 && arg.Ident[0] == name {
+					return true
+				}
+			case *parse.VariableNode:
+				// $.Field is used to reference a variable from within range and with blocks
+				if len(arg.Ident) > 1 && arg.Ident[0] == "$" && arg.Ident[1] == name {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// IsResponseNode reports whether the action references .Response
+func IsResponseNode(node *parse.ActionNode) bool {
+	return node != nil && isFieldNode(node, "Response")
+}
+
+// IsSystemNode reports whether the action references .System
+func IsSystemNode(node *parse.ActionNode) bool {
+	return node != nil && isFieldNode(node, "System")
+}
+
+// IsPromptNode reports whether the action references .Prompt
+func IsPromptNode(node *parse.ActionNode) bool {
+	return node != nil && isFieldNode(node, "Prompt")
+}
+
+// FindFirstResponseNode returns the first action of the template which references .Response, including
+// actions nested within if, range, and with blocks, or nil if the template does not use the response
+func FindFirstResponseNode(tmpl *template.Template) *parse.ActionNode {
+	if tmpl == nil || tmpl.Tree == nil {
+		return nil
+	}
+
+	node, _ := findNode(inlineTemplates(tmpl), isResponseNode).(*parse.ActionNode)
+	return node
+}
+
+// maxInlineDepth limits how deeply template calls are inlined, since a named template may call itself
+const maxInlineDepth = 8
+
+// inlineTemplates returns the nodes of the template with each {{ template "name" . }} call replaced by the
+// nodes of the named template, so nodes such as {{ .Response }} which are within defined templates can be
+// found and split on. Only calls which pass the root variables as dot are inlined, which excludes calls
+// within range and with blocks. The parse tree of the template is not changed.
+func inlineTemplates(tmpl *template.Template) []parse.Node {
+	return inlineNodes(tmpl, tmpl.Tree.Root.Nodes, 0)
+}
+
+func inlineNodes(tmpl *template.Template, nodes []parse.Node, depth int) []parse.Node {
+	inlined := make([]parse.Node, 0, len(nodes))
+	for _, node := range nodes {
+		switch n := node.(type) {
+		case *parse.TemplateNode:
+			if named := tmpl.Lookup(n.Name); named != nil && named.Tree != nil && isDotPipe(n.Pipe) && depth < maxInlineDepth {
+				inlined = append(inlined, inlineNodes(tmpl, named.Tree.Root.Nodes, depth+1)...)
+				continue
+			}
+		case *parse.IfNode:
+			n = n.Copy().(*parse.IfNode)
+			n.List.Nodes = inlineNodes(tmpl, n.List.Nodes, depth)
+			if n.ElseList != nil {
+				n.ElseList.Nodes = inlineNodes(tmpl, n.ElseList.Nodes, depth)
+			}
+
+			node = n
+		}
+
+		inlined = append(inlined, node)
+	}
+
+	return inlined
+}
+
+// isDotPipe reports whether the pipeline is only {{ . }}
+func isDotPipe(pipe *parse.PipeNode) bool {
+	if pipe == nil || len(pipe.Decl) > 0 || len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+		return false
+	}
+
+	_, ok := pipe.Cmds[0].Args[0].(*parse.DotNode)
+	return ok
+}
+
+// defineTemplates returns the {{ define }} actions of the named templates associated with the template, so
+// they are still available to {{ template }} calls when the template is rebuilt from its nodes
+func defineTemplates(tmpl *template.Template) string {
+	var names []string
+	for _, t := range tmpl.Templates() {
+		if t.Name() != tmpl.Name() && t.Tree != nil {
+			names = append(names, t.Name())
+		}
+	}
+	slices.Sort(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&sb, "{{define %q}}%s{{end}}", name, tmpl.Lookup(name).Tree.Root.String())
+	}
+
+	return sb.String()
+}
+
+// isResponseNode checks if the node is an action that references .Response
+func isResponseNode(node parse.Node) bool {
+	return isFieldNode(node, "Response")
+}
+
+// isToolNode checks if the node is an action that references .Tool or .ToolResult
+func isToolNode(node parse.Node) bool {
+	return isFieldNode(node, "Tool") || isFieldNode(node, "ToolResult")
+}
+
+func isDeveloperNode(node parse.Node) bool {
+	return isFieldNode(node, "Developer")
+}
+
+// containsNode checks if any of the nodes, or the nodes nested within their branches, match fn
+func containsNode(nodes []parse.Node, fn func(parse.Node) bool) bool {
+	return findNode(nodes, fn) != nil
+}
+
+// findNode returns the first of the nodes, or the nodes nested within their branches, which matches fn
+func findNode(nodes []parse.Node, fn func(parse.Node) bool) parse.Node {
+	for _, node := range nodes {
+		if fn(node) {
+			return node
+		}
+
+		if b := branchNode(node); b != nil {
+			if found := findNode(b.List.Nodes, fn); found != nil {
+				return found
+			}
+
+			if b.ElseList != nil {
+				if found := findNode(b.ElseList.Nodes, fn); found != nil {
+					return found
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// branchNode returns the branch of an if, range, or with node, or nil for any other node
+func branchNode(node parse.Node) *parse.BranchNode {
+	switch n := node.(type) {
+	case *parse.IfNode:
+		return &n.BranchNode
+	case *parse.RangeNode:
+		return &n.BranchNode
+	case *parse.WithNode:
+		return &n.BranchNode
+	}
+
+	return nil
+}
+
+// splitAtResponse splits a list of nodes at the first {{.Response}} node. Branch nodes which contain
+// the response are split recursively, so the pre and post parts each keep a copy of the enclosing branch.
+func splitAtResponse(nodes []parse.Node) (pre []parse.Node, post []parse.Node, found bool) {
+	for i, node := range nodes {
+		if isResponseNode(node) {
+			return nodes[:i:i], nodes[i:], true
+		}
+
+		b := branchNode(node)
+		if b == nil {
+			continue
+		}
+
+		listPre, listPost, inList := splitAtResponse(b.List.Nodes)
+		var elsePre, elsePost []parse.Node
+		var inElse bool
+		if b.ElseList != nil {
+			elsePre, elsePost, inElse = splitAtResponse(b.ElseList.Nodes)
+		}
+
+		if !inList && !inElse {
+			continue
+		}
+
+		preNode, postNode := node.Copy(), node.Copy()
+		preBranch, postBranch := branchNode(preNode), branchNode(postNode)
+		preBranch.List.Nodes, postBranch.List.Nodes = listPre, listPost
+		if b.ElseList != nil {
+			preBranch.ElseList.Nodes, postBranch.ElseList.Nodes = elsePre, elsePost
+		}
+
+		pre = append(nodes[:i:i], preNode)
+		post = append([]parse.Node{postNode}, nodes[i+1:]...)
+		return pre, post, true
+	}
+
+	return nodes, nil, false
 }
 
 // extractParts extracts the parts of the template before and after the {{.Response}} node.
-func extractParts(tmplStr string) (pre string, post string, err error) {
-	tmpl, err := template.New("").Parse(tmplStr)
+// The response may be nested within if, range, or with actions. Whitespace trimmed by {{- and -}}
+// markers is removed from the text nodes when the template is parsed, so the parts render the same
+// text as the full template even though the markers themselves are not kept.
+func extractParts(tmplStr string, funcs template.FuncMap) (pre string, post string, err error) {
+	tmpl, err := parseTemplateFuncs(tmplStr, funcs)
 	if err != nil {
 		return "", "", err
 	}
 
-	var foundResponse bool
+	preNodes, postNodes, found := splitAtResponse(inlineTemplates(tmpl))
+	if !found {
+		// the template is kept as it is, there is nothing after the response
+		return tmplStr, "", nil
+	}
 
-	for _, node := range tmpl.Tree.Root.Nodes {
-		if node.Type() == parse.NodeAction && node.String() == "{{.Response}}" {
-			foundResponse = true
-		}
-		if !foundResponse {
-			pre += node.String()
-		} else {
-			post += node.String()
-		}
+	defines := defineTemplates(tmpl)
+	pre, post = defines, defines
+	for _, node := range preNodes {
+		pre += node.String()
+	}
+
+	for _, node := range postNodes {
+		post += node.String()
 	}
 
 	return pre, post, nil
 }
 
 func Prompt(promptTemplate string, p PromptVars) (string, error) {
-	var prompt strings.Builder
-	// Use the "missingkey=zero" option to handle missing variables without panicking
-	tmpl, err := template.New("").Option("missingkey=zero").Parse(promptTemplate)
+	return executePrompt(promptTemplate, p, nil)
+}
+
+// executePrompt applies the prompt template, with funcs available to the template along with the
+// default prompt functions
+func executePrompt(promptTemplate string, p PromptVars, funcs template.FuncMap) (string, error) {
+	tmpl, err := parseTemplateFuncs(promptTemplate, funcs)
 	if err != nil {
 		return "", err
 	}
 
-	vars := map[string]any{
-		"System":   p.System,
-		"Prompt":   p.Prompt,
-		"Response": p.Response,
-		"First":    p.First,
+	return executeTemplate(tmpl, p)
+}
+
+// executeTemplate applies the parsed prompt template
+func executeTemplate(tmpl *template.Template, p PromptVars) (string, error) {
+	var prompt strings.Builder
+	hasSystem := tmpl.Tree != nil && containsNode(inlineTemplates(tmpl), func(node parse.Node) bool { return isFieldNode(node, "System") })
+	vars, err := templateVars(p, hasSystem)
+	if err != nil {
+		return "", err
 	}
 
 	var sb strings.Builder
@@ -110,17 +409,53 @@ func Prompt(promptTemplate string, p PromptVars) (string, error) {
 	}
 	prompt.WriteString(sb.String())
 
-	if !strings.Contains(prompt.String(), p.Response) {
+	if response := NormalizePromptUnicode(p.Response); !strings.Contains(prompt.String(), response) {
 		// if the response is not in the prompt template, append it to the end
-		prompt.WriteString(p.Response)
+		prompt.WriteString(response)
 	}
 
 	return prompt.String(), nil
 }
 
+// templateVars returns the variables the prompt template is executed with, as changed by the template hook. The
+// structured output instruction is added to the system message, or to the prompt if the template has no .System.
+func templateVars(p PromptVars, hasSystem bool) (map[string]any, error) {
+	if p.StructuredOutput != nil {
+		instruction := FormatStructuredOutputInstruction(*p.StructuredOutput)
+		switch {
+		case !hasSystem:
+			p.Prompt = instruction + "\n\n" + p.Prompt
+		case p.System != "":
+			p.System += "\n\n" + instruction
+		default:
+			p.System = instruction
+		}
+	}
+
+	// the content is normalized so the prompt is tokenized the same however the client encoded it
+	vars := map[string]any{
+		"System":     NormalizePromptUnicode(p.System),
+		"Prompt":     NormalizePromptUnicode(p.Prompt),
+		"Response":   NormalizePromptUnicode(p.Response),
+		"Tool":       NormalizePromptUnicode(p.Tool),
+		"ToolResult": NormalizePromptUnicode(p.ToolResult),
+		"ToolCallID": p.ToolCallID,
+		"First":      p.First,
+		"Developer":  NormalizePromptUnicode(p.Developer),
+	}
+
+	if p.TemplateHook != nil {
+		if err := p.TemplateHook(vars); err != nil {
+			return nil, fmt.Errorf("template hook: %w", err)
+		}
+	}
+
+	return vars, nil
+}
+
 // PreResponsePrompt returns the prompt before the response tag
 func (m *Model) PreResponsePrompt(p PromptVars) (string, error) {
-	pre, _, err := extractParts(m.Template)
+	pre, _, err := extractParts(m.Template, nil)
 	if err != nil {
 		return "", err
 	}
@@ -134,7 +469,7 @@ func (m *Model) PostResponseTemplate(p PromptVars) (string, error) {
 		// use the default system prompt for this model if one is not specified
 		p.System = m.System
 	}
-	_, post, err := extractParts(m.Template)
+	_, post, err := extractParts(m.Template, nil)
 	if err != nil {
 		return "", err
 	}
@@ -147,71 +482,350 @@ func (m *Model) PostResponseTemplate(p PromptVars) (string, error) {
 	return Prompt(post, p)
 }
 
+// ChatHistory is a list of chat prompts built from a list of messages, one prompt per turn of the conversation
 type ChatHistory struct {
 	Prompts    []PromptVars
 	LastSystem string
+
+	model *Model
+	// open reports whether the last prompt is still being built, later messages may be added to it
+	open bool
+	// images is the number of images appended so far, used to give each image a unique id
+	images int
+	// lastSystemImages are the images of the most recent system message
+	lastSystemImages []llm.ImageData
+
+	// defaultSystem and messages are what the chat history was built from, so it can be built again from the
+	// messages after they are truncated
+	defaultSystem string
+	messages      []api.Message
 }
 
-// ChatPrompts returns a list of formatted chat prompts from a list of messages
-func (m *Model) ChatPrompts(msgs []api.Message) (*ChatHistory, error) {
-	// build the prompt from the list of messages
-	lastSystem := m.System
-	currentVars := PromptVars{
-		First:  true,
-		System: m.System,
+// NewChatHistory returns a chat history for the model, starting with the default system message. Later
+// system messages override it.
+func NewChatHistory(m *Model, defaultSystem string) *ChatHistory {
+	h := &ChatHistory{model: m, LastSystem: defaultSystem, defaultSystem: defaultSystem}
+	if defaultSystem != "" {
+		h.Prompts = []PromptVars{{First: true, System: defaultSystem}}
+		h.open = true
 	}
 
-	prompts := []PromptVars{}
-	var images []llm.ImageData
+	return h
+}
 
-	for _, msg := range msgs {
-		switch strings.ToLower(msg.Role) {
-		case "system":
-			// if this is the first message it overrides the system prompt in the modelfile
-			if !currentVars.First && currentVars.System != "" {
-				prompts = append(prompts, currentVars)
-				currentVars = PromptVars{}
-			}
-			currentVars.System = msg.Content
-			lastSystem = msg.Content
-		case "user":
-			if currentVars.Prompt != "" {
-				prompts = append(prompts, currentVars)
-				currentVars = PromptVars{}
-			}
+// Len returns the number of prompts in the chat history
+func (h *ChatHistory) Len() int {
+	return len(h.Prompts)
+}
+
+// current returns the prompt being built, starting a new one if the last prompt is complete
+func (h *ChatHistory) current() *PromptVars {
+	if !h.open {
+		h.Prompts = append(h.Prompts, PromptVars{First: len(h.Prompts) == 0})
+		h.open = true
+	}
 
-			currentVars.Prompt = msg.Content
+	return &h.Prompts[len(h.Prompts)-1]
+}
 
-			if len(m.ProjectorPaths) > 0 {
-				for i := range msg.Images {
-					id := len(images) + i
-					currentVars.Prompt += fmt.Sprintf(" [img-%d]", id)
-					currentVars.Images = append(currentVars.Images, llm.ImageData{
-						ID:   id,
-						Data: msg.Images[i],
-					})
-				}
+// Append adds a message to the chat history, either to the prompt being built or as the start of a new one
+func (h *ChatHistory) Append(msg api.Message) error {
+	var last PromptVars
+	if h.open {
+		last = h.Prompts[len(h.Prompts)-1]
+	}
+
+	role := strings.ToLower(msg.Role)
+	if role == "developer" {
+		if h.hasDeveloper() {
+			h.open = h.open && (last.First || last.Developer == "")
+			h.current().Developer = msg.Content
+			h.applyMessage(msg)
+			h.messages = append(h.messages, msg)
+			return nil
+		}
+
+		slog.Warn("model template does not reference .Developer, developer message is treated as a system message")
+		role = "system"
+	}
+
+	switch role {
+	case "system":
+		// if this is the first message it overrides the system prompt in the modelfile
+		h.open = h.open && (last.First || last.System == "")
+
+		current := h.current()
+		current.System = msg.Content
+		h.lastSystemImages = h.appendImages(current, &current.System, msg.Images, msg.ImageURLs)
+		h.LastSystem = current.System
+	case "user", "embed_query", "embed_document":
+		h.open = h.open && last.Prompt == ""
+
+		// the content of embed roles starts with the default prefix of embedding models
+		prefix, _ := EmbedPromptOptions{}.prefix(role)
+
+		current := h.current()
+		current.Prompt = prefix + msg.Content
+		h.appendImages(current, &current.Prompt, msg.Images, msg.ImageURLs)
+	case "tool":
+		// a tool call made by the model, its result is expected in a following tool_result message
+		h.open = h.open && last.Tool == ""
+
+		tool, err := toolCalls(msg)
+		if err != nil {
+			return err
+		}
 
-				images = append(images, currentVars.Images...)
+		h.current().Tool = tool
+	case "tool_result":
+		h.open = h.open && last.ToolResult == ""
+		current := h.current()
+		current.ToolResult = msg.Content
+		current.ToolCallID = msg.ToolCallID
+	case "assistant":
+		current := h.current()
+		if len(msg.ToolCalls) > 0 {
+			tool, err := toolCalls(msg)
+			if err != nil {
+				return err
 			}
-		case "assistant":
-			currentVars.Response = msg.Content
-			prompts = append(prompts, currentVars)
-			currentVars = PromptVars{}
-		default:
-			return nil, fmt.Errorf("invalid role: %s, role must be one of [system, user, assistant]", msg.Role)
+
+			current.Tool = tool
+		}
+
+		current.Response = msg.Content
+		current.Incomplete = msg.Incomplete
+		current.responseTokens = nil
+		if msg.TokenIDs != nil {
+			current.responseTokens = &responseTokens{ids: msg.TokenIDs, response: msg.Content}
 		}
+		h.open = false
+	default:
+		return fmt.Errorf("%w: %s, role must be one of [system, developer, user, assistant, tool, tool_result, embed_query, embed_document]", ErrInvalidRole, msg.Role)
 	}
 
-	// Append the last set of vars if they are non-empty
-	if currentVars.Prompt != "" || currentVars.System != "" {
-		prompts = append(prompts, currentVars)
+	h.applyMessage(msg)
+	h.messages = append(h.messages, msg)
+	return nil
+}
+
+// appendImages adds the images of a message to the prompt, with a placeholder for each appended to text. The
+// images are numbered across all messages so each has a unique id, those given by URL are fetched when the
+// prompt is built. They are only added for models with a projector, the images added are returned.
+func (h *ChatHistory) appendImages(current *PromptVars, text *string, images []api.ImageData, urls []string) []llm.ImageData {
+	if h.model == nil || len(h.model.ProjectorPaths) == 0 {
+		return nil
+	}
+
+	added := len(current.Images)
+	for i := range images {
+		id := h.images
+		*text += " " + h.model.imagePlaceholder(id)
+
+		// the image size is used to estimate its token cost, it is left unset if the format is unknown
+		config, _, _ := image.DecodeConfig(bytes.NewReader(images[i]))
+		current.Images = append(current.Images, llm.ImageData{
+			ID:     id,
+			Data:   images[i],
+			Width:  config.Width,
+			Height: config.Height,
+		})
+		h.images++
+	}
+
+	for _, url := range urls {
+		id := h.images
+		*text += " " + h.model.imagePlaceholder(id)
+		current.Images = append(current.Images, llm.ImageData{ID: id, URL: url})
+		h.images++
+	}
+
+	return current.Images[added:]
+}
+
+// withoutSystemImages removes the placeholders of the images of the most recent system message from a system
+// prompt, for when it is carried into a prompt which does not have its images
+func (h *ChatHistory) withoutSystemImages(system string) string {
+	for _, image := range h.lastSystemImages {
+		system = strings.Replace(system, " "+h.model.imagePlaceholder(image.ID), "", 1)
+	}
+
+	return system
+}
+
+// applyMessage sets the metadata and priority of a message on the prompt it was added to. A message without a
+// priority leaves the priority of the prompt as it is, so the reply to an ephemeral message is dropped with it.
+func (h *ChatHistory) applyMessage(msg api.Message) {
+	current := &h.Prompts[len(h.Prompts)-1]
+	current.mergeMetadata(msg.Metadata)
+
+	if msg.Priority != 0 && (current.Priority == 0 || msg.Priority > current.Priority) {
+		current.Priority = msg.Priority
+	}
+}
+
+// mergeMetadata adds the metadata of a message to the prompt. The map is copied so the metadata of the
+// message is not changed by later messages of the same prompt.
+func (p *PromptVars) mergeMetadata(metadata map[string]any) {
+	if len(metadata) == 0 {
+		return
+	}
+
+	merged := make(map[string]any, len(p.Metadata)+len(metadata))
+	for k, v := range p.Metadata {
+		merged[k] = v
+	}
+
+	for k, v := range metadata {
+		merged[k] = v
+	}
+
+	p.Metadata = merged
+}
+
+// hasDeveloper reports whether the template of the model references .Developer, so developer messages are kept
+// separate from system messages
+func (h *ChatHistory) hasDeveloper() bool {
+	if h.model == nil {
+		return false
+	}
+
+	tmpl, err := parseTemplate(h.model.Template)
+	return err == nil && containsNode(inlineTemplates(tmpl), isDeveloperNode)
+}
+
+// toolCalls returns the tool calls of the message as JSON, or its content if it has no structured tool calls
+func toolCalls(msg api.Message) (string, error) {
+	if len(msg.ToolCalls) == 0 {
+		return msg.Content, nil
+	}
+
+	b, err := json.Marshal(msg.ToolCalls)
+	if err != nil {
+		return "", fmt.Errorf("invalid tool calls: %w", err)
+	}
+
+	return string(b), nil
+}
+
+// AppendSystem adds a system message to the chat history
+func (h *ChatHistory) AppendSystem(content string) error {
+	return h.Append(api.Message{Role: "system", Content: content})
+}
+
+// TruncateToWindow drops the oldest prompts of the chat history until it fits within the window of tokens, counted
+// with encode, while preserving the most recent system message. The prompts are rendered with the template of the
+// model the chat history was created for.
+func (h *ChatHistory) TruncateToWindow(window int, encode func(string) ([]int, error)) error {
+	if len(h.Prompts) == 0 {
+		return nil
+	}
+
+	prompts, err := truncatePrompts(context.Background(), h, h.templateModel(""), window, encode, ChatPromptOptions{})
+	if err != nil {
+		return err
+	}
+
+	truncated := make([]PromptVars, len(prompts))
+	for i, prompt := range prompts {
+		truncated[len(prompts)-1-i] = prompt.vars
+	}
+
+	h.Prompts = truncated
+	// the prompts no longer match the messages, so the chat history can't be built again from them
+	h.messages = nil
+	return nil
+}
+
+// Render applies the template to the chat history, dropping the oldest prompts which do not fit within the window of
+// tokens. The chat history itself is left unchanged.
+func (h *ChatHistory) Render(tmpl string, window int, encode func(string) ([]int, error)) (string, error) {
+	ctx := context.Background()
+	it, err := NewChatPromptIterator(ctx, h, h.templateModel(tmpl), window, encode, ChatPromptOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	result, err := renderChatPrompt(it)
+	if err != nil {
+		return "", err
+	}
+
+	return result.Prompt, nil
+}
+
+// templateModel returns the model the chat history was created for with its template replaced by tmpl, if set
+func (h *ChatHistory) templateModel(tmpl string) *Model {
+	var m Model
+	if h.model != nil {
+		m = *h.model
+	}
+
+	if tmpl != "" {
+		m.Template = tmpl
+	}
+
+	return &m
+}
+
+// dropEmptyPrompt drops the last prompt if nothing was set on it
+func (h *ChatHistory) dropEmptyPrompt() {
+	if !h.open {
+		return
+	}
+
+	last := h.Prompts[len(h.Prompts)-1]
+	if last.Prompt == "" && last.System == "" && last.Tool == "" && last.ToolResult == "" && last.Developer == "" {
+		h.Prompts = h.Prompts[:len(h.Prompts)-1]
+		h.open = false
+	}
+}
+
+// rebuilt returns a new chat history for the same model and default system message built from the messages
+func (h *ChatHistory) rebuilt(msgs []api.Message) (*ChatHistory, error) {
+	c := NewChatHistory(h.model, h.defaultSystem)
+	for _, msg := range msgs {
+		if err := c.Append(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	c.dropEmptyPrompt()
+	return c, nil
+}
+
+// ChatPrompts returns a list of formatted chat prompts from a list of messages. The first prompt uses the
+// default system message, or the system message of the model when it is empty, unless the messages set their own.
+func (m *Model) ChatPrompts(msgs []api.Message, defaultSystem string) (*ChatHistory, error) {
+	if defaultSystem == "" {
+		defaultSystem = m.System
+	}
+
+	h := NewChatHistory(m, defaultSystem)
+
+	var hasTools bool
+	for _, msg := range PruneRedundantSystemMessages(msgs) {
+		if err := h.Append(msg); err != nil {
+			return nil, err
+		}
+
+		role := strings.ToLower(msg.Role)
+		hasTools = hasTools || role == "tool" || role == "tool_result" || len(msg.ToolCalls) > 0
+	}
+
+	h.dropEmptyPrompt()
+
+	if len(msgs) > 0 && h.Len() == 0 {
+		return nil, ErrEmptyPrompt
+	}
+
+	if hasTools {
+		if tmpl, err := parseTemplate(m.Template); err == nil && !containsNode(inlineTemplates(tmpl), isToolNode) {
+			slog.Warn("messages contain tool calls but the model template does not reference .Tool or .ToolResult")
+		}
 	}
 
-	return &ChatHistory{
-		Prompts:    prompts,
-		LastSystem: lastSystem,
-	}, nil
+	return h, nil
 }
 
 type ManifestV2 struct {
@@ -405,6 +1019,7 @@ func GetModel(name string) (*Model, error) {
 		}
 	}
 
+	model.TemplateVersion = NewTemplateVersion(model.Template)
 	return model, nil
 }
 
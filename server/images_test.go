@@ -2,8 +2,13 @@ package server
 
 import (
 	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
 	"strings"
 	"testing"
+	"text/template"
+	"text/template/parse"
 
 	"github.com/jmorganca/ollama/api"
 )
@@ -46,6 +51,39 @@ func TestPrompt(t *testing.T) {
 			},
 			want: "[INST] Hello! You are a Wizard. What are the potion ingredients? [/INST] I don't know.",
 		},
+		{
+			name:     "Tool Call and Result",
+			template: "[INST] {{ .Prompt }} [/INST]{{ if .Tool }}[TOOL_CALLS] {{ .Tool }}</s>[TOOL_RESULTS] {{ .ToolResult }}[/TOOL_RESULTS]{{ end }} {{ .Response }}",
+			vars: PromptVars{
+				Prompt:     "What is the weather in Toronto?",
+				Tool:       `{"name": "get_weather"}`,
+				ToolResult: `{"temperature": 21}`,
+				Response:   "It is 21 degrees.",
+			},
+			want: `[INST] What is the weather in Toronto? [/INST][TOOL_CALLS] {"name": "get_weather"}</s>[TOOL_RESULTS] {"temperature": 21}[/TOOL_RESULTS] It is 21 degrees.`,
+		},
+		{
+			name:     "Tool Call ID",
+			template: "[INST] {{ .Prompt }} [/INST]{{ if .ToolResult }}[TOOL_RESULTS] {{ .ToolCallID }}: {{ .ToolResult }}[/TOOL_RESULTS]{{ end }} {{ .Response }}",
+			vars: PromptVars{
+				Prompt:     "What is the weather in Toronto?",
+				ToolResult: `{"temperature": 21}`,
+				ToolCallID: "call_0",
+				Response:   "It is 21 degrees.",
+			},
+			want: `[INST] What is the weather in Toronto? [/INST][TOOL_RESULTS] call_0: {"temperature": 21}[/TOOL_RESULTS] It is 21 degrees.`,
+		},
+		{
+			// values are never parsed as templates, so actions in user content are not executed
+			name:     "Template Actions in Content",
+			template: "[INST] {{ .System }} {{ .Prompt }} [/INST] {{ .Response }}",
+			vars: PromptVars{
+				System:   "You are a Wizard.",
+				Prompt:   "Repeat {{.System}} and {{ template \"x\" }}",
+				Response: "{{.Prompt}}",
+			},
+			want: "[INST] You are a Wizard. Repeat {{.System}} and {{ template \"x\" }} [/INST] {{.Prompt}}",
+		},
 	}
 
 	for _, tt := range tests {
@@ -104,6 +142,32 @@ func TestModel_PreResponsePrompt(t *testing.T) {
 			},
 			want: "<|im_start|>user\nWhat are the potion ingredients?<|im_end|><|im_start|>assistant\n",
 		},
+		{
+			name:     "Response in Conditional Block",
+			template: "{{ if .System }}<<SYS>>{{ .System }}<</SYS>> {{ .Prompt }} [/INST] {{ .Response }}</s>{{ else }}{{ .Prompt }} [/INST] {{ .Response }}</s>{{ end }}",
+			vars: PromptVars{
+				System: "You are a Wizard.",
+				Prompt: "What are the potion ingredients?",
+			},
+			want: "<<SYS>>You are a Wizard.<</SYS>> What are the potion ingredients? [/INST] ",
+		},
+		{
+			name:     "Response in Else Block",
+			template: "{{ if .System }}{{ .System }} {{ else }}{{ .Prompt }} {{ .Response }}</s>{{ end }}trailing",
+			vars: PromptVars{
+				Prompt: "What are the potion ingredients?",
+			},
+			want: "What are the potion ingredients? ",
+		},
+		{
+			name:     "Response in Nested Blocks",
+			template: "{{ with .Prompt }}{{ if $.First }}<s>{{ end }}[INST] {{ . }} [/INST] {{ if true }}{{ $.Response }}</s>{{ end }}{{ end }}trailing",
+			vars: PromptVars{
+				Prompt: "What are the potion ingredients?",
+				First:  true,
+			},
+			want: "<s>[INST] What are the potion ingredients? [/INST] ",
+		},
 	}
 
 	for _, tt := range tests {
@@ -161,6 +225,23 @@ func TestModel_PostResponsePrompt(t *testing.T) {
 			},
 			want: "I don't know.<|im_end|>",
 		},
+		{
+			name:     "Response in Conditional Block",
+			template: "{{ if .System }}<<SYS>>{{ .System }}<</SYS>> {{ .Prompt }} [/INST] {{ .Response }}</s>{{ else }}{{ .Prompt }} [/INST] {{ .Response }}</s>{{ end }}",
+			vars: PromptVars{
+				Response: "I don't know.",
+			},
+			want: "I don't know.</s>",
+		},
+		{
+			name:     "Response in Nested Blocks",
+			template: "{{ with .Prompt }}[INST] {{ . }} [/INST] {{ if true }}{{ $.Response }}</s>{{ end }}{{ end }}trailing",
+			vars: PromptVars{
+				Prompt:   "What are the potion ingredients?",
+				Response: "I don't know.",
+			},
+			want: "I don't know.</s>trailing",
+		},
 	}
 
 	for _, tt := range tests {
@@ -211,6 +292,66 @@ func TestModel_PreResponsePrompt_PostResponsePrompt(t *testing.T) {
 			},
 			want: "<|im_start|>user\nWhat are the potion ingredients?<|im_end|><|im_start|>assistant\nSpice.",
 		},
+		{
+			name:     "Trim Markers Around Response",
+			template: "[INST] {{ .Prompt }} [/INST] {{- .Response -}} \n\n</s>",
+			preVars: PromptVars{
+				Prompt: "What are the potion ingredients?",
+			},
+			postVars: PromptVars{
+				Prompt:   "What are the potion ingredients?",
+				Response: "Sugar.",
+			},
+			want: "[INST] What are the potion ingredients? [/INST]Sugar.</s>",
+		},
+		{
+			name:     "Trim Markers in Conditional Block",
+			template: "<|user|>\n{{ .Prompt }}<|end|>\n<|assistant|>\n{{- if true }}\n  {{- .Response }}\n{{- end }}\n<|end|>",
+			preVars: PromptVars{
+				Prompt: "What are the potion ingredients?",
+			},
+			postVars: PromptVars{
+				Prompt:   "What are the potion ingredients?",
+				Response: "Spice.",
+			},
+			want: "<|user|>\nWhat are the potion ingredients?<|end|>\n<|assistant|>Spice.\n<|end|>",
+		},
+		{
+			name:     "Trim Markers on Comment Before Response",
+			template: "### User:\n{{ .Prompt }}\n\n### Response:\n{{- /* response */ -}}\n  {{ .Response }}",
+			preVars: PromptVars{
+				Prompt: "What are the potion ingredients?",
+			},
+			postVars: PromptVars{
+				Prompt:   "What are the potion ingredients?",
+				Response: "Everything nice.",
+			},
+			want: "### User:\nWhat are the potion ingredients?\n\n### Response:Everything nice.",
+		},
+		{
+			name:     "Response in Defined Template",
+			template: `{{ define "turn" }}<|user|>{{ .Prompt }}<|assistant|>{{ template "response" . }}{{ end }}{{ define "response" }}{{ .Response }}{{ template "end" }}{{ end }}{{ define "end" }}<|end|>{{ end }}{{ template "turn" . }}`,
+			preVars: PromptVars{
+				Prompt: "What are the potion ingredients?",
+			},
+			postVars: PromptVars{
+				Prompt:   "What are the potion ingredients?",
+				Response: "Sugar.",
+			},
+			want: "<|user|>What are the potion ingredients?<|assistant|>Sugar.<|end|>",
+		},
+		{
+			name:     "Response in Block",
+			template: `[INST] {{ .Prompt }} [/INST]{{ block "response" . }} {{ .Response }}</s>{{ end }}`,
+			preVars: PromptVars{
+				Prompt: "What are the potion ingredients?",
+			},
+			postVars: PromptVars{
+				Prompt:   "What are the potion ingredients?",
+				Response: "Spice.",
+			},
+			want: "[INST] What are the potion ingredients? [/INST] Spice.</s>",
+		},
 	}
 
 	for _, tt := range tests {
@@ -256,6 +397,14 @@ func chatHistoryEqual(a, b ChatHistory) bool {
 			return false
 		}
 
+		if v.Tool != b.Prompts[i].Tool || v.ToolResult != b.Prompts[i].ToolResult || v.ToolCallID != b.Prompts[i].ToolCallID {
+			return false
+		}
+
+		if v.Developer != b.Prompts[i].Developer {
+			return false
+		}
+
 		if len(v.Images) != len(b.Prompts[i].Images) {
 			return false
 		}
@@ -410,6 +559,80 @@ func TestChat(t *testing.T) {
 				LastSystem: "You are Professor Utonium.",
 			},
 		},
+		{
+			name: "Tool Calls",
+			model: Model{
+				Template: "[INST] {{ .Prompt }} [/INST] {{ if .Tool }}[TOOL_CALLS] {{ .Tool }}</s>[TOOL_RESULTS] {{ .ToolResult }}[/TOOL_RESULTS]{{ end }}{{ .Response }}",
+			},
+			msgs: []api.Message{
+				{
+					Role:    "user",
+					Content: "What is the weather in Toronto?",
+				},
+				{
+					Role:    "tool",
+					Content: `{"name": "get_weather", "arguments": {"city": "Toronto"}}`,
+				},
+				{
+					Role:    "tool_result",
+					Content: `{"temperature": 21}`,
+				},
+				{
+					Role:    "assistant",
+					Content: "It is 21 degrees in Toronto.",
+				},
+			},
+			want: ChatHistory{
+				Prompts: []PromptVars{
+					{
+						Prompt:     "What is the weather in Toronto?",
+						Tool:       `{"name": "get_weather", "arguments": {"city": "Toronto"}}`,
+						ToolResult: `{"temperature": 21}`,
+						Response:   "It is 21 degrees in Toronto.",
+						First:      true,
+					},
+				},
+			},
+		},
+		{
+			name: "Structured Tool Calls",
+			model: Model{
+				Template: "[INST] {{ .Prompt }} [/INST] {{ if .Tool }}[TOOL_CALLS] {{ .Tool }}</s>{{ end }}{{ if .ToolResult }}[TOOL_RESULTS] {{ .ToolResult }}[/TOOL_RESULTS]{{ end }}{{ .Response }}",
+			},
+			msgs: []api.Message{
+				{
+					Role:    "user",
+					Content: "What is the weather in Toronto?",
+				},
+				{
+					Role:      "assistant",
+					ToolCalls: []api.ToolCall{{Name: "get_weather", Arguments: json.RawMessage(`{"city": "Toronto"}`)}},
+				},
+				{
+					Role:       "tool_result",
+					Content:    `{"temperature": 21}`,
+					ToolCallID: "0",
+				},
+				{
+					Role:      "tool",
+					ToolCalls: []api.ToolCall{{Name: "get_forecast"}},
+				},
+			},
+			want: ChatHistory{
+				Prompts: []PromptVars{
+					{
+						Prompt: "What is the weather in Toronto?",
+						Tool:   `[{"name":"get_weather","arguments":{"city":"Toronto"}}]`,
+						First:  true,
+					},
+					{
+						ToolResult: `{"temperature": 21}`,
+						ToolCallID: "0",
+						Tool:       `[{"name":"get_forecast"}]`,
+					},
+				},
+			},
+		},
 		{
 			name: "Invalid Role",
 			msgs: []api.Message{
@@ -424,7 +647,7 @@ func TestChat(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := tt.model.ChatPrompts(tt.msgs)
+			got, err := tt.model.ChatPrompts(tt.msgs, tt.model.System)
 			if tt.wantErr != "" {
 				if err == nil {
 					t.Errorf("ChatPrompt() expected error, got nil")
@@ -440,3 +663,248 @@ func TestChat(t *testing.T) {
 		})
 	}
 }
+
+func TestChatImageSize(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 336, 224))); err != nil {
+		t.Fatal(err)
+	}
+
+	m := Model{
+		Template:       "[INST] {{ .Prompt }} [/INST]",
+		ProjectorPaths: []string{"projector"},
+	}
+
+	got, err := m.ChatPrompts([]api.Message{
+		{
+			Role:    "user",
+			Content: "What is in these images?",
+			Images:  []api.ImageData{buf.Bytes(), []byte("not an image")},
+		},
+	}, m.System)
+	if err != nil {
+		t.Fatalf("ChatPrompt() error = %v", err)
+	}
+
+	images := got.Prompts[0].Images
+	if len(images) != 2 {
+		t.Fatalf("ChatPrompt() got %d images, want 2", len(images))
+	}
+
+	if images[0].Width != 336 || images[0].Height != 224 {
+		t.Errorf("ChatPrompt() image size = %dx%d, want 336x224", images[0].Width, images[0].Height)
+	}
+
+	if images[1].Width != 0 || images[1].Height != 0 {
+		t.Errorf("ChatPrompt() image size = %dx%d, want 0x0", images[1].Width, images[1].Height)
+	}
+}
+
+func TestChatHistoryAppend(t *testing.T) {
+	m := &Model{
+		Template: "[INST] {{ .System }} {{ .Prompt }} [/INST]",
+		System:   "You are a wizard.",
+	}
+
+	msgs := []api.Message{
+		{Role: "user", Content: "What are the magic words?"},
+		{Role: "assistant", Content: "abracadabra"},
+		{Role: "system", Content: "You are a witch."},
+		{Role: "user", Content: "Do you have a broom?"},
+	}
+
+	want, err := m.ChatPrompts(msgs, m.System)
+	if err != nil {
+		t.Fatalf("ChatPrompts() error = %v", err)
+	}
+
+	got := NewChatHistory(m, m.System)
+	for _, msg := range msgs[:2] {
+		if err := got.Append(msg); err != nil {
+			t.Fatalf("Append() error = %v", err)
+		}
+	}
+
+	if err := got.AppendSystem("You are a witch."); err != nil {
+		t.Fatalf("AppendSystem() error = %v", err)
+	}
+
+	if err := got.Append(msgs[3]); err != nil {
+		t.Fatalf("Append() error = %v", err)
+	}
+
+	if !chatHistoryEqual(*got, *want) {
+		t.Errorf("Append() got = %#v, want %#v", got, want)
+	}
+
+	if got.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", got.Len())
+	}
+
+	if err := got.Append(api.Message{Role: "invalid"}); err == nil {
+		t.Errorf("Append() expected an error for an invalid role")
+	}
+}
+
+func TestChatDeveloperRole(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{
+			name:     "Treated As System",
+			template: "{{ if .System }}<<SYS>>{{ .System }}<</SYS>> {{ end }}[INST] {{ .Prompt }} [/INST]",
+			want:     "<<SYS>>Answer in one word.<</SYS>> [INST] What are the magic words? [/INST]",
+		},
+		{
+			name:     "Separate Variable",
+			template: "{{ if .System }}<<SYS>>{{ .System }}<</SYS>> {{ end }}{{ if .Developer }}<<DEV>>{{ .Developer }}<</DEV>> {{ end }}[INST] {{ .Prompt }} [/INST]",
+			want:     "<<SYS>>You are a wizard.<</SYS>> <<DEV>>Answer in one word.<</DEV>> [INST] What are the magic words? [/INST]",
+		},
+	}
+
+	encode := NewMockEncoder()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Model{Template: tt.template, System: "You are a wizard."}
+			chat, err := m.ChatPrompts([]api.Message{
+				{Role: "developer", Content: "Answer in one word."},
+				{Role: "user", Content: "What are the magic words?"},
+			}, m.System)
+			if err != nil {
+				t.Fatalf("ChatPrompts() error = %v", err)
+			}
+
+			got, err := chat.Render(m.Template, 2048, encode)
+			if err != nil {
+				t.Fatalf("Render() error = %v", err)
+			}
+
+			if got != tt.want {
+				t.Errorf("Render() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatHistoryTruncateToWindow(t *testing.T) {
+	m := &Model{Template: "[INST] {{ .System }} {{ .Prompt }} [/INST]"}
+
+	chat, err := m.ChatPrompts([]api.Message{
+		{Role: "system", Content: "You are a wizard."},
+		{Role: "user", Content: "What are the magic words?"},
+		{Role: "assistant", Content: "abracadabra"},
+		{Role: "user", Content: "Do you have a magic hat?"},
+	}, m.System)
+	if err != nil {
+		t.Fatalf("ChatPrompts() error = %v", err)
+	}
+
+	encode := NewMockEncoder()
+
+	want := "[INST] You are a wizard. Do you have a magic hat? [/INST]"
+
+	got, err := chat.Render(m.Template, 12, encode)
+	if err != nil {
+		t.Fatalf("Render() error = %v", err)
+	}
+
+	if got != want {
+		t.Errorf("Render() got = %q, want %q", got, want)
+	}
+
+	if chat.Len() != 2 {
+		t.Errorf("Render() changed the chat history, Len() = %d, want 2", chat.Len())
+	}
+
+	if err := chat.TruncateToWindow(12, encode); err != nil {
+		t.Fatalf("TruncateToWindow() error = %v", err)
+	}
+
+	if chat.Len() != 1 {
+		t.Fatalf("TruncateToWindow() Len() = %d, want 1", chat.Len())
+	}
+
+	if p := chat.Prompts[0]; !p.First || p.System != "You are a wizard." || p.Prompt != "Do you have a magic hat?" {
+		t.Errorf("TruncateToWindow() got = %#v", p)
+	}
+}
+
+func TestTemplateNodes(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		system   bool
+		prompt   bool
+		response string
+	}{
+		{
+			name:     "No Response",
+			template: "[INST] {{ .System }} {{ .Prompt }} [/INST]",
+			system:   true,
+			prompt:   true,
+		},
+		{
+			name:     "Response",
+			template: "<|user|>{{ .Prompt }}<|assistant|>{{ .Response }}",
+			prompt:   true,
+			response: "{{.Response}}",
+		},
+		{
+			name:     "Nested Response",
+			template: "{{ if .System }}{{ .System }}{{ end }}{{ range .Tool }}{{ $.Response }}{{ end }}",
+			system:   true,
+			response: "{{$.Response}}",
+		},
+		{
+			name:     "Defined Response",
+			template: `{{ define "response" }}{{ .Response }}{{ end }}[INST] {{ .Prompt }} [/INST]{{ if .Prompt }}{{ template "response" . }}{{ end }}`,
+			prompt:   true,
+			response: "{{.Response}}",
+		},
+		{
+			name:     "Defined Response Not Passed Dot",
+			template: `{{ define "response" }}{{ .Response }}{{ end }}[INST] {{ .Prompt }} [/INST]{{ template "response" .Prompt }}`,
+			prompt:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := template.New("").Parse(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var system, prompt bool
+			walkNodes(tmpl.Tree.Root, func(node parse.Node) {
+				if action, ok := node.(*parse.ActionNode); ok {
+					system = system || IsSystemNode(action)
+					prompt = prompt || IsPromptNode(action)
+				}
+			})
+
+			if system != tt.system {
+				t.Errorf("IsSystemNode() got = %v, want %v", system, tt.system)
+			}
+
+			if prompt != tt.prompt {
+				t.Errorf("IsPromptNode() got = %v, want %v", prompt, tt.prompt)
+			}
+
+			response := FindFirstResponseNode(tmpl)
+			switch {
+			case tt.response == "" && response != nil:
+				t.Errorf("FindFirstResponseNode() got = %v, want nil", response)
+			case tt.response != "" && (response == nil || !IsResponseNode(response) || response.String() != tt.response):
+				t.Errorf("FindFirstResponseNode() got = %v, want %v", response, tt.response)
+			}
+		})
+	}
+
+	if IsResponseNode(nil) || FindFirstResponseNode(nil) != nil {
+		t.Errorf("expected nil nodes and templates to have no response")
+	}
+}
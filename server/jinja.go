@@ -0,0 +1,505 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"unicode"
+
+	"golang.org/x/exp/slices"
+)
+
+// isJinja2Template reports whether the template is written in Jinja2 rather than as a Go template. The text of
+// a Go template may contain Jinja2 statements or comments too, so a template which has them is only Jinja2 if it
+// does not parse as a Go template, or has no Go actions.
+func isJinja2Template(s string, funcs template.FuncMap) bool {
+	if !strings.Contains(s, "{%") && !strings.Contains(s, "{#") {
+		return false
+	}
+
+	tmpl, err := template.New("").Funcs(DefaultPromptFuncs()).Funcs(funcs).Parse(s)
+	if err != nil || tmpl.Tree == nil {
+		return true
+	}
+
+	return !slices.ContainsFunc(tmpl.Root.Nodes, func(node parse.Node) bool {
+		return node.Type() != parse.NodeText
+	})
+}
+
+// ParseJinja2Template translates a template written in a subset of Jinja2 to a Go template and parses it.
+// The subset covers variable substitution, for loops, if/elif/else, comparisons with and, or, and not, and
+// the upper, lower, and trim filters. Variables are named as the prompt variables in snake case, such as
+// system, prompt, tool_result, and tool_call_id. Templates are rendered for each turn, so there is no list of
+// messages to loop over and templates which reference messages are rejected.
+func ParseJinja2Template(jinja2Src string) (*template.Template, error) {
+	src, err := translateJinja2(jinja2Src)
+	if err != nil {
+		return nil, err
+	}
+
+	return template.New("").Option("missingkey=zero").Funcs(DefaultPromptFuncs()).Parse(src)
+}
+
+var jinja2Delims = map[string]string{"{{": "}}", "{%": "%}", "{#": "#}"}
+
+// jinja2Filters are the supported filters, each is implemented by the prompt function of the same name
+var jinja2Filters = map[string]bool{"upper": true, "lower": true, "trim": true}
+
+// translateJinja2 translates a Jinja2 template to the equivalent Go template
+func translateJinja2(src string) (string, error) {
+	var sb strings.Builder
+	// blocks are the statements of the open blocks, loops are the variables declared by open for loops
+	var blocks []string
+	var loops [][]string
+
+	for len(src) > 0 {
+		start := jinja2TagStart(src)
+		if start < 0 {
+			sb.WriteString(src)
+			break
+		}
+
+		sb.WriteString(src[:start])
+
+		open := src[start : start+2]
+		end := strings.Index(src[start+2:], jinja2Delims[open])
+		if end < 0 {
+			return "", fmt.Errorf("jinja2 template: unclosed %s", open)
+		}
+
+		body := src[start+2 : start+2+end]
+		src = src[start+2+end+2:]
+
+		trimLeft, trimRight := strings.HasPrefix(body, "-"), strings.HasSuffix(body, "-")
+		body = strings.TrimSpace(strings.Trim(strings.TrimSpace(body), "-+"))
+
+		var action string
+		switch open {
+		case "{#":
+			action = "/**/"
+		case "{{":
+			expr, err := translateJinja2Expr(body, loops)
+			if err != nil {
+				return "", err
+			}
+
+			action = expr
+		case "{%":
+			keyword, rest, _ := strings.Cut(body, " ")
+			rest = strings.TrimSpace(rest)
+
+			switch keyword {
+			case "if":
+				expr, err := translateJinja2Expr(rest, loops)
+				if err != nil {
+					return "", err
+				}
+
+				blocks = append(blocks, "if")
+				action = "if " + expr
+			case "elif":
+				if len(blocks) == 0 || blocks[len(blocks)-1] != "if" {
+					return "", fmt.Errorf("jinja2 template: elif outside of an if block")
+				}
+
+				expr, err := translateJinja2Expr(rest, loops)
+				if err != nil {
+					return "", err
+				}
+
+				action = "else if " + expr
+			case "else":
+				if len(blocks) == 0 {
+					return "", fmt.Errorf("jinja2 template: else outside of an if or for block")
+				}
+
+				action = "else"
+			case "for":
+				target, iterable, ok := strings.Cut(rest, " in ")
+				if !ok {
+					return "", fmt.Errorf("jinja2 template: invalid for loop %q", body)
+				}
+
+				var names, vars []string
+				for _, name := range strings.Split(target, ",") {
+					name = strings.TrimSpace(name)
+					if !isJinja2Ident(name) {
+						return "", fmt.Errorf("jinja2 template: invalid loop variable %q", name)
+					}
+
+					names = append(names, name)
+					vars = append(vars, "$"+name)
+				}
+
+				if len(names) > 2 {
+					return "", fmt.Errorf("jinja2 template: too many loop variables in %q", body)
+				}
+
+				expr, err := translateJinja2Expr(iterable, loops)
+				if err != nil {
+					return "", err
+				}
+
+				blocks = append(blocks, "for")
+				loops = append(loops, names)
+				action = "range " + strings.Join(vars, ", ") + " := " + expr
+			case "endif", "endfor":
+				want := strings.TrimPrefix(keyword, "end")
+				if len(blocks) == 0 || blocks[len(blocks)-1] != want {
+					return "", fmt.Errorf("jinja2 template: unexpected %s", keyword)
+				}
+
+				if want == "for" {
+					loops = loops[:len(loops)-1]
+				}
+
+				blocks = blocks[:len(blocks)-1]
+				action = "end"
+			default:
+				return "", fmt.Errorf("jinja2 template: unsupported statement %q", keyword)
+			}
+		}
+
+		sb.WriteString("{{")
+		if trimLeft {
+			sb.WriteString("- ")
+		}
+		sb.WriteString(action)
+		if trimRight {
+			sb.WriteString(" -")
+		}
+		sb.WriteString("}}")
+	}
+
+	if len(blocks) > 0 {
+		return "", fmt.Errorf("jinja2 template: unclosed %s block", blocks[len(blocks)-1])
+	}
+
+	return sb.String(), nil
+}
+
+// jinja2TagStart returns the index of the first Jinja2 tag in s, or -1 if there is none
+func jinja2TagStart(s string) int {
+	for i := 0; i+1 < len(s); i++ {
+		if _, ok := jinja2Delims[s[i:i+2]]; ok {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func isJinja2Ident(s string) bool {
+	for i, r := range s {
+		if !(r == '_' || unicode.IsLetter(r) || (i > 0 && unicode.IsDigit(r))) {
+			return false
+		}
+	}
+
+	return s != ""
+}
+
+// translateJinja2Expr translates a Jinja2 expression to a Go template pipeline. loops are the variables
+// declared by the enclosing for loops, they are referenced as template variables rather than fields.
+func translateJinja2Expr(src string, loops [][]string) (string, error) {
+	tokens, err := tokenizeJinja2(src)
+	if err != nil {
+		return "", err
+	}
+
+	p := jinja2Parser{tokens: tokens, loops: loops}
+	expr, err := p.or()
+	if err != nil {
+		return "", err
+	}
+
+	if p.pos < len(p.tokens) {
+		return "", fmt.Errorf("jinja2 template: unexpected %q in %q", p.tokens[p.pos], src)
+	}
+
+	// parentheses around the whole pipeline are not needed
+	if strings.HasPrefix(expr, "(") && matchingParen(expr) == len(expr)-1 {
+		expr = expr[1 : len(expr)-1]
+	}
+
+	return expr, nil
+}
+
+// matchingParen returns the index of the parenthesis closing the one which starts s
+func matchingParen(s string) int {
+	var depth int
+	var quoted bool
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == '(':
+			depth++
+		case !quoted && c == ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+// tokenizeJinja2 splits a Jinja2 expression into identifiers, literals, and operators. String literals
+// are converted to quoted Go strings.
+func tokenizeJinja2(src string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'' || c == '"':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(src) && src[j] != c; j++ {
+				if src[j] == '\\' && j+1 < len(src) {
+					j++
+				}
+				sb.WriteByte(src[j])
+			}
+
+			if j >= len(src) {
+				return nil, fmt.Errorf("jinja2 template: unterminated string in %q", src)
+			}
+
+			tokens = append(tokens, strconv.Quote(sb.String()))
+			i = j + 1
+		case c == '=' || c == '!' || c == '<' || c == '>':
+			if i+1 < len(src) && src[i+1] == '=' {
+				tokens = append(tokens, src[i:i+2])
+				i += 2
+			} else if c == '<' || c == '>' {
+				tokens = append(tokens, src[i:i+1])
+				i++
+			} else {
+				return nil, fmt.Errorf("jinja2 template: unexpected %q in %q", c, src)
+			}
+		case strings.IndexByte("()[].|", c) >= 0:
+			tokens = append(tokens, src[i:i+1])
+			i++
+		case c == '_' || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)):
+			j := i
+			for j < len(src) && (src[j] == '_' || unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j]))) {
+				j++
+			}
+
+			tokens = append(tokens, src[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("jinja2 template: unexpected %q in %q", c, src)
+		}
+	}
+
+	return tokens, nil
+}
+
+// jinja2Parser parses the tokens of a Jinja2 expression. Each method returns the Go pipeline for the
+// expression it parses, compound expressions are parenthesized so they can be used as arguments.
+type jinja2Parser struct {
+	tokens []string
+	pos    int
+	loops  [][]string
+}
+
+var jinja2Comparisons = map[string]string{"==": "eq", "!=": "ne", "<": "lt", "<=": "le", ">": "gt", ">=": "ge"}
+
+func (p *jinja2Parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+
+	return ""
+}
+
+func (p *jinja2Parser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *jinja2Parser) or() (string, error) {
+	return p.binary("or", p.and)
+}
+
+func (p *jinja2Parser) and() (string, error) {
+	return p.binary("and", p.not)
+}
+
+func (p *jinja2Parser) binary(op string, operand func() (string, error)) (string, error) {
+	left, err := operand()
+	if err != nil {
+		return "", err
+	}
+
+	for p.peek() == op {
+		p.next()
+		right, err := operand()
+		if err != nil {
+			return "", err
+		}
+
+		left = "(" + op + " " + left + " " + right + ")"
+	}
+
+	return left, nil
+}
+
+func (p *jinja2Parser) not() (string, error) {
+	if p.peek() == "not" {
+		p.next()
+		expr, err := p.not()
+		if err != nil {
+			return "", err
+		}
+
+		return "(not " + expr + ")", nil
+	}
+
+	return p.comparison()
+}
+
+func (p *jinja2Parser) comparison() (string, error) {
+	left, err := p.filtered()
+	if err != nil {
+		return "", err
+	}
+
+	if fn, ok := jinja2Comparisons[p.peek()]; ok {
+		p.next()
+		right, err := p.filtered()
+		if err != nil {
+			return "", err
+		}
+
+		return "(" + fn + " " + left + " " + right + ")", nil
+	}
+
+	return left, nil
+}
+
+func (p *jinja2Parser) filtered() (string, error) {
+	expr, err := p.primary()
+	if err != nil {
+		return "", err
+	}
+
+	if p.peek() != "|" {
+		return expr, nil
+	}
+
+	for p.peek() == "|" {
+		p.next()
+		filter := p.next()
+		if !jinja2Filters[filter] {
+			return "", fmt.Errorf("jinja2 template: unsupported filter %q", filter)
+		}
+
+		expr += " | " + filter
+	}
+
+	return "(" + expr + ")", nil
+}
+
+func (p *jinja2Parser) primary() (string, error) {
+	t := p.next()
+	var expr string
+	switch {
+	case t == "":
+		return "", fmt.Errorf("jinja2 template: unexpected end of expression")
+	case t == "(":
+		inner, err := p.or()
+		if err != nil {
+			return "", err
+		}
+
+		if p.next() != ")" {
+			return "", fmt.Errorf("jinja2 template: missing )")
+		}
+
+		expr = inner
+	case strings.HasPrefix(t, `"`):
+		return t, nil
+	case t == "true" || t == "false":
+		return t, nil
+	case t == "True" || t == "False":
+		return strings.ToLower(t), nil
+	case unicode.IsDigit(rune(t[0])):
+		return t, nil
+	case isJinja2Ident(t):
+		var err error
+		if expr, err = p.variable(t); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("jinja2 template: unexpected %q", t)
+	}
+
+	// attributes and subscripts
+	for {
+		switch p.peek() {
+		case ".":
+			p.next()
+			attr := p.next()
+			if !isJinja2Ident(attr) {
+				return "", fmt.Errorf("jinja2 template: invalid attribute %q", attr)
+			}
+
+			expr += "." + attr
+		case "[":
+			p.next()
+			key, err := p.or()
+			if err != nil {
+				return "", err
+			}
+
+			if p.next() != "]" {
+				return "", fmt.Errorf("jinja2 template: missing ]")
+			}
+
+			expr = "(index " + expr + " " + key + ")"
+		default:
+			return expr, nil
+		}
+	}
+}
+
+// variable returns the template variable for a loop variable, or the field of the prompt variables
+// for any other name
+func (p *jinja2Parser) variable(name string) (string, error) {
+	for i := len(p.loops) - 1; i >= 0; i-- {
+		for _, loop := range p.loops[i] {
+			if loop == name {
+				return "$" + name, nil
+			}
+		}
+	}
+
+	if name == "messages" {
+		return "", fmt.Errorf("jinja2 template: messages is not supported, templates are rendered for each turn with variables such as system, prompt, and response")
+	}
+
+	var sb strings.Builder
+	sb.WriteString(".")
+	for _, part := range strings.Split(name, "_") {
+		if part == "id" {
+			// the prompt variables spell the initialism in upper case, such as ToolCallID
+			sb.WriteString("ID")
+		} else if part != "" {
+			sb.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+
+	return sb.String(), nil
+}
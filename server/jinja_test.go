@@ -0,0 +1,126 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestTranslateJinja2(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "Variables",
+			src:  "[INST] {{ system }} {{ prompt }} [/INST]{# response #}{{ tool_result }} {{ tool_call_id }}",
+			want: "[INST] {{.System}} {{.Prompt}} [/INST]{{/**/}}{{.ToolResult}} {{.ToolCallID}}",
+		},
+		{
+			name: "If Elif Else",
+			src:  "{% if system and not first %}{{ system }}{% elif prompt == 'hi' %}hello{% else %}{{ prompt }}{% endif %}",
+			want: `{{if and .System (not .First)}}{{.System}}{{else if eq .Prompt "hi"}}hello{{else}}{{.Prompt}}{{end}}`,
+		},
+		{
+			name: "For",
+			src:  "{% for item in items %}{{ item['name'] }}: {{ item.value }}{% endfor %}",
+			want: `{{range $item := .Items}}{{index $item "name"}}: {{$item.value}}{{end}}`,
+		},
+		{
+			name: "Filters",
+			src:  "{{ system | trim | upper }}{% if prompt | lower == 'hi' %}{{ prompt }}{% endif %}",
+			want: `{{.System | trim | upper}}{{if eq (.Prompt | lower) "hi"}}{{.Prompt}}{{end}}`,
+		},
+		{
+			name: "Whitespace Control",
+			src:  "{%- if system -%}\n{{ system }}\n{%- endif %}",
+			want: "{{- if .System -}}\n{{.System}}\n{{- end}}",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := translateJinja2(tt.src)
+			if err != nil {
+				t.Fatalf("translateJinja2() error = %v", err)
+			}
+
+			if got != tt.want {
+				t.Errorf("translateJinja2() got = %q, want %q", got, tt.want)
+			}
+
+			if _, err := ParseJinja2Template(tt.src); err != nil {
+				t.Errorf("ParseJinja2Template() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestTranslateJinja2Errors(t *testing.T) {
+	for _, src := range []string{
+		"{% if system %}{{ system }}",
+		"{% endif %}",
+		"{% set x = 1 %}",
+		"{{ system | title }}",
+		"{{ system ",
+		"{{ 'unterminated }}",
+		"{% for in items %}{% endfor %}",
+		"{% for message in messages %}{{ message.content }}{% endfor %}",
+	} {
+		if _, err := ParseJinja2Template(src); err == nil {
+			t.Errorf("ParseJinja2Template(%q) expected an error", src)
+		}
+	}
+}
+
+func TestIsJinja2Template(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want bool
+	}{
+		{"Go", "[INST] {{ .System }} {{ .Prompt }} [/INST]", false},
+		{"Go With Literal Statement", "{% raw %} [INST] {{ .Prompt }} [/INST]", false},
+		{"Go With Literal Comment", "{# not a comment #} {{ .Prompt }}", false},
+		{"Jinja2", "{% if system %}{{ system }}{% endif %}{{ prompt }}", true},
+		{"Jinja2 Without Actions", "{# comment #}Hello", true},
+		{"Text", "Hello", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isJinja2Template(tt.src, nil); got != tt.want {
+				t.Errorf("isJinja2Template() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPromptJinja2(t *testing.T) {
+	template := "{% if system %}<|system|>\n{{ system | trim }}</s>\n{% endif %}<|user|>\n{{ prompt }}</s>\n<|assistant|>\n{{ response }}"
+	vars := PromptVars{
+		System:   "  You are a Wizard.  ",
+		Prompt:   "What are the potion ingredients?",
+		Response: "I don't know.",
+	}
+
+	got, err := Prompt(template, vars)
+	if err != nil {
+		t.Fatalf("Prompt() error = %v", err)
+	}
+
+	want := "<|system|>\nYou are a Wizard.</s>\n<|user|>\nWhat are the potion ingredients?</s>\n<|assistant|>\nI don't know."
+	if got != want {
+		t.Errorf("Prompt() got = %q, want %q", got, want)
+	}
+
+	m := Model{Template: template}
+	pre, err := m.PreResponsePrompt(PromptVars{Prompt: vars.Prompt})
+	if err != nil {
+		t.Fatalf("PreResponsePrompt() error = %v", err)
+	}
+
+	want = "<|user|>\nWhat are the potion ingredients?</s>\n<|assistant|>\n"
+	if pre != want {
+		t.Errorf("PreResponsePrompt() got = %q, want %q", pre, want)
+	}
+}
@@ -0,0 +1,42 @@
+//go:build integration
+
+package server
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+// TestIntegrationEstimateTokenCount checks the estimates of EstimateTokenCount are within 20% of the tokens of
+// a model's tokenizer
+func TestIntegrationEstimateTokenCount(t *testing.T) {
+	SkipIFNoTestData(t)
+	workDir, err := os.MkdirTemp("", "ollama")
+	require.NoError(t, err)
+	defer os.RemoveAll(workDir)
+	require.NoError(t, llm.Init(workDir))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
+	defer cancel()
+
+	_, llmRunner := PrepareModelForPrompts(t, "orca-mini", api.DefaultOptions())
+	defer llmRunner.Close()
+
+	for name, text := range estimateSamples {
+		t.Run(name, func(t *testing.T) {
+			tokens, err := llmRunner.Encode(ctx, text)
+			require.NoError(t, err)
+
+			estimate := EstimateTokenCount(text)
+			if diff := float64(estimate-len(tokens)) / float64(len(tokens)); diff < -0.2 || diff > 0.2 {
+				t.Errorf("EstimateTokenCount() = %d, tokenizer = %d, %+.0f%% off", estimate, len(tokens), diff*100)
+			}
+		})
+	}
+}
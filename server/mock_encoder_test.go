@@ -0,0 +1,140 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// errMockEncode is returned by a mock encoder on the call set by WithErrorOnCall
+var errMockEncode = errors.New("mock encode failed")
+
+type mockEncoder struct {
+	latency       time.Duration
+	errorOnCall   int64
+	tokensPerChar float64
+	fixed         map[string][]int
+
+	calls atomic.Int64
+
+	mu       sync.Mutex
+	recorded *[]string
+}
+
+// MockEncoderOption changes how a mock encoder returned by NewMockEncoder tokenizes text
+type MockEncoderOption func(*mockEncoder)
+
+// WithLatency makes each call to the encoder take at least d
+func WithLatency(d time.Duration) MockEncoderOption {
+	return func(e *mockEncoder) { e.latency = d }
+}
+
+// WithErrorOnCall makes the nth call to the encoder, counting from one, fail with errMockEncode
+func WithErrorOnCall(n int) MockEncoderOption {
+	return func(e *mockEncoder) { e.errorOnCall = int64(n) }
+}
+
+// WithTokensPerChar counts ratio tokens for each character of the text, rounded up, instead of a token for each word
+func WithTokensPerChar(ratio float64) MockEncoderOption {
+	return func(e *mockEncoder) { e.tokensPerChar = ratio }
+}
+
+// WithFixedTokens returns the tokens of the map for text which is one of its keys
+func WithFixedTokens(tokens map[string][]int) MockEncoderOption {
+	return func(e *mockEncoder) { e.fixed = tokens }
+}
+
+// WithCallRecorder appends the text of each call to the encoder to texts, in the order of the calls. The encoder
+// may be called concurrently, so texts should only be read once the calls have returned.
+func WithCallRecorder(texts *[]string) MockEncoderOption {
+	return func(e *mockEncoder) { e.recorded = texts }
+}
+
+// NewMockEncoder returns an encoder for tests which counts each word of the text as a token, unless changed by the
+// options. Tokens are numbered by their position in the text. The encoder is safe to call concurrently.
+func NewMockEncoder(options ...MockEncoderOption) func(string) ([]int, error) {
+	e := &mockEncoder{}
+	for _, option := range options {
+		option(e)
+	}
+
+	return func(s string) ([]int, error) {
+		call := e.calls.Add(1)
+		if e.recorded != nil {
+			e.mu.Lock()
+			*e.recorded = append(*e.recorded, s)
+			e.mu.Unlock()
+		}
+
+		if e.latency > 0 {
+			time.Sleep(e.latency)
+		}
+
+		if call == e.errorOnCall {
+			return nil, errMockEncode
+		}
+
+		if tokens, ok := e.fixed[s]; ok {
+			return tokens, nil
+		}
+
+		n := len(strings.Fields(s))
+		if e.tokensPerChar > 0 {
+			n = int(math.Ceil(float64(len([]rune(s))) * e.tokensPerChar))
+		}
+
+		tokens := make([]int, n)
+		for i := range tokens {
+			tokens[i] = i
+		}
+
+		return tokens, nil
+	}
+}
+
+func TestNewMockEncoder(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []MockEncoderOption
+		text    string
+		want    int
+	}{
+		{name: "Words", text: "What are the magic words?", want: 5},
+		{name: "Tokens Per Char", options: []MockEncoderOption{WithTokensPerChar(0.25)}, text: "abracadabra", want: 3},
+		{name: "Fixed Tokens", options: []MockEncoderOption{WithFixedTokens(map[string][]int{"abracadabra": {1, 2}})}, text: "abracadabra", want: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, err := NewMockEncoder(tt.options...)(tt.text)
+			if err != nil {
+				t.Fatalf("encode() error = %v", err)
+			}
+
+			if len(tokens) != tt.want {
+				t.Errorf("encode() got %d tokens, want %d", len(tokens), tt.want)
+			}
+		})
+	}
+
+	var calls []string
+	encode := NewMockEncoder(WithErrorOnCall(2), WithLatency(time.Millisecond), WithCallRecorder(&calls))
+	start := time.Now()
+	for call := 1; call <= 3; call++ {
+		if _, err := encode("abracadabra"); (call == 2) != errors.Is(err, errMockEncode) {
+			t.Errorf("encode() call %d error = %v", call, err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < 3*time.Millisecond {
+		t.Errorf("encode() took %v for 3 calls, want at least 3ms", elapsed)
+	}
+
+	if len(calls) != 3 || calls[0] != "abracadabra" {
+		t.Errorf("encode() recorded calls %q, want 3 calls", calls)
+	}
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"regexp"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// PIIRedactor replaces personal information in the content of a message, such as email addresses or phone
+// numbers, before it is tokenized or rendered into a prompt
+type PIIRedactor func(content string) string
+
+// NoopPIIRedactor is a PIIRedactor which leaves the content as it is
+func NoopPIIRedactor(content string) string {
+	return content
+}
+
+// NewRegexPIIRedactor returns a PIIRedactor which replaces each match of the patterns with the replacement.
+// The patterns are applied in order, the replacement may refer to submatches such as $1.
+func NewRegexPIIRedactor(patterns []*regexp.Regexp, replacement string) PIIRedactor {
+	return func(content string) string {
+		for _, pattern := range patterns {
+			content = pattern.ReplaceAllString(content, replacement)
+		}
+
+		return content
+	}
+}
+
+// redacted returns a copy of the chat history with the content of each prompt redacted
+func (h *ChatHistory) redacted(redact PIIRedactor) *ChatHistory {
+	c := *h
+	c.LastSystem = redact(h.LastSystem)
+	c.Prompts = make([]PromptVars, len(h.Prompts))
+	for i, prompt := range h.Prompts {
+		prompt.System = redact(prompt.System)
+		prompt.Prompt = redact(prompt.Prompt)
+		prompt.Response = redact(prompt.Response)
+		prompt.Tool = redact(prompt.Tool)
+		prompt.ToolResult = redact(prompt.ToolResult)
+		prompt.Developer = redact(prompt.Developer)
+		c.Prompts[i] = prompt
+	}
+
+	return &c
+}
+
+// redactMessages returns copies of the messages with their content redacted, the messages are left as they are
+func redactMessages(msgs []api.Message, redact PIIRedactor) []api.Message {
+	redacted := make([]api.Message, len(msgs))
+	for i, msg := range msgs {
+		msg.Content = redact(msg.Content)
+		redacted[i] = msg
+	}
+
+	return redacted
+}
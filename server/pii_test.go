@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+var testPIIPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`[\w.+-]+@[\w-]+(\.[\w-]+)+`),
+	regexp.MustCompile(`\+?\d[\d -]{7,}\d`),
+}
+
+func TestNewRegexPIIRedactor(t *testing.T) {
+	redact := NewRegexPIIRedactor(testPIIPatterns, "[redacted]")
+
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{content: "Write to merlin@camelot.example", want: "Write to [redacted]"},
+		{content: "Call +44 20 7946 0958 or merlin@camelot.example.", want: "Call [redacted] or [redacted]."},
+		{content: "What are the magic words?", want: "What are the magic words?"},
+	}
+
+	for _, tt := range tests {
+		if got := redact(tt.content); got != tt.want {
+			t.Errorf("redact(%q) got = %q, want %q", tt.content, got, tt.want)
+		}
+	}
+
+	if got := NoopPIIRedactor("merlin@camelot.example"); got != "merlin@camelot.example" {
+		t.Errorf("NoopPIIRedactor() got = %q", got)
+	}
+}
+
+func TestChatPromptPIIRedactor(t *testing.T) {
+	m := &Model{Template: "[INST] {{ .System }} {{ .Prompt }} [/INST] {{ .Response }}"}
+	msgs := []api.Message{
+		{Role: "system", Content: "The user is merlin@camelot.example."},
+		{Role: "user", Content: "Remember my number, +44 20 7946 0958."},
+		{Role: "assistant", Content: "I will call +44 20 7946 0958."},
+		{Role: "user", Content: "What is my email?"},
+	}
+
+	var encoded []string
+	encode := NewMockEncoder(WithCallRecorder(&encoded))
+
+	opts := ChatPromptOptions{PIIRedactor: NewRegexPIIRedactor(testPIIPatterns, "[redacted]"), Truncation: DropOldestStrategy{}}
+
+	chat, err := m.ChatPrompts(msgs, "")
+	if err != nil {
+		t.Fatalf("ChatPrompts() error = %v", err)
+	}
+
+	result, err := trimmedPrompt(context.Background(), chat, m, 512, encode, opts)
+	if err != nil {
+		t.Fatalf("ChatPrompt() error = %v", err)
+	}
+
+	want := "[INST] The user is [redacted]. Remember my number, [redacted]. [/INST] I will call [redacted].[INST]  What is my email? [/INST] "
+	if result.Prompt != want {
+		t.Errorf("ChatPrompt() got = %q, want %q", result.Prompt, want)
+	}
+
+	for _, s := range append(encoded, result.Prompt) {
+		if strings.Contains(s, "merlin@") || strings.Contains(s, "7946") {
+			t.Errorf("ChatPrompt() personal information was not redacted from %q", s)
+		}
+	}
+
+	if msgs[0].Content != "The user is merlin@camelot.example." {
+		t.Errorf("ChatPrompt() changed the content of the message to %q", msgs[0].Content)
+	}
+}
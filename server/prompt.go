@@ -0,0 +1,1122 @@
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/exp/slices"
+	"golang.org/x/time/rate"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// maxCachedTemplates is the most parsed templates kept in the template cache. Requests can override the template
+// of the model, so the least recently used templates are evicted to bound the memory used by the cache.
+const maxCachedTemplates = 256
+
+// templateCache holds parsed prompt templates keyed by the sha256 digest of the template string
+var templateCache templateLRU
+
+// templateLRU is a cache of parsed templates which evicts the least recently used template once it holds
+// maxCachedTemplates, the zero value is an empty cache
+type templateLRU struct {
+	mu      sync.Mutex
+	entries map[[32]byte]*list.Element
+	// order holds the templates from the most recently used
+	order list.List
+}
+
+type cachedTemplate struct {
+	key  [32]byte
+	tmpl *template.Template
+}
+
+func (c *templateLRU) load(key [32]byte) (*template.Template, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.order.MoveToFront(e)
+	return e.Value.(cachedTemplate).tmpl, true
+}
+
+func (c *templateLRU) store(key [32]byte, tmpl *template.Template) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[[32]byte]*list.Element)
+	}
+
+	if e, ok := c.entries[key]; ok {
+		e.Value = cachedTemplate{key, tmpl}
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(cachedTemplate{key, tmpl})
+	for c.order.Len() > maxCachedTemplates {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(cachedTemplate).key)
+	}
+}
+
+// size returns the number of templates in the cache
+func (c *templateLRU) size() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *templateLRU) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+	c.order.Init()
+}
+
+// parseTemplate parses a prompt template, which may be written in Go or Jinja2 syntax, reusing the
+// parsed template from the cache if the same template string has been parsed before. The returned
+// template is a clone of the cached template, so it can be executed concurrently with other callers.
+func parseTemplate(s string) (*template.Template, error) {
+	return parseTemplateFuncs(s, nil)
+}
+
+// parseTemplateFuncs parses a prompt template in the same way as parseTemplate, with funcs available to
+// the template along with the default prompt functions. Templates are cached by the names of their
+// functions, the functions themselves are bound to the returned clone.
+func parseTemplateFuncs(s string, funcs template.FuncMap) (*template.Template, error) {
+	names := make([]string, 0, len(funcs))
+	for name := range funcs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	key := sha256.Sum256([]byte(s + "\x00" + strings.Join(names, ",")))
+
+	var tmpl *template.Template
+	if cached, ok := templateCache.load(key); ok {
+		tmpl = cached
+	} else {
+		observer().OnTemplateParseStart()
+		start := time.Now()
+
+		var err error
+		if isJinja2Template(s, funcs) {
+			tmpl, err = ParseJinja2Template(s)
+		} else {
+			// Use the "missingkey=zero" option to handle missing variables without panicking
+			tmpl, err = template.New("").Option("missingkey=zero").Funcs(DefaultPromptFuncs()).Funcs(funcs).Parse(s)
+		}
+
+		observer().OnTemplateParseEnd(time.Since(start))
+		if err != nil {
+			return nil, err
+		}
+
+		templateCache.store(key, tmpl)
+	}
+
+	clone, err := tmpl.Clone()
+	if err != nil {
+		return nil, err
+	}
+
+	return clone.Funcs(funcs), nil
+}
+
+// maxRepeatLength limits the length of the string returned by the repeat prompt function
+const maxRepeatLength = 1 << 20
+
+// DefaultPromptFuncs returns the functions available to every prompt template
+func DefaultPromptFuncs() template.FuncMap {
+	return template.FuncMap{
+		"upper": strings.ToUpper,
+		"lower": strings.ToLower,
+		"trim":  strings.TrimSpace,
+		"json": func(v any) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+		"repeat": func(count int, s string) (string, error) {
+			if count < 0 || (len(s) > 0 && count > maxRepeatLength/len(s)) {
+				return "", fmt.Errorf("repeat count %d is out of range", count)
+			}
+
+			return strings.Repeat(s, count), nil
+		},
+		"add": func(a, b int) int { return a + b },
+		"sub": func(a, b int) int { return a - b },
+	}
+}
+
+// FlushTemplateCache removes all parsed templates from the template cache
+func FlushTemplateCache() {
+	templateCache.flush()
+}
+
+// PromptTemplate is a parsed prompt template along with the prompt variables it uses
+type PromptTemplate struct {
+	Template *template.Template
+
+	HasSystem   bool
+	HasPrompt   bool
+	HasResponse bool
+
+	Source string
+}
+
+// ParsePromptTemplate parses the prompt template and finds which of the system message, prompt, and
+// response it renders, including those rendered within if, range, and with blocks
+func ParsePromptTemplate(src string) (*PromptTemplate, error) {
+	tmpl, err := parseTemplate(src)
+	if err != nil {
+		return nil, err
+	}
+
+	has := func(name string) bool {
+		return containsNode(inlineTemplates(tmpl), func(node parse.Node) bool {
+			return isFieldNode(node, name)
+		})
+	}
+
+	return &PromptTemplate{
+		Template:    tmpl,
+		HasSystem:   has("System"),
+		HasPrompt:   has("Prompt"),
+		HasResponse: has("Response"),
+		Source:      src,
+	}, nil
+}
+
+// ModelfileTemplateError is an error parsing a template from a Modelfile, its position is within the Modelfile
+type ModelfileTemplateError struct {
+	Line int
+	// Column is zero when the error does not include one
+	Column  int
+	Message string
+
+	err error
+}
+
+func (e *ModelfileTemplateError) Error() string {
+	if e.Column > 0 {
+		return fmt.Sprintf("Modelfile line %d, column %d: %s", e.Line, e.Column, e.Message)
+	}
+
+	return fmt.Sprintf("Modelfile line %d: %s", e.Line, e.Message)
+}
+
+func (e *ModelfileTemplateError) Unwrap() error {
+	return e.err
+}
+
+// templateErrorPosition matches the position at the start of a template error, such as "template: :1:42: "
+var templateErrorPosition = regexp.MustCompile(`^template: [^:]*:(\d+)(?::(\d+))?: `)
+
+// ParsePromptTemplateFromModelfile parses a prompt template which starts lineOffset lines into a Modelfile,
+// so the position of a parse error refers to the Modelfile rather than the template
+func ParsePromptTemplateFromModelfile(src string, lineOffset int) (*template.Template, error) {
+	tmpl, err := parseTemplate(src)
+	if err != nil {
+		m := templateErrorPosition.FindStringSubmatch(err.Error())
+		if m == nil {
+			return nil, err
+		}
+
+		line, _ := strconv.Atoi(m[1])
+		column, _ := strconv.Atoi(m[2])
+		return nil, &ModelfileTemplateError{
+			Line:    line + lineOffset,
+			Column:  column,
+			Message: strings.TrimPrefix(err.Error(), m[0]),
+			err:     err,
+		}
+	}
+
+	return tmpl, nil
+}
+
+// Prompt applies the template in the same way as the Prompt function, without parsing the template again
+func (t *PromptTemplate) Prompt(p PromptVars) (string, error) {
+	return executeTemplate(t.Template, p)
+}
+
+// renderPrompt applies the prompt template, when cut is true only the part of the template before the
+// {{.Response}} node is rendered
+func renderPrompt(promptTemplate string, p PromptVars, cut bool) (string, error) {
+	return PromptWithFuncs(promptTemplate, p, cut, nil)
+}
+
+// PromptWithFuncs applies the prompt template in the same way as Prompt, with funcs available to the
+// template along with DefaultPromptFuncs. When cut is true only the part of the template before the
+// {{.Response}} node is rendered.
+func PromptWithFuncs(promptTemplate string, p PromptVars, cut bool, funcs template.FuncMap) (string, error) {
+	if cut {
+		pre, _, err := extractParts(promptTemplate, funcs)
+		if err != nil {
+			return "", err
+		}
+
+		promptTemplate = pre
+	}
+
+	return executePrompt(promptTemplate, p, funcs)
+}
+
+// PromptWithContext applies the prompt template in the same way as Prompt, but returns early with
+// the context error if ctx is done before the template has finished executing. When cut is true only
+// the part of the template before the {{.Response}} node is rendered.
+func PromptWithContext(ctx context.Context, promptTemplate string, p PromptVars, cut bool) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	type result struct {
+		prompt string
+		err    error
+	}
+
+	// buffered so the goroutine can finish executing the template after the caller has gone away
+	ch := make(chan result, 1)
+	go func() {
+		prompt, err := renderPrompt(promptTemplate, p, cut)
+		ch <- result{prompt, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case r := <-ch:
+		return r.prompt, r.err
+	}
+}
+
+// PromptRenderer renders the prompt variables into a prompt. When cut is true only the part of the prompt
+// before the response is rendered.
+type PromptRenderer interface {
+	Render(p PromptVars, cut bool) (string, error)
+}
+
+// goTemplateRenderer renders prompts with a Go template, see Prompt
+type goTemplateRenderer struct {
+	template string
+}
+
+// NewGoTemplateRenderer returns a renderer which applies the Go template to prompts
+func NewGoTemplateRenderer(tmpl string) PromptRenderer {
+	return goTemplateRenderer{template: tmpl}
+}
+
+func (r goTemplateRenderer) Render(p PromptVars, cut bool) (string, error) {
+	return renderPrompt(r.template, p, cut)
+}
+
+var errNoPromptTemplate = errors.New("prompt template is not set")
+
+// PromptBuilder builds a prompt from a template and the prompt variables set on it, so the variables
+// are named at the call site rather than passed by position
+type PromptBuilder struct {
+	template    string
+	hasTemplate bool
+	vars        PromptVars
+	cut         bool
+}
+
+// NewPromptBuilder returns an empty prompt builder, a template must be set before building the prompt
+func NewPromptBuilder() *PromptBuilder {
+	return &PromptBuilder{}
+}
+
+// WithTemplate sets the template the prompt is rendered with
+func (b *PromptBuilder) WithTemplate(tmpl string) *PromptBuilder {
+	b.template = tmpl
+	b.hasTemplate = true
+	return b
+}
+
+// WithSystem sets the system message
+func (b *PromptBuilder) WithSystem(system string) *PromptBuilder {
+	b.vars.System = system
+	return b
+}
+
+// WithPrompt sets the user prompt
+func (b *PromptBuilder) WithPrompt(prompt string) *PromptBuilder {
+	b.vars.Prompt = prompt
+	return b
+}
+
+// WithResponse sets the model response
+func (b *PromptBuilder) WithResponse(response string) *PromptBuilder {
+	b.vars.Response = response
+	return b
+}
+
+// WithCut sets whether only the part of the template before the {{.Response}} node is rendered
+func (b *PromptBuilder) WithCut(cut bool) *PromptBuilder {
+	b.cut = cut
+	return b
+}
+
+// Build renders the prompt, it returns an error if no template has been set
+func (b *PromptBuilder) Build() (string, error) {
+	if !b.hasTemplate {
+		return "", errNoPromptTemplate
+	}
+
+	return renderPrompt(b.template, b.vars, b.cut)
+}
+
+// PromptTokenCount applies the prompt template and encodes the result, returning both the rendered
+// prompt and its length in tokens
+func PromptTokenCount(promptTemplate string, p PromptVars, cut bool, encode func(string) ([]int, error)) (string, int, error) {
+	rendered, err := renderPrompt(promptTemplate, p, cut)
+	if err != nil {
+		return "", 0, err
+	}
+
+	tokens, err := encode(rendered)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return rendered, len(tokens), nil
+}
+
+// RateLimitedEncoder limits the calls to encode to rps per second, such as for a remote tokenizer with a rate
+// limit. Each call blocks until it is allowed, calls are not limited when rps is not positive.
+func RateLimitedEncoder(encode func(string) ([]int, error), rps float64) func(string) ([]int, error) {
+	if rps <= 0 {
+		return encode
+	}
+
+	limiter := rate.NewLimiter(rate.Limit(rps), 1)
+	return func(s string) ([]int, error) {
+		if err := limiter.Wait(context.Background()); err != nil {
+			return nil, err
+		}
+
+		return encode(s)
+	}
+}
+
+// tokenWriter tokenizes each chunk written to it
+type tokenWriter struct {
+	tokenize func(chunk string) ([]int, error)
+	tokens   []int
+}
+
+func (w *tokenWriter) Write(p []byte) (int, error) {
+	tokens, err := w.tokenize(string(p))
+	if err != nil {
+		return 0, err
+	}
+
+	w.tokens = append(w.tokens, tokens...)
+	return len(p), nil
+}
+
+// PromptTokenStream applies the prompt template in the same way as Prompt, but passes the output to tokenize
+// in chunks as the template is executed rather than building the whole prompt first, and returns the tokens
+// of all of the chunks. The tokenizer must be able to continue from the end of the previous chunk. As the
+// prompt is not built, the response is appended when the template does not reference it rather than when
+// the rendered prompt does not contain it.
+func PromptTokenStream(tmpl, system, prompt, response string, cut bool, tokenize func(chunk string) ([]int, error)) ([]int, error) {
+	if cut {
+		pre, _, err := extractParts(tmpl, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		tmpl = pre
+	}
+
+	t, err := parseTemplate(tmpl)
+	if err != nil {
+		return nil, err
+	}
+
+	vars, err := templateVars(PromptVars{System: system, Prompt: prompt, Response: response, First: true}, true)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &tokenWriter{tokenize: tokenize}
+	if err := t.Execute(w, vars); err != nil {
+		return nil, err
+	}
+
+	if response != "" && FindFirstResponseNode(t) == nil {
+		if _, err := w.Write([]byte(NormalizePromptUnicode(response))); err != nil {
+			return nil, err
+		}
+	}
+
+	return w.tokens, nil
+}
+
+// promptVariables are the variables available to a prompt template
+var promptVariables = []string{"System", "Prompt", "Response", "First", "Tool", "ToolResult", "ToolCallID", "Developer"}
+
+// walkFields calls fn for each field referenced on the root variables passed to the template.
+// Fields within range and with blocks are skipped since dot no longer refers to the root variables.
+func walkFields(node parse.Node, root bool, fn func(*parse.FieldNode)) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+
+		for _, node := range n.Nodes {
+			walkFields(node, root, fn)
+		}
+	case *parse.ActionNode:
+		walkFields(n.Pipe, root, fn)
+	case *parse.TemplateNode:
+		walkFields(n.Pipe, root, fn)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+
+		for _, cmd := range n.Cmds {
+			walkFields(cmd, root, fn)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			walkFields(arg, root, fn)
+		}
+	case *parse.ChainNode:
+		walkFields(n.Node, root, fn)
+	case *parse.FieldNode:
+		if root {
+			fn(n)
+		}
+	case *parse.IfNode:
+		walkFields(n.Pipe, root, fn)
+		walkFields(n.List, root, fn)
+		walkFields(n.ElseList, root, fn)
+	case *parse.RangeNode:
+		walkFields(n.Pipe, root, fn)
+		walkFields(n.List, false, fn)
+		walkFields(n.ElseList, root, fn)
+	case *parse.WithNode:
+		walkFields(n.Pipe, root, fn)
+		walkFields(n.List, false, fn)
+		walkFields(n.ElseList, root, fn)
+	}
+}
+
+// TemplateVariables returns the names of the variables referenced by a prompt template, sorted and without
+// duplicates. Fields of variables within range and with blocks are not included.
+func TemplateVariables(tmpl string) ([]string, error) {
+	t, err := parseTemplate(tmpl)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	walkFields(t.Tree.Root, true, func(field *parse.FieldNode) {
+		if !slices.Contains(names, field.Ident[0]) {
+			names = append(names, field.Ident[0])
+		}
+	})
+
+	slices.Sort(names)
+	return names, nil
+}
+
+// RenderSystemPrompt renders the part of a prompt template before the first node which uses a variable other than
+// .System or .First, with only the system message set. Nodes which use .System along with other variables,
+// such as a branch which includes the prompt, are not rendered.
+func RenderSystemPrompt(tmpl, system string) (string, error) {
+	t, err := parseTemplate(tmpl)
+	if err != nil {
+		return "", err
+	}
+
+	isConversationNode := func(node parse.Node) bool {
+		for _, name := range promptVariables {
+			if name != "System" && name != "First" && isFieldNode(node, name) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	var sb strings.Builder
+	for _, node := range t.Tree.Root.Nodes {
+		if containsNode([]parse.Node{node}, isConversationNode) {
+			break
+		}
+
+		sb.WriteString(node.String())
+	}
+
+	return Prompt(sb.String(), PromptVars{System: system})
+}
+
+// SplitPromptAtResponse renders the prompt template with an empty response and splits the output where the
+// response is inserted. The prefix is the prompt the model continues from, such as for warming up its cache,
+// and the response part is what the template renders after the response. Templates which do not render the
+// response return the whole output as the prefix.
+func SplitPromptAtResponse(tmpl, system, prompt string) (prefix, responsePart string, err error) {
+	vars := PromptVars{System: system, Prompt: prompt, First: true}
+
+	full, err := renderPrompt(tmpl, vars, false)
+	if err != nil {
+		return "", "", err
+	}
+
+	if prefix, err = renderPrompt(tmpl, vars, true); err != nil {
+		return "", "", err
+	}
+
+	responsePart, ok := strings.CutPrefix(full, prefix)
+	if !ok {
+		// the template renders the text before the response again after it, such as within a range block
+		return "", "", errors.New("prompt template renders text before the response which is not part of the prefix")
+	}
+
+	return prefix, responsePart, nil
+}
+
+// partialResponseMarker is rendered in place of the response by PartialPrompt to find where the response goes
+const partialResponseMarker = "\x00partial-response\x00"
+
+// PartialPrompt renders a prompt with the partial response of a streaming reply in place, for displaying the
+// response as it is generated within the formatting of the template. It is not meant to be sent to the model.
+// An empty response renders the prompt up to where the response goes, without the text after the response
+// such as the end of turn marker.
+func PartialPrompt(tmpl, system, prompt string, partialResponse string) (string, error) {
+	vars := PromptVars{System: system, Prompt: prompt, Response: partialResponseMarker, First: true}
+
+	rendered, err := renderPrompt(tmpl, vars, false)
+	if err != nil {
+		return "", err
+	}
+
+	// templates which do not render the response have it appended by renderPrompt
+	before, after, _ := strings.Cut(rendered, partialResponseMarker)
+	if partialResponse == "" {
+		return before, nil
+	}
+
+	// the marker is replaced everywhere in case the template renders the response more than once
+	return before + partialResponse + strings.ReplaceAll(after, partialResponseMarker, partialResponse), nil
+}
+
+// ValidatePromptTemplate checks that a prompt template only references the variables which are set when it
+// is executed. Unknown variables are otherwise silently replaced with an empty value.
+func ValidatePromptTemplate(tmpl string) error {
+	names, err := TemplateVariables(tmpl)
+	if err != nil {
+		return err
+	}
+
+	var unknown []string
+	for _, name := range names {
+		if !slices.Contains(promptVariables, name) {
+			unknown = append(unknown, name)
+		}
+	}
+
+	if len(unknown) > 0 {
+		return fmt.Errorf("template references unknown variables: .%s, variables must be one of [.%s]", strings.Join(unknown, ", ."), strings.Join(promptVariables, ", ."))
+	}
+
+	return nil
+}
+
+// clipTokens is the number of tokens used by a single 336x336 image tile encoded by a CLIP ViT-L/14 projector
+const clipTokens = 576
+
+// TokenCostForImage estimates the number of tokens used by an image of the given size for the named model.
+// Models which split images into tiles, such as llava 1.6, use more tokens for larger images. The default
+// cost is returned when the size of the image is unknown or the model is not recognised.
+func TokenCostForImage(width, height int, model string) int {
+	if width <= 0 || height <= 0 {
+		return defaultImageTokenCost
+	}
+
+	model = strings.ToLower(model)
+	switch {
+	case strings.Contains(model, "llava") && strings.Contains(model, "1.6"):
+		// the image is split into a grid of up to 4 tiles and encoded along with a downscaled copy of the whole image
+		cols := min(max((width+335)/336, 1), 3)
+		rows := min(max((height+335)/336, 1), 3)
+		for cols*rows > 4 {
+			if cols >= rows {
+				cols--
+			} else {
+				rows--
+			}
+		}
+
+		return (cols*rows + 1) * clipTokens
+	case strings.Contains(model, "llava"):
+		return clipTokens
+	case strings.Contains(model, "moondream"):
+		// 378x378 images with 14x14 patches
+		return 729
+	default:
+		return defaultImageTokenCost
+	}
+}
+
+// PromptHash returns the sha256 digest of a rendered prompt, for use as a cache key
+func PromptHash(rendered string) [32]byte {
+	return sha256.Sum256([]byte(rendered))
+}
+
+// PromptPrefixHash returns the sha256 digest of the first upToByteOffset bytes of a rendered prompt.
+// The offset is limited to the length of the prompt.
+func PromptPrefixHash(rendered string, upToByteOffset int) [32]byte {
+	return PromptHash(rendered[:min(max(upToByteOffset, 0), len(rendered))])
+}
+
+// PromptHashForMessages returns the sha256 digest of the chat prompt rendered from the messages with the
+// template. None of the messages are truncated, encode is only used to count the tokens of the prompt.
+func PromptHashForMessages(tmpl string, messages []api.Message, encode func(string) ([]int, error)) ([32]byte, error) {
+	chat, err := (&Model{Template: tmpl}).ChatPrompts(messages, "")
+	if err != nil {
+		return [32]byte{}, err
+	}
+
+	rendered, err := chat.Render(tmpl, math.MaxInt32, encode)
+	if err != nil {
+		return [32]byte{}, err
+	}
+
+	return PromptHash(rendered), nil
+}
+
+// MessageContentHash returns a digest of the role, content and images of a message, for use as a key to cache
+// responses and to find identical requests. The sha256 digest of the role and content is combined with the
+// sha256 digest of each image with XOR, so the order of the images does not change the digest.
+func MessageContentHash(msg api.Message) ([32]byte, error) {
+	if msg.Role == "" {
+		return [32]byte{}, fmt.Errorf("%w: message has no role", ErrInvalidRole)
+	}
+
+	digest := sha256.Sum256([]byte(msg.Role + "\x00" + msg.Content))
+	for _, image := range msg.Images {
+		imageDigest := sha256.Sum256(image)
+		for i := range digest {
+			digest[i] ^= imageDigest[i]
+		}
+	}
+
+	return digest, nil
+}
+
+// MessagesHash returns the sha256 digest of the MessageContentHash of each message in order, so the same
+// messages in another order have a different digest
+func MessagesHash(msgs []api.Message) ([32]byte, error) {
+	h := sha256.New()
+	for _, msg := range msgs {
+		digest, err := MessageContentHash(msg)
+		if err != nil {
+			return [32]byte{}, err
+		}
+
+		h.Write(digest[:])
+	}
+
+	var digest [32]byte
+	h.Sum(digest[:0])
+	return digest, nil
+}
+
+// defaultRoleFormatters format the messages of each role when NewPromptFromMessages is not given any
+var defaultRoleFormatters = map[string]string{
+	"system":    "%s\n\n",
+	"user":      "User: %s\n",
+	"assistant": "Assistant: %s\n",
+}
+
+// NewPromptFromMessages builds a prompt for models without a template by formatting each message with the format
+// string of its role, such as "User: %s\n", and joining them. The default formats are used when roleFormatters is
+// nil, messages with a role not in roleFormatters return ErrInvalidRole.
+func NewPromptFromMessages(messages []api.Message, roleFormatters map[string]string) (string, error) {
+	if roleFormatters == nil {
+		roleFormatters = defaultRoleFormatters
+	}
+
+	var sb strings.Builder
+	for _, msg := range messages {
+		format, ok := roleFormatters[strings.ToLower(msg.Role)]
+		if !ok {
+			return "", fmt.Errorf("%w: %s, no format for the role", ErrInvalidRole, msg.Role)
+		}
+
+		fmt.Fprintf(&sb, format, msg.Content)
+	}
+
+	return sb.String(), nil
+}
+
+// ChatPromptTokens renders the chat prompt for the messages with the template, truncated to fit the window of
+// tokens, and encodes the whole prompt so its tokens can be reused, such as to match a cached prefix. The
+// system message is used unless the messages set their own.
+func ChatPromptTokens(tmpl string, system string, messages []api.Message, window int, encode func(string) ([]int, error)) (rendered string, tokenIDs []int, err error) {
+	m := &Model{Template: tmpl}
+	chat, err := m.ChatPrompts(messages, system)
+	if err != nil {
+		return "", nil, err
+	}
+
+	result, err := trimmedPrompt(context.Background(), chat, m, window, encode, ChatPromptOptions{})
+	if err != nil {
+		return "", nil, err
+	}
+
+	// the prompt is encoded as a whole, tokens can differ from those of each part of the prompt
+	tokenIDs, err = encode(result.Prompt)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return result.Prompt, tokenIDs, nil
+}
+
+// PromptReplay renders the prompt the model was given for each assistant message of a conversation, from the
+// messages before it, for reproducing the responses of the model. Each prompt is truncated to fit the window of
+// tokens in the same way as a chat request. The system message is used unless the messages set their own.
+func PromptReplay(tmpl, system string, messages []api.Message, window int, encode func(string) ([]int, error)) ([]string, error) {
+	m := &Model{Template: tmpl}
+
+	var prompts []string
+	for i, msg := range messages {
+		if strings.ToLower(msg.Role) != "assistant" {
+			continue
+		}
+
+		chat, err := m.ChatPrompts(messages[:i], system)
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := trimmedPrompt(context.Background(), chat, m, window, encode, ChatPromptOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %w", i, err)
+		}
+
+		prompts = append(prompts, result.Prompt)
+	}
+
+	return prompts, nil
+}
+
+// defaultCharsPerToken is the number of characters of a token assumed by CheckContextFit, which is about right for
+// English text
+const defaultCharsPerToken = 4
+
+// CheckContextFit estimates whether the content of the messages fits in a window of tokens, assuming each token is
+// charsPerToken bytes of content. Templates and images are not counted, so it is only meant to tell when the messages
+// obviously fit or obviously do not, before counting their tokens with ChatPromptDryRun.
+func CheckContextFit(messages []api.Message, window int, charsPerToken float64) bool {
+	if charsPerToken <= 0 {
+		charsPerToken = defaultCharsPerToken
+	}
+
+	var chars int
+	for _, msg := range messages {
+		chars += len(msg.Content)
+	}
+
+	return float64(chars)/charsPerToken <= float64(window)
+}
+
+// ChatPromptDryRun truncates the chat prompt for the messages in the same way as ChatPromptTokens, returning the
+// number of tokens of the prompt and whether any messages or images would be dropped to fit the window. Each
+// turn is rendered to count its tokens, but the prompt is not built or encoded as a whole.
+func ChatPromptDryRun(tmpl string, system string, messages []api.Message, window int, encode func(string) ([]int, error)) (totalTokens int, wouldTruncate bool, err error) {
+	m := &Model{Template: tmpl}
+	chat, err := m.ChatPrompts(messages, system)
+	if err != nil {
+		return 0, false, err
+	}
+
+	it, err := NewChatPromptIterator(context.Background(), chat, m, window, encode, ChatPromptOptions{})
+	if err != nil {
+		return 0, false, err
+	}
+
+	result := it.Result()
+	return result.Tokens, result.TruncatedPrompts > 0 || result.TruncatedImages > 0, nil
+}
+
+// StreamChatPrompt renders the chat prompt for the messages with the template, truncated to fit the window of
+// tokens, writing each turn to w as soon as it is rendered. The system message is used unless the messages
+// set their own.
+func StreamChatPrompt(w io.Writer, tmpl string, system string, messages []api.Message, window int, encode func(string) ([]int, error)) error {
+	m := &Model{Template: tmpl}
+	chat, err := m.ChatPrompts(messages, system)
+	if err != nil {
+		return err
+	}
+
+	it, err := NewChatPromptIterator(context.Background(), chat, m, window, encode, ChatPromptOptions{})
+	if err != nil {
+		return err
+	}
+
+	for {
+		turn, ok := it.Next()
+		if !ok {
+			break
+		}
+
+		if _, err := io.WriteString(w, turn); err != nil {
+			return err
+		}
+	}
+
+	return it.Err()
+}
+
+// PromptDiff returns the longest common prefix of two rendered prompts and the part of the current
+// prompt which follows it. The prefix always ends on a complete UTF-8 character, so the tokens of a
+// cached prefix can be reused and only the new suffix needs to be evaluated.
+func PromptDiff(previous, current string) (prefix string, newSuffix string) {
+	n := min(len(previous), len(current))
+
+	var i int
+	for i < n && previous[i] == current[i] {
+		i++
+	}
+
+	// back off to the start of a character that was only partially matched
+	for i > 0 && i < len(current) && !utf8.RuneStart(current[i]) {
+		i--
+	}
+
+	return current[:i], current[i:]
+}
+
+// FormatStructuredOutputInstruction returns an instruction for the model to respond with JSON matching the schema
+func FormatStructuredOutputInstruction(schema json.RawMessage) string {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, schema); err != nil {
+		// use the schema as it was given, the model may still make sense of it
+		return "Respond only with valid JSON matching this schema: " + string(schema)
+	}
+
+	return "Respond only with valid JSON matching this schema: " + compact.String()
+}
+
+// LintWarning describes a likely mistake in a prompt template which does not stop it from being executed
+type LintWarning struct {
+	// Line and Column locate the problem in the template, they are zero for problems with the whole template
+	Line    int
+	Column  int
+	Message string
+}
+
+func (w LintWarning) String() string {
+	if w.Line == 0 {
+		return w.Message
+	}
+
+	return fmt.Sprintf("%d:%d: %s", w.Line, w.Column, w.Message)
+}
+
+// position returns the line and column of a byte offset in the template
+func position(tmpl string, pos parse.Pos) (line, col int) {
+	before := tmpl[:min(int(pos), len(tmpl))]
+	line = 1 + strings.Count(before, "\n")
+	col = 1 + len(before) - (strings.LastIndex(before, "\n") + 1)
+	return line, col
+}
+
+// walkNodes calls fn for each node in the list, including the nodes nested within branches
+func walkNodes(list *parse.ListNode, fn func(parse.Node)) {
+	if list == nil {
+		return
+	}
+
+	for _, node := range list.Nodes {
+		fn(node)
+		if b := branchNode(node); b != nil {
+			walkNodes(b.List, fn)
+			walkNodes(b.ElseList, fn)
+		}
+	}
+}
+
+// renderedResponses returns the {{.Response}} nodes which are rendered together when the template is
+// executed, using whichever branch renders the most of them
+func renderedResponses(list *parse.ListNode) []parse.Node {
+	if list == nil {
+		return nil
+	}
+
+	var responses []parse.Node
+	for _, node := range list.Nodes {
+		if isResponseNode(node) {
+			responses = append(responses, node)
+		} else if b := branchNode(node); b != nil {
+			inList, inElse := renderedResponses(b.List), renderedResponses(b.ElseList)
+			if len(inElse) > len(inList) {
+				inList = inElse
+			}
+
+			responses = append(responses, inList...)
+		}
+	}
+
+	return responses
+}
+
+// isEmptyPipe checks if the pipeline is a constant which renders nothing or evaluates to false
+func isEmptyPipe(pipe *parse.PipeNode) bool {
+	if pipe == nil || len(pipe.Decl) > 0 || len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+		return false
+	}
+
+	switch arg := pipe.Cmds[0].Args[0].(type) {
+	case *parse.StringNode:
+		return arg.Text == ""
+	case *parse.BoolNode:
+		return !arg.True
+	case *parse.NilNode:
+		return true
+	}
+
+	return false
+}
+
+// LintPromptTemplate checks a prompt template for common mistakes, such as placing .Response before .Prompt,
+// rendering .Response more than once, actions which always render nothing, or not using .System at all
+func LintPromptTemplate(tmpl string) []LintWarning {
+	t, err := parseTemplate(tmpl)
+	if err != nil {
+		return []LintWarning{{Message: err.Error()}}
+	}
+
+	var warnings []LintWarning
+	warn := func(node parse.Node, message string) {
+		line, col := position(tmpl, node.Position())
+		warnings = append(warnings, LintWarning{Line: line, Column: col, Message: message})
+	}
+
+	var prompt, response, system parse.Node
+	walkFields(t.Tree.Root, true, func(field *parse.FieldNode) {
+		switch {
+		case field.Ident[0] == "Prompt" && prompt == nil:
+			prompt = field
+		case field.Ident[0] == "Response" && response == nil:
+			response = field
+		case field.Ident[0] == "System" && system == nil:
+			system = field
+		}
+	})
+
+	if prompt != nil && response != nil && response.Position() < prompt.Position() {
+		warn(response, ".Response is used before .Prompt")
+	}
+
+	if responses := renderedResponses(t.Tree.Root); len(responses) > 1 {
+		warn(responses[1], ".Response is rendered more than once")
+	}
+
+	walkNodes(t.Tree.Root, func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.ActionNode:
+			if isEmptyPipe(n.Pipe) {
+				warn(n, "action always renders an empty string")
+			}
+		case *parse.IfNode:
+			if isEmptyPipe(n.Pipe) {
+				warn(n, "if condition is always false")
+			}
+		}
+	})
+
+	if system == nil {
+		warnings = append(warnings, LintWarning{Message: "template does not use .System, system messages will be ignored"})
+	}
+
+	return warnings
+}
+
+// CutAtStopSequence returns the text up to the first occurrence of any of the stop sequences
+func CutAtStopSequence(text string, stops []string) string {
+	end := len(text)
+	for _, stop := range stops {
+		if stop == "" {
+			continue
+		}
+
+		if i := strings.Index(text[:end], stop); i >= 0 {
+			end = i
+		}
+	}
+
+	return text[:end]
+}
+
+// TokenBudgetManager tracks the tokens of a context window which are in use, such as by a prompt and the
+// response streamed after it, so requests sharing the window are not given more tokens than remain
+type TokenBudgetManager struct {
+	mu     sync.Mutex
+	window int
+	used   int
+}
+
+// NewTokenBudgetManager returns a budget for a context window of windowSize tokens, none of which are in use
+func NewTokenBudgetManager(windowSize int) *TokenBudgetManager {
+	return &TokenBudgetManager{window: windowSize}
+}
+
+// Reserve marks n tokens as in use if that many remain, reporting whether they were reserved
+func (b *TokenBudgetManager) Reserve(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if n < 0 || b.used+n > b.window {
+		return false
+	}
+
+	b.used += n
+	return true
+}
+
+// Release returns n reserved tokens to the budget
+func (b *TokenBudgetManager) Release(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.used = max(b.used-max(n, 0), 0)
+}
+
+// Remaining returns the number of tokens which are not in use
+func (b *TokenBudgetManager) Remaining() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.window - b.used
+}
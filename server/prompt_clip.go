@@ -0,0 +1,74 @@
+package server
+
+import (
+	"log/slog"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+// clippedContentMarker is appended to the content of messages which are cut by clipMessageContent
+const clippedContentMarker = "… [truncated]"
+
+// clipMessageContent cuts content which is longer than limit bytes at the last character which fits and
+// appends clippedContentMarker. Content is not cut when limit is zero.
+func clipMessageContent(content string, limit int) string {
+	if limit <= 0 || len(content) <= limit {
+		return content
+	}
+
+	n := limit
+	for n > 0 && !utf8.RuneStart(content[n]) {
+		n--
+	}
+
+	slog.Warn("message content is longer than the limit and is truncated", "bytes", len(content), "limit", limit)
+	return content[:n] + clippedContentMarker
+}
+
+// clipped returns a copy of the chat history with the content of each message cut to limit bytes. The image
+// placeholders after the content are kept, as is the incomplete response of the most recent prompt since
+// the model continues from it.
+func (h *ChatHistory) clipped(limit int) *ChatHistory {
+	c := *h
+	c.LastSystem = h.clipWithImages(h.LastSystem, h.lastSystemImages, limit)
+	c.Prompts = make([]PromptVars, len(h.Prompts))
+	for i, prompt := range h.Prompts {
+		prompt.System = h.clipWithImages(prompt.System, prompt.Images, limit)
+		prompt.Prompt = h.clipWithImages(prompt.Prompt, prompt.Images, limit)
+		prompt.ToolResult = clipMessageContent(prompt.ToolResult, limit)
+		prompt.Developer = clipMessageContent(prompt.Developer, limit)
+		if i < len(h.Prompts)-1 || !prompt.Incomplete {
+			prompt.Response = clipMessageContent(prompt.Response, limit)
+		}
+
+		c.Prompts[i] = prompt
+	}
+
+	return &c
+}
+
+// clipWithImages cuts the content of a message which is followed by the placeholders of its images, the
+// placeholders are kept and not counted against the limit
+func (h *ChatHistory) clipWithImages(text string, images []llm.ImageData, limit int) string {
+	content := text
+	for i := len(images) - 1; i >= 0; i-- {
+		content = strings.TrimSuffix(content, " "+h.model.imagePlaceholder(images[i].ID))
+	}
+
+	return clipMessageContent(content, limit) + text[len(content):]
+}
+
+// clipMessages returns copies of the messages with their content cut to limit bytes, the messages are left
+// as they are
+func clipMessages(msgs []api.Message, limit int) []api.Message {
+	clipped := make([]api.Message, len(msgs))
+	for i, msg := range msgs {
+		msg.Content = clipMessageContent(msg.Content, limit)
+		clipped[i] = msg
+	}
+
+	return clipped
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestClipMessageContent(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		limit   int
+		want    string
+	}{
+		{"No Limit", "abracadabra", 0, "abracadabra"},
+		{"Shorter", "abracadabra", 20, "abracadabra"},
+		{"Exact", "abracadabra", 11, "abracadabra"},
+		{"Longer", "abracadabra", 5, "abrac… [truncated]"},
+		{"Multibyte", "héllo", 2, "h… [truncated]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clipMessageContent(tt.content, tt.limit); got != tt.want {
+				t.Errorf("clipMessageContent() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatPromptMaxMessageContentBytes(t *testing.T) {
+	m := &Model{
+		Template:       "[INST] {{ .System }} {{ .Prompt }} [/INST] {{ .Response }}",
+		ProjectorPaths: []string{"vision"},
+	}
+
+	msgs := []api.Message{
+		{Role: "system", Content: "You are a wizard who speaks in riddles."},
+		{Role: "user", Content: "What is in this image?", Images: []api.ImageData{api.ImageData("hat")}},
+		{Role: "assistant", Content: "A pointed hat with stars."},
+		{Role: "user", Content: "Tell me more."},
+		{Role: "assistant", Content: "It belongs to a wizard", Incomplete: true},
+	}
+
+	chat, err := m.ChatPrompts(msgs, "")
+	if err != nil {
+		t.Fatalf("ChatPrompts() error = %v", err)
+	}
+
+	result, err := trimmedPrompt(context.Background(), chat, m, 512, NewMockEncoder(), ChatPromptOptions{MaxMessageContentBytes: 14, ImageTokenCost: 1})
+	if err != nil {
+		t.Fatalf("ChatPrompt() error = %v", err)
+	}
+
+	want := "[INST] You are a wiza… [truncated] What is in thi… [truncated] [img-0] [/INST] A pointed hat … [truncated][INST]  Tell me more. [/INST] It belongs to a wizard"
+	if result.Prompt != want {
+		t.Errorf("ChatPrompt() got = %q, want %q", result.Prompt, want)
+	}
+
+	if len(result.Images) != 1 {
+		t.Errorf("ChatPrompt() got %d images, want 1", len(result.Images))
+	}
+
+	if chat.Prompts[0].Prompt != "What is in this image? [img-0]" {
+		t.Errorf("ChatPrompt() changed the chat history to %q", chat.Prompts[0].Prompt)
+	}
+}
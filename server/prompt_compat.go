@@ -0,0 +1,176 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"text/template/parse"
+
+	"golang.org/x/exp/slices"
+)
+
+// templateFormatVersions are the versions of the prompt template format, oldest first
+//
+//	v0.1  .System, .Prompt, .Response, and .First
+//	v0.2  .Tool, .ToolResult, and .ToolCallID, prompts are cut at .Response nested within blocks, and templates which
+//	      reference unknown variables are rejected when the model is loaded
+//	v0.3  .Developer, and system messages later in the conversation are kept when turns are dropped
+var templateFormatVersions = []string{"v0.1", "v0.2", "v0.3"}
+
+// CurrentTemplateFormatVersion is the version of the prompt template format templates are executed with
+const CurrentTemplateFormatVersion = "v0.3"
+
+// CompatibilitySeverity is how a template written for an older version of the template format is affected
+// by a change to the format
+type CompatibilitySeverity string
+
+const (
+	// SeverityError is a template which no longer works, such as one which fails to load
+	SeverityError CompatibilitySeverity = "error"
+	// SeverityWarning is a template which renders a different prompt than it used to
+	SeverityWarning CompatibilitySeverity = "warning"
+	// SeverityInfo is a template which renders the same prompt but misses a newer feature
+	SeverityInfo CompatibilitySeverity = "info"
+)
+
+// CompatibilityWarning describes a pattern in a template which worked in an older version of the template
+// format but is deprecated, ambiguous, or broken in the current one
+type CompatibilityWarning struct {
+	Severity CompatibilitySeverity
+	// Line and Column locate the pattern in the template, they are zero for problems with the whole template
+	Line         int
+	Column       int
+	Message      string
+	SuggestedFix string
+}
+
+func (w CompatibilityWarning) String() string {
+	s := fmt.Sprintf("%s: %s", w.Severity, w.Message)
+	if w.Line > 0 {
+		s = fmt.Sprintf("%d:%d: %s", w.Line, w.Column, s)
+	}
+
+	if w.SuggestedFix != "" {
+		s += " (" + w.SuggestedFix + ")"
+	}
+
+	return s
+}
+
+// CheckTemplateCompatibility checks a template written for an older version of the template format, such as
+// "v0.2", for patterns which behave differently in CurrentTemplateFormatVersion. An empty version is the
+// oldest version. Templates written for the current version have no warnings.
+func CheckTemplateCompatibility(tmpl string, version string) []CompatibilityWarning {
+	if version == "" {
+		version = templateFormatVersions[0]
+	}
+
+	since := slices.Index(templateFormatVersions, version)
+	if since < 0 {
+		return []CompatibilityWarning{{
+			Severity:     SeverityError,
+			Message:      fmt.Sprintf("unknown template format version %q", version),
+			SuggestedFix: "use one of " + strings.Join(templateFormatVersions, ", "),
+		}}
+	}
+
+	t, err := parseTemplate(tmpl)
+	if err != nil {
+		return []CompatibilityWarning{{Severity: SeverityError, Message: err.Error()}}
+	}
+
+	// before reports whether the template was written for a version older than the one which made a change
+	before := func(changed string) bool {
+		return since < slices.Index(templateFormatVersions, changed)
+	}
+
+	var warnings []CompatibilityWarning
+	warn := func(node parse.Node, severity CompatibilitySeverity, message, fix string) {
+		var line, col int
+		if node != nil {
+			line, col = position(tmpl, node.Position())
+		}
+
+		warnings = append(warnings, CompatibilityWarning{Severity: severity, Line: line, Column: col, Message: message, SuggestedFix: fix})
+	}
+
+	nodes := inlineTemplates(t)
+
+	if before("v0.2") {
+		var unknown []string
+		walkFields(t.Tree.Root, true, func(field *parse.FieldNode) {
+			if name := field.Ident[0]; !slices.Contains(promptVariables, name) && !slices.Contains(unknown, name) {
+				unknown = append(unknown, name)
+				warn(field, SeverityError,
+					fmt.Sprintf(".%s is not a template variable, models with this template fail to load", name),
+					fmt.Sprintf("remove .%s, variables must be one of [.%s]", name, strings.Join(promptVariables, ", .")))
+			}
+		})
+
+		if response := findNode(nodes, isResponseNode); response != nil && !slices.Contains(nodes, response) {
+			warn(response, SeverityWarning,
+				".Response is nested within a block, the last prompt is now cut at .Response so the rest of the block is not rendered",
+				"make sure the text after .Response in the block only ends the response")
+		}
+
+		if !containsNode(nodes, isToolNode) {
+			warn(nil, SeverityInfo,
+				"template does not reference .Tool or .ToolResult, tool calls and their results are not rendered",
+				"render {{ .Tool }} after the response and {{ .ToolResult }} as its own turn")
+		}
+	}
+
+	if before("v0.3") {
+		if !containsNode(nodes, isDeveloperNode) {
+			warn(nil, SeverityInfo,
+				"template does not reference .Developer, developer messages are rendered as system messages",
+				"render {{ .Developer }} where the model expects developer instructions")
+		}
+
+		if system := systemOnlyOnFirst(t.Tree.Root); system != nil {
+			warn(system, SeverityWarning,
+				".System is only rendered with .First, system messages later in the conversation are not rendered",
+				"render .System outside of the {{ if .First }} block")
+		}
+	}
+
+	return warnings
+}
+
+// systemOnlyOnFirst returns the first action which renders .System if every such action is within an
+// {{ if .First }} block, or nil if .System is rendered elsewhere or not at all
+func systemOnlyOnFirst(root *parse.ListNode) parse.Node {
+	var system parse.Node
+	var walk func(list *parse.ListNode, first bool) bool
+	walk = func(list *parse.ListNode, first bool) bool {
+		if list == nil {
+			return true
+		}
+
+		for _, node := range list.Nodes {
+			switch n := node.(type) {
+			case *parse.ActionNode:
+				if isFieldNode(n, "System") {
+					if !first {
+						return false
+					}
+
+					if system == nil {
+						system = n
+					}
+				}
+			case *parse.IfNode:
+				if !walk(n.List, first || isFieldNode(&parse.ActionNode{Pipe: n.Pipe}, "First")) || !walk(n.ElseList, first) {
+					return false
+				}
+			}
+		}
+
+		return true
+	}
+
+	if !walk(root, false) {
+		return nil
+	}
+
+	return system
+}
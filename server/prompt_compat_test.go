@@ -0,0 +1,73 @@
+package server
+
+import (
+	"testing"
+
+	"golang.org/x/exp/slices"
+)
+
+func TestCheckTemplateCompatibility(t *testing.T) {
+	current := "{{ if .System }}<<SYS>>{{ .System }}<</SYS>>{{ end }}{{ if .Developer }}<<DEV>>{{ .Developer }}<</DEV>>{{ end }}[INST] {{ .Prompt }}{{ .ToolResult }} [/INST] {{ .Response }}{{ .Tool }}"
+
+	tests := []struct {
+		name    string
+		tmpl    string
+		version string
+		want    []string
+	}{
+		{
+			name:    "Current Version",
+			tmpl:    current,
+			version: CurrentTemplateFormatVersion,
+		},
+		{
+			name:    "Unknown Version",
+			tmpl:    current,
+			version: "v9",
+			want:    []string{`error: unknown template format version "v9" (use one of v0.1, v0.2, v0.3)`},
+		},
+		{
+			name:    "Parse Error",
+			tmpl:    "{{ .Prompt",
+			version: "v0.1",
+			want:    []string{"error: template: :1: unclosed action"},
+		},
+		{
+			name:    "Up To Date",
+			tmpl:    current,
+			version: "v0.1",
+		},
+		{
+			name: "Oldest Version",
+			tmpl: "[INST] {{ if .First }}<<SYS>>{{ .System }}<</SYS>>{{ end }}{{ .Context }}{{ .Prompt }} [/INST]{{ if .Prompt }} {{ .Response }}</s>{{ end }}",
+			want: []string{
+				"1:63: error: .Context is not a template variable, models with this template fail to load (remove .Context, variables must be one of [.System, .Prompt, .Response, .First, .Tool, .ToolResult, .ToolCallID, .Developer])",
+				"1:115: warning: .Response is nested within a block, the last prompt is now cut at .Response so the rest of the block is not rendered (make sure the text after .Response in the block only ends the response)",
+				"info: template does not reference .Tool or .ToolResult, tool calls and their results are not rendered (render {{ .Tool }} after the response and {{ .ToolResult }} as its own turn)",
+				"info: template does not reference .Developer, developer messages are rendered as system messages (render {{ .Developer }} where the model expects developer instructions)",
+				"1:33: warning: .System is only rendered with .First, system messages later in the conversation are not rendered (render .System outside of the {{ if .First }} block)",
+			},
+		},
+		{
+			name:    "System Outside First",
+			tmpl:    "{{ if .First }}<<SYS>>{{ .System }}<</SYS>>{{ else }}{{ .System }}{{ end }}[INST] {{ .Prompt }}{{ .ToolResult }} [/INST] {{ .Response }}{{ .Tool }}",
+			version: "v0.2",
+			want: []string{
+				"info: template does not reference .Developer, developer messages are rendered as system messages (render {{ .Developer }} where the model expects developer instructions)",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, w := range CheckTemplateCompatibility(tt.tmpl, tt.version) {
+				got = append(got, w.String())
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("CheckTemplateCompatibility() got =\n%v\nwant\n%v", got, tt.want)
+			}
+		})
+	}
+}
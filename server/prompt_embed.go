@@ -0,0 +1,59 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The default prefixes of embedding models such as nomic-embed-text, which expect the content to start with
+// the task it is embedded for
+const (
+	defaultEmbedQueryPrefix    = "search_query: "
+	defaultEmbedDocumentPrefix = "search_document: "
+)
+
+// EmbedPromptOptions configures the prefixes added to the content of embed_query and embed_document messages
+type EmbedPromptOptions struct {
+	// EmbedQueryPrefix is prepended to the content of embed_query messages, "search_query: " when it is not set
+	EmbedQueryPrefix string
+
+	// EmbedDocumentPrefix is prepended to the content of embed_document messages, "search_document: " when it
+	// is not set
+	EmbedDocumentPrefix string
+}
+
+// prefix returns the prefix for the content of a message of the role, and whether the role is an embed role
+func (opts EmbedPromptOptions) prefix(role string) (string, bool) {
+	switch strings.ToLower(role) {
+	case "embed_query":
+		if opts.EmbedQueryPrefix != "" {
+			return opts.EmbedQueryPrefix, true
+		}
+
+		return defaultEmbedQueryPrefix, true
+	case "embed_document":
+		if opts.EmbedDocumentPrefix != "" {
+			return opts.EmbedDocumentPrefix, true
+		}
+
+		return defaultEmbedDocumentPrefix, true
+	default:
+		return "", false
+	}
+}
+
+// EmbedPrompt renders the content to embed with the template of an embedding model, prefixed for the role,
+// which must be embed_query or embed_document. The prefixed content is the .Prompt of the template, it is
+// returned as it is for models without a template.
+func EmbedPrompt(tmpl string, content string, role string, opts EmbedPromptOptions) (string, error) {
+	prefix, ok := opts.prefix(role)
+	if !ok {
+		return "", fmt.Errorf("%w: %s, role must be one of [embed_query, embed_document]", ErrInvalidRole, role)
+	}
+
+	if tmpl == "" {
+		return prefix + content, nil
+	}
+
+	return Prompt(tmpl, PromptVars{Prompt: prefix + content})
+}
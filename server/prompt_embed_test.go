@@ -0,0 +1,64 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestEmbedPrompt(t *testing.T) {
+	tests := []struct {
+		name string
+		tmpl string
+		role string
+		opts EmbedPromptOptions
+		want string
+	}{
+		{"Query", "{{ .Prompt }}", "embed_query", EmbedPromptOptions{}, "search_query: What are the magic words?"},
+		{"Document", "{{ .Prompt }}", "embed_document", EmbedPromptOptions{}, "search_document: What are the magic words?"},
+		{"Custom Prefix", "{{ .Prompt }}", "embed_query", EmbedPromptOptions{EmbedQueryPrefix: "query: "}, "query: What are the magic words?"},
+		{"Template", "<s>{{ .Prompt }}</s>", "EMBED_DOCUMENT", EmbedPromptOptions{EmbedDocumentPrefix: "passage: "}, "<s>passage: What are the magic words?</s>"},
+		{"No Template", "", "embed_query", EmbedPromptOptions{}, "search_query: What are the magic words?"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := EmbedPrompt(tt.tmpl, "What are the magic words?", tt.role, tt.opts)
+			if err != nil {
+				t.Fatalf("EmbedPrompt() error = %v", err)
+			}
+
+			if got != tt.want {
+				t.Errorf("EmbedPrompt() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := EmbedPrompt("{{ .Prompt }}", "abracadabra", "user", EmbedPromptOptions{}); !errors.Is(err, ErrInvalidRole) {
+		t.Errorf("EmbedPrompt() error = %v, want %v", err, ErrInvalidRole)
+	}
+}
+
+func TestChatHistoryEmbedRoles(t *testing.T) {
+	m := &Model{Template: "{{ .Prompt }}"}
+	chat, err := m.ChatPrompts([]api.Message{
+		{Role: "embed_document", Content: "The magic words are abracadabra."},
+		{Role: "assistant", Content: ""},
+		{Role: "embed_query", Content: "What are the magic words?"},
+	}, "")
+	if err != nil {
+		t.Fatalf("ChatPrompts() error = %v", err)
+	}
+
+	want := []string{"search_document: The magic words are abracadabra.", "search_query: What are the magic words?"}
+	if len(chat.Prompts) != len(want) {
+		t.Fatalf("ChatPrompts() got %d prompts, want %d", len(chat.Prompts), len(want))
+	}
+
+	for i := range want {
+		if chat.Prompts[i].Prompt != want[i] {
+			t.Errorf("ChatPrompts() prompt %d got = %q, want %q", i, chat.Prompts[i].Prompt, want[i])
+		}
+	}
+}
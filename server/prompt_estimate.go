@@ -0,0 +1,98 @@
+package server
+
+import (
+	"math"
+	"unicode"
+)
+
+// tokenClass is a kind of text which is tokenized into tokens of about the same number of characters
+type tokenClass int
+
+const (
+	classSpace tokenClass = iota
+	classLatin
+	classCJK
+	classLetter
+	classDigit
+	classSymbol
+)
+
+// classCharsPerToken is the average number of characters of a token of each class. Latin text is about 4 characters
+// a token, Chinese and Japanese about 1.5, and the letters of other scripts such as Cyrillic fall in between.
+// Digits and symbols are mostly tokenized on their own, which is why code has fewer characters a token than prose.
+var classCharsPerToken = map[tokenClass]float64{
+	classLatin:  4,
+	classCJK:    1.5,
+	classLetter: 2.5,
+	classDigit:  1,
+	classSymbol: 1.2,
+}
+
+// cjkScripts are the scripts of Chinese, Japanese, and Korean text
+var cjkScripts = []*unicode.RangeTable{unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul}
+
+func classify(r rune) tokenClass {
+	switch {
+	case unicode.IsSpace(r):
+		return classSpace
+	case unicode.Is(unicode.Latin, r):
+		return classLatin
+	case unicode.IsOneOf(cjkScripts, r):
+		return classCJK
+	case unicode.IsLetter(r) || unicode.IsMark(r):
+		return classLetter
+	case unicode.IsDigit(r):
+		return classDigit
+	default:
+		return classSymbol
+	}
+}
+
+// EstimateTokenCount estimates the number of tokens of text without a tokenizer. The text is split into runs
+// of characters of the same script or kind, such as Latin letters, Chinese characters, digits, or symbols, and
+// each run is counted with the number of characters a token of its kind usually has. A single space is part of
+// the word after it, other spaces count as a token for each line break and for every four spaces of indentation.
+func EstimateTokenCount(text string) int {
+	runes := []rune(text)
+
+	var tokens float64
+	for i := 0; i < len(runes); {
+		class := classify(runes[i])
+
+		j := i + 1
+		for j < len(runes) && classify(runes[j]) == class {
+			j++
+		}
+
+		if class == classSpace {
+			tokens += spaceTokens(runes[i:j])
+		} else {
+			// every run is at least one token, such as short words
+			tokens += math.Max(1, math.Round(float64(j-i)/classCharsPerToken[class]))
+		}
+
+		i = j
+	}
+
+	return int(tokens)
+}
+
+// spaceTokens estimates the number of tokens of a run of whitespace
+func spaceTokens(space []rune) float64 {
+	var lines, spaces int
+	for _, r := range space {
+		if r == '\n' {
+			lines++
+			spaces = 0
+		} else {
+			spaces++
+		}
+	}
+
+	// the space before a word is part of its token
+	if spaces > 0 {
+		spaces--
+	}
+
+	return float64(lines) + math.Ceil(float64(spaces)/4)
+}
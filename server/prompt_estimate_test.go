@@ -0,0 +1,47 @@
+package server
+
+import "testing"
+
+// estimateSamples are texts in different languages for checking token estimates
+var estimateSamples = map[string]string{
+	"English": "The wizard raised his staff and spoke the magic words. Light filled the room, and when it faded the dragon was gone.",
+	"Chinese": "巫师举起他的法杖，说出了咒语。光芒充满了整个房间，当光芒消失时，龙已经不见了。",
+	"Python": `def cast(spell: str, power: int = 10) -> bool:
+    if power <= 0:
+        raise ValueError("power must be positive")
+    return spell in {"abracadabra", "hocus pocus"}
+`,
+}
+
+func TestEstimateTokenCount(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want int
+	}{
+		{name: "Empty", text: "", want: 0},
+		{name: "Words", text: "What are the magic words?", want: 6},
+		{name: "Chinese", text: "咒语是什么", want: 3},
+		{name: "Cyrillic", text: "Привет", want: 2},
+		{name: "Digits", text: "year 2024", want: 5},
+		{name: "Indentation", text: "if x:\n        return", want: 8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := EstimateTokenCount(tt.text); got != tt.want {
+				t.Errorf("EstimateTokenCount() got = %d, want %d", got, tt.want)
+			}
+		})
+	}
+
+	// the same story has fewer characters a token in Chinese than in English, and code falls in between
+	ratio := func(name string) float64 {
+		text := estimateSamples[name]
+		return float64(len([]rune(text))) / float64(EstimateTokenCount(text))
+	}
+
+	if english, chinese, python := ratio("English"), ratio("Chinese"), ratio("Python"); !(chinese < python && python < english) {
+		t.Errorf("EstimateTokenCount() characters a token = %.2f English, %.2f Chinese, %.2f Python", english, chinese, python)
+	}
+}
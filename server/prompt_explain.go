@@ -0,0 +1,115 @@
+package server
+
+import "strings"
+
+// PromptSection is a part of a rendered prompt along with where it came from. Role is "system", "user", or
+// "assistant" for the variables of the prompt, or "template" for the text of the template around them.
+type PromptSection struct {
+	Content string
+	Role    string
+	// ByteRange is the start and end of the section within the rendered prompt
+	ByteRange [2]int
+}
+
+// ExplainedPrompt is a rendered prompt split into the sections which make it up
+type ExplainedPrompt struct {
+	Sections []PromptSection
+}
+
+// explainMarkers stand in for the variables of the prompt when it is rendered, so they can be found in the output
+var explainMarkers = []struct {
+	marker, role string
+}{
+	{"\x00system\x00", "system"},
+	{"\x00user\x00", "user"},
+	{"\x00assistant\x00", "assistant"},
+}
+
+// ExplainPrompt renders the prompt template and splits the result into the sections from the system message,
+// the prompt, the response, and the template itself. Variables which the template changes, such as with a
+// function, are not recognised and are part of the template sections.
+func ExplainPrompt(tmpl, system, prompt, response string) (ExplainedPrompt, error) {
+	values := []string{system, prompt, response}
+
+	// empty values are left empty so conditions in the template are rendered in the same way
+	marked := make([]string, len(values))
+	for i, value := range values {
+		if value != "" {
+			marked[i] = explainMarkers[i].marker
+		}
+	}
+
+	rendered, err := Prompt(tmpl, PromptVars{System: marked[0], Prompt: marked[1], Response: marked[2], First: true})
+	if err != nil {
+		return ExplainedPrompt{}, err
+	}
+
+	var explained ExplainedPrompt
+	var offset int
+	add := func(content, role string) {
+		if content == "" {
+			return
+		}
+
+		explained.Sections = append(explained.Sections, PromptSection{
+			Content:   content,
+			Role:      role,
+			ByteRange: [2]int{offset, offset + len(content)},
+		})
+		offset += len(content)
+	}
+
+	for rendered != "" {
+		// find the earliest marker
+		next, at := -1, len(rendered)
+		for i, m := range explainMarkers {
+			if marked[i] == "" {
+				continue
+			}
+
+			if j := strings.Index(rendered, m.marker); j >= 0 && j < at {
+				next, at = i, j
+			}
+		}
+
+		add(rendered[:at], "template")
+		if next < 0 {
+			break
+		}
+
+		add(values[next], explainMarkers[next].role)
+		rendered = rendered[at+len(explainMarkers[next].marker):]
+	}
+
+	return explained, nil
+}
+
+// String returns the rendered prompt
+func (e ExplainedPrompt) String() string {
+	var sb strings.Builder
+	for _, section := range e.Sections {
+		sb.WriteString(section.Content)
+	}
+
+	return sb.String()
+}
+
+// explainColors are the ANSI escape codes used to colour each role
+var explainColors = map[string]string{
+	"system":    "\x1b[33m",
+	"user":      "\x1b[32m",
+	"assistant": "\x1b[36m",
+	"template":  "\x1b[2m",
+}
+
+// ColorString returns the rendered prompt with each section coloured by its role, for display in a terminal
+func (e ExplainedPrompt) ColorString() string {
+	var sb strings.Builder
+	for _, section := range e.Sections {
+		sb.WriteString(explainColors[section.Role])
+		sb.WriteString(section.Content)
+		sb.WriteString("\x1b[0m")
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExplainPrompt(t *testing.T) {
+	got, err := ExplainPrompt("[INST] {{ if .System }}<<SYS>>{{ .System }}<</SYS>> {{ end }}{{ .Prompt }} [/INST] {{ .Response }}", "You are a wizard.", "What are the magic words?", "abracadabra")
+	if err != nil {
+		t.Fatalf("ExplainPrompt() error = %v", err)
+	}
+
+	want := []PromptSection{
+		{Content: "[INST] <<SYS>>", Role: "template", ByteRange: [2]int{0, 14}},
+		{Content: "You are a wizard.", Role: "system", ByteRange: [2]int{14, 31}},
+		{Content: "<</SYS>> ", Role: "template", ByteRange: [2]int{31, 40}},
+		{Content: "What are the magic words?", Role: "user", ByteRange: [2]int{40, 65}},
+		{Content: " [/INST] ", Role: "template", ByteRange: [2]int{65, 74}},
+		{Content: "abracadabra", Role: "assistant", ByteRange: [2]int{74, 85}},
+	}
+
+	if !reflect.DeepEqual(got.Sections, want) {
+		t.Errorf("ExplainPrompt() got = %#v, want %#v", got.Sections, want)
+	}
+
+	if want := "[INST] <<SYS>>You are a wizard.<</SYS>> What are the magic words? [/INST] abracadabra"; got.String() != want {
+		t.Errorf("String() got = %q, want %q", got.String(), want)
+	}
+
+	// the system branch is not rendered without a system message
+	got, err = ExplainPrompt("[INST] {{ if .System }}<<SYS>>{{ .System }}<</SYS>> {{ end }}{{ .Prompt }} [/INST]", "", "Hello", "")
+	if err != nil {
+		t.Fatalf("ExplainPrompt() error = %v", err)
+	}
+
+	if want := "\x1b[2m[INST] \x1b[0m\x1b[32mHello\x1b[0m\x1b[2m [/INST]\x1b[0m"; got.ColorString() != want {
+		t.Errorf("ColorString() got = %q, want %q", got.ColorString(), want)
+	}
+}
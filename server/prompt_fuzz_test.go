@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"text/template/parse"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// fuzzTemplates are known-good templates used to seed the fuzz targets, they must render without an error
+// for any values of the variables
+var fuzzTemplates = []string{
+	"[INST] {{ .Prompt }} [/INST] {{ .Response }}",
+	"[INST] {{ if .System }}<<SYS>>{{ .System }}<</SYS>> {{ end }}{{ .Prompt }} [/INST] {{ .Response }}</s>",
+	"{{- if .First }}<s>{{ end }}[INST] {{ if and .First .System }}{{ .System }}\n\n{{ end }}{{ .Prompt }} [/INST]{{ .Response }}</s>",
+	"{{ if .System }}<|im_start|>system\n{{ .System }}<|im_end|>\n{{ end }}{{ if .Prompt }}<|im_start|>user\n{{ .Prompt }}<|im_end|>\n{{ end }}<|im_start|>assistant\n{{ .Response }}<|im_end|>\n",
+	"### System:\n{{ .System }}\n\n### User:\n{{ .Prompt }}\n\n### Response:\n{{ if .Response }}{{ .Response }}\n\n{{ end }}",
+	"User: {{ upper .Prompt }}\nAssistant:{{ with .Response }} {{ trim . }}{{ end }} {{ $.System }}",
+}
+
+// responseInRange reports whether the template renders the response within a range block. The part of the
+// range before the response is repeated for each iteration, so the cut prompt is not a prefix of the full one.
+func responseInRange(tmpl string) bool {
+	parsed, err := parseTemplateFuncs(tmpl, nil)
+	if err != nil || parsed.Tree == nil {
+		return false
+	}
+
+	return containsNode(parsed.Tree.Root.Nodes, func(node parse.Node) bool {
+		r, ok := node.(*parse.RangeNode)
+		return ok && (containsNode(r.List.Nodes, isResponseNode) || (r.ElseList != nil && containsNode(r.ElseList.Nodes, isResponseNode)))
+	})
+}
+
+func FuzzPrompt(f *testing.F) {
+	knownGood := make(map[string]bool)
+	for _, tmpl := range fuzzTemplates {
+		knownGood[tmpl] = true
+		f.Add(tmpl, "You are a wizard.", "What are the magic words?", "abracadabra")
+		f.Add(tmpl, "", "Hello", "")
+		f.Add(tmpl, "{{ .System }}", "", "}}")
+	}
+
+	f.Fuzz(func(t *testing.T, tmpl, system, prompt, response string) {
+		if _, err := parseTemplateFuncs(tmpl, nil); err != nil {
+			return
+		}
+
+		vars := PromptVars{System: system, Prompt: prompt, Response: response, First: true}
+
+		full, err := renderPrompt(tmpl, vars, false)
+		if knownGood[tmpl] && err != nil {
+			t.Fatalf("renderPrompt() error = %v", err)
+		}
+
+		cut, cutErr := renderPrompt(tmpl, vars, true)
+		if knownGood[tmpl] && cutErr != nil {
+			t.Fatalf("renderPrompt() with cut error = %v", cutErr)
+		}
+
+		if err != nil || cutErr != nil {
+			return
+		}
+
+		if knownGood[tmpl] && (system != "" || prompt != "" || response != "") && full == "" {
+			t.Errorf("renderPrompt() rendered an empty prompt for %q", tmpl)
+		}
+
+		if !responseInRange(tmpl) && !strings.HasPrefix(full, cut) {
+			t.Errorf("renderPrompt() with cut = %q, want a prefix of %q", cut, full)
+		}
+	})
+}
+
+// fuzzMessages parses a conversation written one message a line, as "role: content"
+func fuzzMessages(conversation string) []api.Message {
+	var msgs []api.Message
+	for _, line := range strings.Split(conversation, "\n") {
+		role, content, _ := strings.Cut(line, ": ")
+		msgs = append(msgs, api.Message{Role: role, Content: content})
+	}
+
+	return msgs
+}
+
+func FuzzChatPrompt(f *testing.F) {
+	knownGood := make(map[string]bool)
+	for _, tmpl := range fuzzTemplates {
+		knownGood[tmpl] = true
+		f.Add(tmpl, "user: What are the magic words?", 512)
+		f.Add(tmpl, "system: You are a wizard.\nuser: What are the magic words?\nassistant: abracadabra\nuser: Say them again", 512)
+		f.Add(tmpl, "user: Hello\nassistant: Hi\nuser: \nassistant: ", 2)
+		f.Add(tmpl, "system: You are a wizard.\nsystem: You are a cat.\nuser: Meow?", 1)
+	}
+
+	f.Fuzz(func(t *testing.T, tmpl, conversation string, numCtx int) {
+		if _, err := parseTemplateFuncs(tmpl, nil); err != nil {
+			return
+		}
+
+		m := &Model{Template: tmpl}
+		chat, err := m.ChatPrompts(fuzzMessages(conversation), "")
+		if errors.Is(err, ErrInvalidRole) || errors.Is(err, ErrEmptyPrompt) {
+			return
+		} else if err != nil {
+			t.Fatalf("ChatPrompts() error = %v", err)
+		}
+
+		// each rune is a token
+		encode := func(s string) ([]int, error) {
+			return make([]int, len([]rune(s))), nil
+		}
+
+		result, err := trimmedPrompt(context.Background(), chat, m, numCtx, encode, ChatPromptOptions{})
+		if errors.Is(err, ErrContextWindowExhausted) || !knownGood[tmpl] {
+			return
+		} else if err != nil {
+			t.Fatalf("ChatPrompt() error = %v", err)
+		}
+
+		if result.Prompt == "" {
+			t.Errorf("ChatPrompt() rendered an empty prompt for %q", tmpl)
+		}
+	})
+}
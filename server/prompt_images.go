@@ -0,0 +1,257 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+
+	"github.com/jmorganca/ollama/llm"
+)
+
+const (
+	defaultImageFetchTimeout = 30 * time.Second
+	defaultMaxImageFetchSize = 20 << 20
+)
+
+var (
+	// ErrImageTooLarge is returned when an image fetched from a URL is larger than
+	// ChatPromptOptions.MaxImageFetchSize
+	ErrImageTooLarge = errors.New("image is too large")
+	// ErrImageURLNotAllowed is returned when an image URL is not a data URL or on one of the hosts of
+	// ChatPromptOptions.ImageURLHosts
+	ErrImageURLNotAllowed = errors.New("image url not allowed")
+)
+
+// fetchImages returns a copy of the chat history with the images which have a URL but no data fetched, so their
+// token cost can be estimated. The chat history is returned as it is when there are none to fetch.
+func (opts ChatPromptOptions) fetchImages(ctx context.Context, chat *ChatHistory) (*ChatHistory, error) {
+	c := *chat
+	c.Prompts = slices.Clone(chat.Prompts)
+
+	var fetched bool
+	for i := range c.Prompts {
+		var cloned bool
+		for j := range c.Prompts[i].Images {
+			if img := c.Prompts[i].Images[j]; img.Data != nil || img.URL == "" {
+				continue
+			}
+
+			// the images are cloned so the chat history is left as it is
+			if !cloned {
+				c.Prompts[i].Images = slices.Clone(chat.Prompts[i].Images)
+				cloned = true
+			}
+			fetched = true
+
+			img := &c.Prompts[i].Images[j]
+			data, err := opts.fetchImage(ctx, img.URL)
+			if err != nil {
+				return nil, fmt.Errorf("fetch image %d: %w", img.ID, err)
+			}
+
+			img.Data = data
+			if img.Width == 0 && img.Height == 0 {
+				// the image size is used to estimate its token cost, it is left unset if the format is unknown
+				config, _, _ := image.DecodeConfig(bytes.NewReader(data))
+				img.Width, img.Height = config.Width, config.Height
+			}
+		}
+	}
+
+	if !fetched {
+		return chat, nil
+	}
+
+	return &c, nil
+}
+
+// imageURLAllowed reports whether an image may be fetched from the host of u over http or https
+func (opts ChatPromptOptions) imageURLAllowed(u *url.URL) bool {
+	return slices.Contains(opts.ImageURLHosts, u.Hostname())
+}
+
+// fetchImage returns the contents of an http, https, or data URL, which must not be larger than the
+// maximum image size
+func (opts ChatPromptOptions) fetchImage(ctx context.Context, rawURL string) ([]byte, error) {
+	limit := opts.MaxImageFetchSize
+	if limit <= 0 {
+		limit = defaultMaxImageFetchSize
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "data":
+		return decodeDataURL(rawURL, limit)
+	case "http", "https":
+		if !opts.imageURLAllowed(u) {
+			return nil, fmt.Errorf("%w: %s is not one of the allowed hosts", ErrImageURLNotAllowed, u.Hostname())
+		}
+	default:
+		return nil, fmt.Errorf("unsupported image url scheme %q", u.Scheme)
+	}
+
+	timeout := opts.ImageFetchTimeout
+	if timeout <= 0 {
+		timeout = defaultImageFetchTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := http.Client{}
+	if opts.ImageHTTPClient != nil {
+		client = *opts.ImageHTTPClient
+	}
+
+	// redirects are followed only to allowed hosts, the client's own policy is applied after that
+	checkRedirect := client.CheckRedirect
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if !opts.imageURLAllowed(req.URL) {
+			return fmt.Errorf("%w: redirected to %s, which is not one of the allowed hosts", ErrImageURLNotAllowed, req.URL.Hostname())
+		}
+
+		if checkRedirect != nil {
+			return checkRedirect(req, via)
+		}
+
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+
+		return nil
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	if resp.ContentLength > limit {
+		return nil, fmt.Errorf("%w: %d bytes, the limit is %d", ErrImageTooLarge, resp.ContentLength, limit)
+	}
+
+	// read one byte more than the limit to tell if the image is larger without reading all of it
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrImageTooLarge, limit)
+	}
+
+	return data, nil
+}
+
+// decodeDataURL returns the contents of a data URL, such as data:image/png;base64,iVBORw0KGgo...
+func decodeDataURL(rawURL string, limit int64) ([]byte, error) {
+	header, payload, ok := strings.Cut(strings.TrimPrefix(rawURL, "data:"), ",")
+	if !ok {
+		return nil, errors.New("invalid data url")
+	}
+
+	var data []byte
+	if strings.HasSuffix(header, ";base64") {
+		if int64(base64.StdEncoding.DecodedLen(len(payload))) > limit+2 {
+			return nil, fmt.Errorf("%w: more than %d bytes", ErrImageTooLarge, limit)
+		}
+
+		var err error
+		if data, err = base64.StdEncoding.DecodeString(payload); err != nil {
+			return nil, fmt.Errorf("invalid data url: %w", err)
+		}
+	} else {
+		s, err := url.PathUnescape(payload)
+		if err != nil {
+			return nil, fmt.Errorf("invalid data url: %w", err)
+		}
+
+		data = []byte(s)
+	}
+
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%w: %d bytes, the limit is %d", ErrImageTooLarge, len(data), limit)
+	}
+
+	return data, nil
+}
+
+// preprocessedImages returns a copy of the chat history with the data of each image replaced by the result of
+// preprocess. Images are preprocessed concurrently by as many workers as GOMAXPROCS.
+func (h *ChatHistory) preprocessedImages(preprocess func([]byte) ([]byte, error)) (*ChatHistory, error) {
+	c := *h
+	c.Prompts = make([]PromptVars, len(h.Prompts))
+
+	var images []*llm.ImageData
+	for i, prompt := range h.Prompts {
+		prompt.Images = slices.Clone(prompt.Images)
+		c.Prompts[i] = prompt
+		for j := range prompt.Images {
+			images = append(images, &c.Prompts[i].Images[j])
+		}
+	}
+
+	errs := make([]error, len(images))
+	indices := make(chan int)
+
+	var wg sync.WaitGroup
+	for n := min(runtime.GOMAXPROCS(0), len(images)); n > 0; n-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				img := images[i]
+
+				var data []byte
+				if data, errs[i] = preprocess(img.Data); errs[i] != nil {
+					errs[i] = fmt.Errorf("preprocess image %d: %w", img.ID, errs[i])
+					continue
+				}
+
+				// the preprocessor may resize the image, so its size is found again
+				config, _, _ := image.DecodeConfig(bytes.NewReader(data))
+				img.Data, img.Width, img.Height = data, config.Width, config.Height
+			}
+		}()
+	}
+
+	for i := range images {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &c, nil
+}
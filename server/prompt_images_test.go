@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jmorganca/ollama/api"
+	"github.com/jmorganca/ollama/llm"
+)
+
+func TestFetchImages(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 336, 224))); err != nil {
+		t.Fatal(err)
+	}
+	img := buf.Bytes()
+
+	var requests int
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/image.png":
+			w.Write(img)
+		case "/redirect":
+			// localhost is the same server, but not one of the allowed hosts
+			http.Redirect(w, r, strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)+"/image.png", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	allowed := ChatPromptOptions{ImageURLHosts: []string{"127.0.0.1"}}
+
+	tests := []struct {
+		name    string
+		url     string
+		opts    ChatPromptOptions
+		wantErr error
+	}{
+		{
+			name: "HTTP",
+			url:  srv.URL + "/image.png",
+			opts: allowed,
+		},
+		{
+			name: "Data URL",
+			url:  "data:image/png;base64," + base64.StdEncoding.EncodeToString(img),
+		},
+		{
+			name:    "Host Not Allowed",
+			url:     srv.URL + "/image.png",
+			wantErr: ErrImageURLNotAllowed,
+		},
+		{
+			name:    "Redirect Not Allowed",
+			url:     srv.URL + "/redirect",
+			opts:    allowed,
+			wantErr: ErrImageURLNotAllowed,
+		},
+		{
+			name:    "Too Large",
+			url:     srv.URL + "/image.png",
+			opts:    ChatPromptOptions{ImageURLHosts: allowed.ImageURLHosts, MaxImageFetchSize: 16},
+			wantErr: ErrImageTooLarge,
+		},
+		{
+			name:    "Data URL Too Large",
+			url:     "data:image/png;base64," + base64.StdEncoding.EncodeToString(img),
+			opts:    ChatPromptOptions{MaxImageFetchSize: 16},
+			wantErr: ErrImageTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chat := &ChatHistory{Prompts: []PromptVars{{Prompt: "What is in this image? [img-0]", Images: []llm.ImageData{{URL: tt.url}}}}}
+
+			fetched, err := tt.opts.fetchImages(context.Background(), chat)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("fetchImages() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("fetchImages() error = %v", err)
+			}
+
+			got := fetched.Prompts[0].Images[0]
+			if !bytes.Equal(got.Data, img) {
+				t.Errorf("fetchImages() fetched %d bytes, want %d", len(got.Data), len(img))
+			}
+
+			if got.Width != 336 || got.Height != 224 {
+				t.Errorf("fetchImages() size = %dx%d, want 336x224", got.Width, got.Height)
+			}
+
+			if chat.Prompts[0].Images[0].Data != nil {
+				t.Errorf("fetchImages() changed the chat history")
+			}
+		})
+	}
+
+	// images which already have data are not fetched again
+	requests = 0
+	chat := &ChatHistory{Prompts: []PromptVars{{Images: []llm.ImageData{{URL: srv.URL + "/image.png", Data: img}}}}}
+	if _, err := allowed.fetchImages(context.Background(), chat); err != nil {
+		t.Fatalf("fetchImages() error = %v", err)
+	}
+
+	if requests != 0 {
+		t.Errorf("fetchImages() made %d requests, want none", requests)
+	}
+
+	chat = &ChatHistory{Prompts: []PromptVars{{Images: []llm.ImageData{{URL: srv.URL + "/missing.png"}}}}}
+	if _, err := allowed.fetchImages(context.Background(), chat); err == nil {
+		t.Errorf("fetchImages() expected an error for a missing image")
+	}
+}
+
+func TestChatPromptsImageURLs(t *testing.T) {
+	m := &Model{Template: "[INST] {{ .Prompt }} [/INST]", ProjectorPaths: []string{"projector"}}
+
+	chat, err := m.ChatPrompts([]api.Message{
+		{Role: "user", Content: "What is in these images?", Images: []api.ImageData{[]byte("cat")}, ImageURLs: []string{"https://example.com/dog.png"}},
+	}, "")
+	if err != nil {
+		t.Fatalf("ChatPrompts() error = %v", err)
+	}
+
+	got := chat.Prompts[0]
+	if want := "What is in these images? [img-0] [img-1]"; got.Prompt != want {
+		t.Errorf("ChatPrompts() prompt = %q, want %q", got.Prompt, want)
+	}
+
+	if len(got.Images) != 2 || got.Images[1].ID != 1 || got.Images[1].URL != "https://example.com/dog.png" || got.Images[1].Data != nil {
+		t.Errorf("ChatPrompts() images = %+v, want the url as image 1", got.Images)
+	}
+}
+
+func TestPreprocessedImages(t *testing.T) {
+	chat := &ChatHistory{
+		Prompts: []PromptVars{
+			{Prompt: "What is in these images? [img-0] [img-1]", Images: []llm.ImageData{{ID: 0, Data: []byte("cat")}, {ID: 1, Data: []byte("dog")}}},
+			{Prompt: "And this one? [img-2]", Images: []llm.ImageData{{ID: 2, Data: []byte("hat")}}},
+		},
+	}
+
+	got, err := chat.preprocessedImages(func(data []byte) ([]byte, error) {
+		return bytes.ToUpper(data), nil
+	})
+	if err != nil {
+		t.Fatalf("preprocessedImages() error = %v", err)
+	}
+
+	for i, want := range [][]string{{"CAT", "DOG"}, {"HAT"}} {
+		for j := range want {
+			if string(got.Prompts[i].Images[j].Data) != want[j] {
+				t.Errorf("preprocessedImages() image %d of prompt %d = %q, want %q", j, i, got.Prompts[i].Images[j].Data, want[j])
+			}
+		}
+	}
+
+	if string(chat.Prompts[0].Images[0].Data) != "cat" {
+		t.Errorf("preprocessedImages() changed the chat history")
+	}
+
+	failure := errors.New("unsupported format")
+	if _, err := chat.preprocessedImages(func([]byte) ([]byte, error) { return nil, failure }); !errors.Is(err, failure) {
+		t.Errorf("preprocessedImages() error = %v, want %v", err, failure)
+	}
+}
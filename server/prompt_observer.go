@@ -0,0 +1,52 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// PromptObserver is notified as prompts are built, for profiling or to record metrics. Prompts are
+// tokenized in parallel, so its methods may be called concurrently.
+type PromptObserver interface {
+	// OnTemplateParseStart is called before a template is parsed, templates found in the cache are not parsed again
+	OnTemplateParseStart()
+	OnTemplateParseEnd(duration time.Duration)
+	// OnTokenizeStart is called before the prompt at msgIndex of a chat history is rendered and tokenized
+	OnTokenizeStart(msgIndex int)
+	OnTokenizeEnd(msgIndex, tokenCount int, duration time.Duration)
+	// OnTruncateMessage is called for each prompt of a chat history which is dropped to fit the context window
+	OnTruncateMessage(msgIndex int)
+}
+
+// NoopPromptObserver is a PromptObserver which does nothing, it is used until another observer is set
+type NoopPromptObserver struct{}
+
+func (NoopPromptObserver) OnTemplateParseStart()                 {}
+func (NoopPromptObserver) OnTemplateParseEnd(time.Duration)      {}
+func (NoopPromptObserver) OnTokenizeStart(int)                   {}
+func (NoopPromptObserver) OnTokenizeEnd(int, int, time.Duration) {}
+func (NoopPromptObserver) OnTruncateMessage(int)                 {}
+
+// observerValue wraps the observer so observers of different types can be stored in the same atomic.Value
+type observerValue struct {
+	PromptObserver
+}
+
+var promptObserver atomic.Value
+
+// SetPromptObserver sets the observer notified as prompts are built, a nil observer stops notifications
+func SetPromptObserver(o PromptObserver) {
+	if o == nil {
+		o = NoopPromptObserver{}
+	}
+
+	promptObserver.Store(observerValue{o})
+}
+
+func observer() PromptObserver {
+	if o, ok := promptObserver.Load().(observerValue); ok {
+		return o.PromptObserver
+	}
+
+	return NoopPromptObserver{}
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingObserver struct {
+	mu        sync.Mutex
+	parses    int
+	tokenized []int
+	truncated []int
+}
+
+func (o *recordingObserver) OnTemplateParseStart() {}
+
+func (o *recordingObserver) OnTemplateParseEnd(time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.parses++
+}
+
+func (o *recordingObserver) OnTokenizeStart(int) {}
+
+func (o *recordingObserver) OnTokenizeEnd(msgIndex, tokenCount int, _ time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.tokenized = append(o.tokenized, msgIndex)
+}
+
+func (o *recordingObserver) OnTruncateMessage(msgIndex int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.truncated = append(o.truncated, msgIndex)
+}
+
+func TestPromptObserver(t *testing.T) {
+	o := &recordingObserver{}
+	SetPromptObserver(o)
+	t.Cleanup(func() { SetPromptObserver(nil) })
+
+	FlushTemplateCache()
+
+	// prompts are tokenized one at a time, so tokenizing stops as soon as they are past the window
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+
+	m := &Model{Template: "[INST] {{ .Prompt }} [/INST] observed"}
+	chat := &ChatHistory{
+		Prompts: []PromptVars{
+			{Prompt: "What are the magic words?", Response: "abracadabra", First: true},
+			{Prompt: "Do you have a magic hat?", Response: "Of course."},
+			{Prompt: "What is the spell for invisibility?"},
+		},
+	}
+
+	if _, err := trimmedPrompt(context.Background(), chat, m, 1, mockEncode(1), ChatPromptOptions{}); err != nil {
+		t.Fatalf("ChatPrompt() error = %v", err)
+	}
+
+	sort.Ints(o.tokenized)
+	if !reflect.DeepEqual(o.tokenized, []int{1, 2}) {
+		t.Errorf("OnTokenizeEnd() got = %v, want [1 2]", o.tokenized)
+	}
+
+	if !reflect.DeepEqual(o.truncated, []int{0, 1}) {
+		t.Errorf("OnTruncateMessage() got = %v, want [0 1]", o.truncated)
+	}
+
+	if o.parses == 0 {
+		t.Errorf("OnTemplateParseEnd() was not called")
+	}
+}
@@ -0,0 +1,46 @@
+//go:build otelprompt
+
+package server
+
+import (
+	"context"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/jmorganca/ollama/server"
+
+var tracer atomic.Pointer[trace.Tracer]
+
+// SetTracerProvider sets the provider of the tracer used to record spans while building prompts. The
+// global OpenTelemetry tracer provider is used until it is set.
+func SetTracerProvider(tp trace.TracerProvider) {
+	t := tp.Tracer(tracerName)
+	tracer.Store(&t)
+}
+
+// promptSpan is a tracing span around building a prompt
+type promptSpan struct {
+	span trace.Span
+}
+
+func startPromptSpan(ctx context.Context, name string) (context.Context, promptSpan) {
+	t := otel.Tracer(tracerName)
+	if p := tracer.Load(); p != nil {
+		t = *p
+	}
+
+	ctx, span := t.Start(ctx, name)
+	return ctx, promptSpan{span: span}
+}
+
+func (s promptSpan) SetInt(key string, value int) {
+	s.span.SetAttributes(attribute.Int(key, value))
+}
+
+func (s promptSpan) End() {
+	s.span.End()
+}
@@ -0,0 +1,120 @@
+//go:build otelprompt
+
+package server
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// recordedSpan is a span recorded by a recordingTracerProvider
+type recordedSpan struct {
+	noop.Span
+
+	name, parent string
+	attributes   map[string]int64
+	ended        bool
+}
+
+func (s *recordedSpan) SetAttributes(kv ...attribute.KeyValue) {
+	for _, attr := range kv {
+		s.attributes[string(attr.Key)] = attr.Value.AsInt64()
+	}
+}
+
+func (s *recordedSpan) End(...trace.SpanEndOption) {
+	s.ended = true
+}
+
+// recordingTracerProvider records the spans started by its tracers in memory
+type recordingTracerProvider struct {
+	noop.TracerProvider
+
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+func (p *recordingTracerProvider) Tracer(string, ...trace.TracerOption) trace.Tracer {
+	return recordingTracer{provider: p}
+}
+
+type recordingTracer struct {
+	noop.Tracer
+
+	provider *recordingTracerProvider
+}
+
+func (t recordingTracer) Start(ctx context.Context, name string, _ ...trace.SpanStartOption) (context.Context, trace.Span) {
+	span := &recordedSpan{name: name, attributes: make(map[string]int64)}
+	if parent, ok := trace.SpanFromContext(ctx).(*recordedSpan); ok {
+		span.parent = parent.name
+	}
+
+	t.provider.mu.Lock()
+	defer t.provider.mu.Unlock()
+	t.provider.spans = append(t.provider.spans, span)
+	return trace.ContextWithSpan(ctx, span), span
+}
+
+func TestPromptSpans(t *testing.T) {
+	tp := &recordingTracerProvider{}
+	SetTracerProvider(tp)
+	t.Cleanup(func() { tracer.Store(nil) })
+
+	m := &Model{Template: "[INST] {{ .Prompt }} [/INST] {{ .Response }}"}
+	chat := &ChatHistory{
+		Prompts: []PromptVars{
+			{Prompt: "What are the magic words?", Response: "abracadabra", First: true},
+			{Prompt: "Do you have a magic hat?", Response: "Of course."},
+			{Prompt: "What is the spell for invisibility?"},
+		},
+	}
+
+	if _, err := trimmedPrompt(context.Background(), chat, m, 2, mockEncode(1), ChatPromptOptions{}); err != nil {
+		t.Fatalf("ChatPrompt() error = %v", err)
+	}
+
+	var prompt *recordedSpan
+	var counted int
+	for _, span := range tp.spans {
+		if !span.ended {
+			t.Errorf("span %s was not ended", span.name)
+		}
+
+		switch span.name {
+		case "ollama.chat_prompt":
+			prompt = span
+		case "ollama.count_tokens":
+			counted++
+			if span.parent != "ollama.chat_prompt" {
+				t.Errorf("span %s parent = %q, want ollama.chat_prompt", span.name, span.parent)
+			}
+
+			if want := map[string]int64{"tokens": 1}; !reflect.DeepEqual(span.attributes, want) {
+				t.Errorf("span %s attributes = %v, want %v", span.name, span.attributes, want)
+			}
+		default:
+			t.Errorf("unexpected span %s", span.name)
+		}
+	}
+
+	if prompt == nil {
+		t.Fatalf("ollama.chat_prompt span was not recorded")
+	}
+
+	want := map[string]int64{"message_count": 3, "window_size": 2, "truncated_messages": 1, "total_tokens": 2}
+	if !reflect.DeepEqual(prompt.attributes, want) {
+		t.Errorf("ollama.chat_prompt attributes = %v, want %v", prompt.attributes, want)
+	}
+
+	// tokenizing stops once the prompts are past the window, so the oldest is only tokenized in the same batch
+	if counted < 2 || counted > len(chat.Prompts) {
+		t.Errorf("recorded %d ollama.count_tokens spans, want 2 or 3", counted)
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"golang.org/x/exp/slices"
+)
+
+// ErrInvalidOutput is returned by ValidatePromptOutput when a response does not match the schema of the
+// structured output it was asked for
+var ErrInvalidOutput = errors.New("response does not match the schema")
+
+// outputSchemaURL is the url the schema is added to the compiler with, it is only used to refer to the schema
+const outputSchemaURL = "schema.json"
+
+// ValidatePromptOutput checks that the output of the model is JSON which matches the schema, for prompts with
+// PromptVars.StructuredOutput set. Errors for output which does not match wrap ErrInvalidOutput and describe
+// each part of the output which is wrong.
+func ValidatePromptOutput(output string, schema json.RawMessage) error {
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource(outputSchemaURL, bytes.NewReader(schema)); err != nil {
+		return fmt.Errorf("invalid schema: %w", err)
+	}
+
+	s, err := compiler.Compile(outputSchemaURL)
+	if err != nil {
+		return fmt.Errorf("invalid schema: %w", err)
+	}
+
+	// numbers are decoded as json.Number so large integers are compared exactly
+	d := json.NewDecoder(strings.NewReader(output))
+	d.UseNumber()
+
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return fmt.Errorf("%w: not valid JSON: %v", ErrInvalidOutput, err)
+	}
+
+	if _, err := d.Token(); err != io.EOF {
+		return fmt.Errorf("%w: not valid JSON: unexpected data after the JSON value", ErrInvalidOutput)
+	}
+
+	if err := s.Validate(v); err != nil {
+		var ve *jsonschema.ValidationError
+		if errors.As(err, &ve) {
+			// the properties of an object are not validated in order, the failures are sorted so the error is stable
+			failures := validationFailures(ve)
+			slices.Sort(failures)
+			return fmt.Errorf("%w: %s", ErrInvalidOutput, strings.Join(failures, "; "))
+		}
+
+		return fmt.Errorf("%w: %v", ErrInvalidOutput, err)
+	}
+
+	return nil
+}
+
+// validationFailures returns a description of each of the innermost causes of a validation error, which are
+// the checks of the schema the output failed
+func validationFailures(ve *jsonschema.ValidationError) []string {
+	if len(ve.Causes) == 0 {
+		location := ve.InstanceLocation
+		if location == "" {
+			location = "the response"
+		}
+
+		return []string{location + ": " + ve.Message}
+	}
+
+	var failures []string
+	for _, cause := range ve.Causes {
+		failures = append(failures, validationFailures(cause)...)
+	}
+
+	return failures
+}
+
+// RetryWithValidationError returns a follow-up prompt asking the model to respond again, after its previous
+// output failed to validate with ValidatePromptOutput
+func RetryWithValidationError(prevOutput string, validationErr error) string {
+	reason := strings.TrimPrefix(validationErr.Error(), ErrInvalidOutput.Error()+": ")
+
+	var sb strings.Builder
+	if prevOutput != "" {
+		fmt.Fprintf(&sb, "Your previous response was:\n%s\n\n", prevOutput)
+	}
+
+	fmt.Fprintf(&sb, "Your previous response was invalid because: %s; please try again.", reason)
+	return sb.String()
+}
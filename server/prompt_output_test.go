@@ -0,0 +1,67 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestValidatePromptOutput(t *testing.T) {
+	schema := json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"spell": {"type": "string"},
+			"duration": {"type": "integer", "minimum": 1}
+		},
+		"required": ["spell"]
+	}`)
+
+	tests := []struct {
+		name   string
+		output string
+		want   string
+	}{
+		{name: "Valid", output: `{"spell": "abracadabra", "duration": 10}`},
+		{name: "Whitespace", output: "\n  {\"spell\": \"abracadabra\"}\n"},
+		{name: "Not JSON", output: "The spell is abracadabra.", want: "response does not match the schema: not valid JSON: invalid character 'T' looking for beginning of value"},
+		{name: "Trailing Text", output: `{"spell": "abracadabra"} I hope this helps!`, want: "response does not match the schema: not valid JSON: unexpected data after the JSON value"},
+		{name: "Missing Property", output: `{"duration": 10}`, want: "response does not match the schema: the response: missing properties: 'spell'"},
+		{name: "Wrong Types", output: `{"spell": 1, "duration": 0}`, want: "response does not match the schema: /duration: must be >= 1 but found 0; /spell: expected string, but got number"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidatePromptOutput(tt.output, schema)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("ValidatePromptOutput() error = %v", err)
+				}
+
+				return
+			}
+
+			if !errors.Is(err, ErrInvalidOutput) || err.Error() != tt.want {
+				t.Errorf("ValidatePromptOutput() error = %v, want %s", err, tt.want)
+			}
+		})
+	}
+
+	if err := ValidatePromptOutput("{}", json.RawMessage(`{"type": 1}`)); err == nil || errors.Is(err, ErrInvalidOutput) {
+		t.Errorf("ValidatePromptOutput() error = %v, want an invalid schema error", err)
+	}
+}
+
+func TestRetryWithValidationError(t *testing.T) {
+	schema := json.RawMessage(`{"type": "object", "required": ["spell"]}`)
+	err := ValidatePromptOutput(`{"duration": 10}`, schema)
+
+	want := "Your previous response was:\n{\"duration\": 10}\n\nYour previous response was invalid because: the response: missing properties: 'spell'; please try again."
+	if got := RetryWithValidationError(`{"duration": 10}`, err); got != want {
+		t.Errorf("RetryWithValidationError() got = %q, want %q", got, want)
+	}
+
+	want = "Your previous response was invalid because: the response was empty; please try again."
+	if got := RetryWithValidationError("", errors.New("the response was empty")); got != want {
+		t.Errorf("RetryWithValidationError() got = %q, want %q", got, want)
+	}
+}
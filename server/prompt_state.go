@@ -0,0 +1,44 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// promptStateVersion is the version of the format written by MarshalPromptState
+const promptStateVersion = 1
+
+// promptState is a conversation saved by MarshalPromptState
+type promptState struct {
+	Version  int           `json:"version"`
+	Template string        `json:"template,omitempty"`
+	System   string        `json:"system,omitempty"`
+	Messages []api.Message `json:"messages"`
+}
+
+// MarshalPromptState encodes a conversation along with the template and system prompt it is rendered with, so
+// it can be saved and later reloaded with UnmarshalPromptState
+func MarshalPromptState(messages []api.Message, tmpl string, system string) ([]byte, error) {
+	return json.Marshal(promptState{
+		Version:  promptStateVersion,
+		Template: tmpl,
+		System:   system,
+		Messages: messages,
+	})
+}
+
+// UnmarshalPromptState decodes a conversation encoded by MarshalPromptState
+func UnmarshalPromptState(data []byte) (messages []api.Message, tmpl string, system string, err error) {
+	var state promptState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, "", "", fmt.Errorf("invalid prompt state: %w", err)
+	}
+
+	if state.Version != promptStateVersion {
+		return nil, "", "", fmt.Errorf("unsupported prompt state version %d", state.Version)
+	}
+
+	return state.Messages, state.Template, state.System, nil
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestPromptState(t *testing.T) {
+	messages := []api.Message{
+		{Role: "user", Content: "What is in this image?", Images: []api.ImageData{api.ImageData("cat")}},
+		{Role: "assistant", Content: "A cat", ToolCalls: []api.ToolCall{{Name: "describe", Arguments: []byte(`{"animal":"cat"}`)}}},
+		{Role: "tool_result", Content: "meow", ToolCallID: "call_0"},
+		{Role: "assistant", Content: "It is a", Incomplete: true, Metadata: map[string]any{"temperature": 0.8}},
+	}
+
+	tmpl := "[INST] {{ .System }} {{ .Prompt }} [/INST] {{ .Response }}"
+
+	data, err := MarshalPromptState(messages, tmpl, "You are a wizard.")
+	if err != nil {
+		t.Fatalf("MarshalPromptState() error = %v", err)
+	}
+
+	gotMessages, gotTmpl, gotSystem, err := UnmarshalPromptState(data)
+	if err != nil {
+		t.Fatalf("UnmarshalPromptState() error = %v", err)
+	}
+
+	if !reflect.DeepEqual(gotMessages, messages) {
+		t.Errorf("UnmarshalPromptState() messages = %#v, want %#v", gotMessages, messages)
+	}
+
+	if gotTmpl != tmpl || gotSystem != "You are a wizard." {
+		t.Errorf("UnmarshalPromptState() template = %q, system = %q", gotTmpl, gotSystem)
+	}
+
+	for _, data := range []string{"", "{", `{"version":2,"messages":[]}`} {
+		if _, _, _, err := UnmarshalPromptState([]byte(data)); err == nil {
+			t.Errorf("UnmarshalPromptState(%q) expected an error", data)
+		}
+	}
+}
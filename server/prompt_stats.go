@@ -0,0 +1,129 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// promptStatsSamples is the number of the most recent calls the percentiles of GlobalPromptStats are taken from
+const promptStatsSamples = 1024
+
+// PromptStats is the timing of a single call to PromptWithStats
+type PromptStats struct {
+	// ParseDuration is the time taken to parse the template, which is close to zero when it is cached. For a cut
+	// prompt it includes finding the part of the template before the response.
+	ParseDuration time.Duration
+	// ExecuteDuration is the time taken to execute the parsed template
+	ExecuteDuration time.Duration
+	Rendered        string
+}
+
+// PromptDurationStats summarizes the durations of a step of PromptWithStats
+type PromptDurationStats struct {
+	Mean time.Duration
+	Max  time.Duration
+	// P99 is the 99th percentile of the most recent calls
+	P99 time.Duration
+}
+
+// PromptStatsAggregate summarizes the calls to PromptWithStats since the server started
+type PromptStatsAggregate struct {
+	Count   int
+	Parse   PromptDurationStats
+	Execute PromptDurationStats
+}
+
+// durationStats accumulates durations, keeping the most recent ones for percentiles
+type durationStats struct {
+	total   time.Duration
+	max     time.Duration
+	samples []time.Duration
+}
+
+func (s *durationStats) add(d time.Duration, count int) {
+	s.total += d
+	s.max = max(s.max, d)
+
+	if len(s.samples) < promptStatsSamples {
+		s.samples = append(s.samples, d)
+	} else {
+		s.samples[count%promptStatsSamples] = d
+	}
+}
+
+func (s *durationStats) summary(count int) PromptDurationStats {
+	if count == 0 {
+		return PromptDurationStats{}
+	}
+
+	sorted := slices.Clone(s.samples)
+	slices.Sort(sorted)
+
+	return PromptDurationStats{
+		Mean: s.total / time.Duration(count),
+		Max:  s.max,
+		P99:  sorted[(len(sorted)-1)*99/100],
+	}
+}
+
+var promptStats struct {
+	mu      sync.Mutex
+	count   int
+	parse   durationStats
+	execute durationStats
+}
+
+// GlobalPromptStats returns the timing of all calls to PromptWithStats
+func GlobalPromptStats() PromptStatsAggregate {
+	promptStats.mu.Lock()
+	defer promptStats.mu.Unlock()
+
+	return PromptStatsAggregate{
+		Count:   promptStats.count,
+		Parse:   promptStats.parse.summary(promptStats.count),
+		Execute: promptStats.execute.summary(promptStats.count),
+	}
+}
+
+func recordPromptStats(stats PromptStats) {
+	promptStats.mu.Lock()
+	defer promptStats.mu.Unlock()
+
+	promptStats.parse.add(stats.ParseDuration, promptStats.count)
+	promptStats.execute.add(stats.ExecuteDuration, promptStats.count)
+	promptStats.count++
+}
+
+// PromptWithStats applies the prompt template in the same way as Prompt, and returns how long parsing and
+// executing the template took. The timing is also added to GlobalPromptStats.
+func PromptWithStats(tmpl, system, prompt, response string, cut bool) (rendered string, stats PromptStats, err error) {
+	start := time.Now()
+	if cut {
+		pre, _, err := extractParts(tmpl, nil)
+		if err != nil {
+			return "", PromptStats{}, err
+		}
+
+		tmpl = pre
+	}
+
+	t, err := parseTemplate(tmpl)
+	if err != nil {
+		return "", PromptStats{}, err
+	}
+
+	stats.ParseDuration = time.Since(start)
+
+	start = time.Now()
+	if rendered, err = executeTemplate(t, PromptVars{System: system, Prompt: prompt, Response: response, First: true}); err != nil {
+		return "", PromptStats{}, err
+	}
+
+	stats.ExecuteDuration = time.Since(start)
+	stats.Rendered = rendered
+
+	recordPromptStats(stats)
+	return rendered, stats, nil
+}
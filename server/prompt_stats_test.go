@@ -0,0 +1,60 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPromptWithStats(t *testing.T) {
+	tmpl := "[INST] {{ .System }} {{ .Prompt }} [/INST] {{ .Response }}</s>"
+	before := GlobalPromptStats().Count
+
+	for _, cut := range []bool{false, true} {
+		rendered, stats, err := PromptWithStats(tmpl, "You are a wizard.", "What are the magic words?", "abracadabra", cut)
+		if err != nil {
+			t.Fatalf("PromptWithStats() error = %v", err)
+		}
+
+		want, err := renderPrompt(tmpl, PromptVars{System: "You are a wizard.", Prompt: "What are the magic words?", Response: "abracadabra", First: true}, cut)
+		if err != nil {
+			t.Fatalf("renderPrompt() error = %v", err)
+		}
+
+		if rendered != want || stats.Rendered != want {
+			t.Errorf("PromptWithStats() cut = %v, got = %q, want %q", cut, rendered, want)
+		}
+	}
+
+	aggregate := GlobalPromptStats()
+	if aggregate.Count != before+2 {
+		t.Errorf("GlobalPromptStats() count = %d, want %d", aggregate.Count, before+2)
+	}
+
+	if aggregate.Execute.Max < aggregate.Execute.Mean || aggregate.Execute.Max < aggregate.Execute.P99 {
+		t.Errorf("GlobalPromptStats() execute = %+v, the maximum is less than the mean or 99th percentile", aggregate.Execute)
+	}
+
+	if _, _, err := PromptWithStats("{{ .Prompt", "", "", "", false); err == nil {
+		t.Errorf("PromptWithStats() expected an error for an invalid template")
+	}
+}
+
+func TestDurationStats(t *testing.T) {
+	var s durationStats
+
+	// more calls than samples, so the oldest samples are replaced
+	count := 2000
+	for i := 0; i < count; i++ {
+		s.add(time.Duration(i%100+1)*time.Millisecond, i)
+	}
+
+	got := s.summary(count)
+	want := PromptDurationStats{Mean: 50500 * time.Microsecond, Max: 100 * time.Millisecond, P99: 99 * time.Millisecond}
+	if got != want {
+		t.Errorf("summary() got = %+v, want %+v", got, want)
+	}
+
+	if got := (&durationStats{}).summary(0); got != (PromptDurationStats{}) {
+		t.Errorf("summary() without calls got = %+v, want zero", got)
+	}
+}
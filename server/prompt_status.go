@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// contextPreviewLength is the number of characters of the content of each message shown by ContextWindowStatus
+const contextPreviewLength = 40
+
+// ContextWindowStatus returns a table of how the context window of window tokens is used by a chat prompt
+// of used tokens, for debug logs. Each message is a row with its role, the start of its content, and its
+// number of tokens from tokenCounts, followed by a row for the tokens which remain. Messages are numbered
+// by turn, which starts at each user message.
+func ContextWindowStatus(window, used int, messages []api.Message, tokenCounts []int) string {
+	var sb strings.Builder
+	w := tabwriter.NewWriter(&sb, 0, 0, 2, ' ', 0)
+
+	var turn int
+	for i, msg := range messages {
+		role := strings.ToLower(msg.Role)
+
+		label := "System"
+		if role != "system" && role != "developer" {
+			if role == "user" || turn == 0 {
+				turn++
+			}
+
+			label = fmt.Sprintf("Turn %d", turn)
+		}
+
+		var tokens int
+		if i < len(tokenCounts) {
+			tokens = tokenCounts[i]
+		}
+
+		fmt.Fprintf(w, "%s:\t%s\t%q\t%s\n", label, role, contentPreview(msg.Content), tokenUsage(tokens, window))
+	}
+
+	fmt.Fprintf(w, "Remaining:\t\t\t%s\n", tokenUsage(window-used, window))
+	w.Flush()
+
+	return sb.String()
+}
+
+// contentPreview returns the start of the content of a message on a single line
+func contentPreview(content string) string {
+	content = strings.Join(strings.Fields(content), " ")
+	if runes := []rune(content); len(runes) > contextPreviewLength {
+		return string(runes[:contextPreviewLength]) + "…"
+	}
+
+	return content
+}
+
+// tokenUsage formats a number of tokens as a part of the context window, such as 128/4096 (3%)
+func tokenUsage(tokens, window int) string {
+	var percent int
+	if window > 0 {
+		percent = tokens * 100 / window
+	}
+
+	return fmt.Sprintf("%d/%d (%d%%)", tokens, window, percent)
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestContextWindowStatus(t *testing.T) {
+	messages := []api.Message{
+		{Role: "system", Content: "You are a wizard."},
+		{Role: "user", Content: "What are the magic words?"},
+		{Role: "assistant", Content: "abracadabra"},
+		{Role: "user", Content: "Which spell makes\nyou invisible and how long does it last?"},
+	}
+
+	got := ContextWindowStatus(4096, 2896, messages, []int{128, 340, 28, 2000})
+	want := `System:     system     "You are a wizard."                          128/4096 (3%)
+Turn 1:     user       "What are the magic words?"                  340/4096 (8%)
+Turn 1:     assistant  "abracadabra"                                28/4096 (0%)
+Turn 2:     user       "Which spell makes you invisible and how …"  2000/4096 (48%)
+Remaining:                                                          1200/4096 (29%)
+`
+
+	if got != want {
+		t.Errorf("ContextWindowStatus() got =\n%s\nwant\n%s", got, want)
+	}
+
+	// missing token counts are shown as zero
+	got = ContextWindowStatus(0, 0, []api.Message{{Role: "user", Content: "Hello"}}, nil)
+	want = `Turn 1:     user  "Hello"  0/0 (0%)
+Remaining:                 0/0 (0%)
+`
+
+	if got != want {
+		t.Errorf("ContextWindowStatus() got =\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// summaryRoleFormatters format each message of the conversation given to the summarizer of SummarizeConversation
+var summaryRoleFormatters = map[string]string{
+	"system":      "System: %s\n",
+	"developer":   "Developer: %s\n",
+	"user":        "User: %s\n",
+	"assistant":   "Assistant: %s\n",
+	"tool":        "Tool call: %s\n",
+	"tool_result": "Tool result: %s\n",
+}
+
+// summaryInstruction is given to the summarizer before the conversation
+const summaryInstruction = "Summarize the following conversation, keeping the facts, decisions, and open questions needed to continue it."
+
+// summaryPrefix starts the content of the system message returned by SummarizeConversation
+const summaryPrefix = "Summary of the conversation so far:\n"
+
+// SummarizeConversation renders the messages as a transcript and asks summarizer to summarize it in at most
+// maxTokens tokens, zero for no limit. The summarizer is usually a request to a model, such as /api/generate.
+// The summary is returned as a system message, which can replace the messages in the chat history.
+func SummarizeConversation(messages []api.Message, maxTokens int, summarizer func(string) (string, error)) (api.Message, error) {
+	if len(messages) == 0 {
+		return api.Message{}, fmt.Errorf("%w: no messages to summarize", ErrEmptyPrompt)
+	}
+
+	transcript, err := NewPromptFromMessages(messages, summaryRoleFormatters)
+	if err != nil {
+		return api.Message{}, err
+	}
+
+	instruction := summaryInstruction
+	if maxTokens > 0 {
+		instruction += fmt.Sprintf(" Use at most %d tokens.", maxTokens)
+	}
+
+	summary, err := summarizer(instruction + "\n\n" + transcript)
+	if err != nil {
+		return api.Message{}, fmt.Errorf("summarize conversation: %w", err)
+	}
+
+	summary = strings.TrimSpace(summary)
+	if summary == "" {
+		return api.Message{}, errors.New("summarize conversation: the summary is empty")
+	}
+
+	return api.Message{Role: "system", Content: summaryPrefix + summary}, nil
+}
+
+// summarizeMessages replaces the oldest messages with a summary when the messages are estimated to use more than
+// SummarizeThreshold of the window. The most recent messages which fit within the threshold are kept, the summary
+// is asked to fit in the rest of the window.
+func (opts ChatPromptOptions) summarizeMessages(msgs []api.Message, window int) ([]api.Message, error) {
+	budget := int(opts.SummarizeThreshold * float64(window))
+
+	var total int
+	for _, msg := range msgs {
+		tokens, err := estimateMessageTokens(msg)
+		if err != nil {
+			return nil, err
+		}
+
+		total += tokens
+	}
+
+	if total <= budget {
+		return msgs, nil
+	}
+
+	strategy := SummarizeStrategy{
+		Summarize: func(dropped []api.Message) (string, error) {
+			summary, err := SummarizeConversation(dropped, max(window-budget, 0), opts.Summarizer)
+			return summary.Content, err
+		},
+	}
+
+	return strategy.Truncate(msgs, budget)
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestSummarizeConversation(t *testing.T) {
+	msgs := []api.Message{
+		{Role: "system", Content: "You are a wizard."},
+		{Role: "user", Content: "What are the magic words?"},
+		{Role: "assistant", Content: "abracadabra"},
+	}
+
+	var got string
+	summary, err := SummarizeConversation(msgs, 64, func(s string) (string, error) {
+		got = s
+		return " The user asked for the magic words, which are abracadabra.\n", nil
+	})
+	if err != nil {
+		t.Fatalf("SummarizeConversation() error = %v", err)
+	}
+
+	want := "Summarize the following conversation, keeping the facts, decisions, and open questions needed to continue it. Use at most 64 tokens.\n\nSystem: You are a wizard.\nUser: What are the magic words?\nAssistant: abracadabra\n"
+	if got != want {
+		t.Errorf("SummarizeConversation() summarizer got = %q, want %q", got, want)
+	}
+
+	if want := (api.Message{Role: "system", Content: "Summary of the conversation so far:\nThe user asked for the magic words, which are abracadabra."}); !reflect.DeepEqual(summary, want) {
+		t.Errorf("SummarizeConversation() got = %#v, want %#v", summary, want)
+	}
+
+	failure := errors.New("model is not loaded")
+	if _, err := SummarizeConversation(msgs, 0, func(string) (string, error) { return "", failure }); !errors.Is(err, failure) {
+		t.Errorf("SummarizeConversation() error = %v, want %v", err, failure)
+	}
+
+	if _, err := SummarizeConversation(msgs, 0, func(string) (string, error) { return " ", nil }); err == nil {
+		t.Errorf("SummarizeConversation() expected an error for an empty summary")
+	}
+
+	if _, err := SummarizeConversation(nil, 0, func(string) (string, error) { return "abracadabra", nil }); !errors.Is(err, ErrEmptyPrompt) {
+		t.Errorf("SummarizeConversation() error = %v, want %v", err, ErrEmptyPrompt)
+	}
+}
+
+func TestChatPromptSummarizeThreshold(t *testing.T) {
+	m := &Model{Template: "[INST] {{ .System }} {{ .Prompt }} [/INST] {{ .Response }}"}
+	msgs := []api.Message{
+		{Role: "system", Content: "You are a wizard."},
+		{Role: "user", Content: "What are the magic words?"},
+		{Role: "assistant", Content: "abracadabra"},
+		{Role: "user", Content: "Do you have a hat?"},
+	}
+
+	chat, err := m.ChatPrompts(msgs, "")
+	if err != nil {
+		t.Fatalf("ChatPrompts() error = %v", err)
+	}
+
+	var summarized string
+	summarizer := func(s string) (string, error) {
+		summarized = s
+		return "The user asked for the magic words.", nil
+	}
+
+	// the messages are estimated to use 20 tokens, half of the window
+	opts := ChatPromptOptions{SummarizeThreshold: 0.5, Summarizer: summarizer}
+	result, _, err := ChatPromptWithStats(context.Background(), chat, m, 40, NewMockEncoder(), opts)
+	if err != nil {
+		t.Fatalf("ChatPromptWithStats() error = %v", err)
+	}
+
+	want := "[INST] You are a wizard. What are the magic words? [/INST] abracadabra[INST]  Do you have a hat? [/INST] "
+	if result.Prompt != want || summarized != "" {
+		t.Errorf("ChatPromptWithStats() summarized messages below the threshold: %q", result.Prompt)
+	}
+
+	opts.SummarizeThreshold = 0.25
+	result, _, err = ChatPromptWithStats(context.Background(), chat, m, 40, NewMockEncoder(), opts)
+	if err != nil {
+		t.Fatalf("ChatPromptWithStats() error = %v", err)
+	}
+
+	want = "[INST] You are a wizard.\n\nSummary of the conversation so far:\nThe user asked for the magic words. Do you have a hat? [/INST] "
+	if result.Prompt != want {
+		t.Errorf("ChatPromptWithStats() got = %q, want %q", result.Prompt, want)
+	}
+
+	// the summary is asked to fit in the part of the window above the threshold
+	if wantSummarized := "Summarize the following conversation, keeping the facts, decisions, and open questions needed to continue it. Use at most 30 tokens.\n\nUser: What are the magic words?\nAssistant: abracadabra\n"; summarized != wantSummarized {
+		t.Errorf("ChatPromptWithStats() summarizer got = %q, want %q", summarized, wantSummarized)
+	}
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"log/slog"
+	"sync"
+)
+
+// TemplateVersion identifies the content of a prompt template, see NewTemplateVersion
+type TemplateVersion uint64
+
+// NewTemplateVersion returns the version of a template, taken from the sha256 digest of its content
+func NewTemplateVersion(tmpl string) TemplateVersion {
+	digest := sha256.Sum256([]byte(tmpl))
+	return TemplateVersion(binary.BigEndian.Uint64(digest[:8]))
+}
+
+// templateVersion returns the version of the template of the model
+func (m *Model) templateVersion() TemplateVersion {
+	if m.TemplateVersion != 0 {
+		return m.TemplateVersion
+	}
+
+	return NewTemplateVersion(m.Template)
+}
+
+// conversationTemplates is the version of the template each conversation was last prompted with, by its id
+var conversationTemplates sync.Map
+
+// checkTemplateVersion records the version of the template a conversation is prompted with, and warns when it
+// has changed since the last prompt of the conversation. It reports whether the version changed.
+func checkTemplateVersion(conversationID string, version TemplateVersion) bool {
+	previous, loaded := conversationTemplates.Swap(conversationID, version)
+	if !loaded || previous.(TemplateVersion) == version {
+		return false
+	}
+
+	slog.Warn("prompt template changed during the conversation", "conversation", conversationID, "previous", previous, "current", version)
+	return true
+}
+
+// ForgetConversation removes the template version recorded for a conversation which has ended
+func ForgetConversation(conversationID string) {
+	conversationTemplates.Delete(conversationID)
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTemplateVersion(t *testing.T) {
+	if NewTemplateVersion("[INST] {{ .Prompt }} [/INST]") != NewTemplateVersion("[INST] {{ .Prompt }} [/INST]") {
+		t.Errorf("NewTemplateVersion() differs for the same template")
+	}
+
+	if NewTemplateVersion("[INST] {{ .Prompt }} [/INST]") == NewTemplateVersion("<|user|>{{ .Prompt }}<|assistant|>") {
+		t.Errorf("NewTemplateVersion() is the same for different templates")
+	}
+
+	chat := &ChatHistory{Prompts: []PromptVars{{Prompt: "What are the magic words?", First: true}}}
+	opts := ChatPromptOptions{ConversationID: "test-template-version"}
+	defer ForgetConversation(opts.ConversationID)
+
+	steps := []struct {
+		template string
+		changed  bool
+	}{
+		{template: "[INST] {{ .Prompt }} [/INST]"},
+		{template: "[INST] {{ .Prompt }} [/INST]"},
+		{template: "<|user|>{{ .Prompt }}<|assistant|>", changed: true},
+		{template: "<|user|>{{ .Prompt }}<|assistant|>"},
+	}
+
+	for i, step := range steps {
+		m := &Model{Template: step.template}
+		previous, _ := conversationTemplates.Load(opts.ConversationID)
+
+		if _, err := trimmedPrompt(context.Background(), chat, m, 512, NewMockEncoder(), opts); err != nil {
+			t.Fatalf("ChatPrompt() error = %v", err)
+		}
+
+		current, _ := conversationTemplates.Load(opts.ConversationID)
+		if current != m.templateVersion() {
+			t.Errorf("step %d: recorded version = %v, want %v", i, current, m.templateVersion())
+		}
+
+		if changed := previous != nil && previous != current; changed != step.changed {
+			t.Errorf("step %d: changed = %v, want %v", i, changed, step.changed)
+		}
+	}
+
+	if !checkTemplateVersion(opts.ConversationID, 1) || checkTemplateVersion(opts.ConversationID, 1) {
+		t.Errorf("checkTemplateVersion() did not report the change of version once")
+	}
+
+	ForgetConversation(opts.ConversationID)
+	if _, ok := conversationTemplates.Load(opts.ConversationID); ok {
+		t.Errorf("ForgetConversation() did not remove the conversation")
+	}
+}
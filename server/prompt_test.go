@@ -0,0 +1,1333 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slices"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestPromptWithContext(t *testing.T) {
+	template := "[INST] {{ .System }} {{ .Prompt }} [/INST] {{ .Response }}</s>"
+	vars := PromptVars{
+		System:   "You are a Wizard.",
+		Prompt:   "What are the potion ingredients?",
+		Response: "I don't know.",
+	}
+
+	t.Run("Complete", func(t *testing.T) {
+		got, err := PromptWithContext(context.Background(), template, vars, false)
+		if err != nil {
+			t.Fatalf("PromptWithContext() error = %v", err)
+		}
+
+		want := "[INST] You are a Wizard. What are the potion ingredients? [/INST] I don't know.</s>"
+		if got != want {
+			t.Errorf("PromptWithContext() got = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Cut", func(t *testing.T) {
+		got, err := PromptWithContext(context.Background(), template, PromptVars{System: vars.System, Prompt: vars.Prompt}, true)
+		if err != nil {
+			t.Fatalf("PromptWithContext() error = %v", err)
+		}
+
+		want := "[INST] You are a Wizard. What are the potion ingredients? [/INST] "
+		if got != want {
+			t.Errorf("PromptWithContext() got = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if _, err := PromptWithContext(ctx, template, vars, false); !errors.Is(err, context.Canceled) {
+			t.Errorf("PromptWithContext() error = %v, want %v", err, context.Canceled)
+		}
+	})
+
+	t.Run("Deadline Exceeded", func(t *testing.T) {
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+		defer cancel()
+
+		if _, err := PromptWithContext(ctx, template, vars, false); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("PromptWithContext() error = %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+
+	t.Run("Cancelled While Executing", func(t *testing.T) {
+		started, release := make(chan struct{}), make(chan struct{})
+		defer close(release)
+
+		// the template blocks in the middle of executing until it is released
+		blocking := vars
+		blocking.TemplateHook = func(vars map[string]any) error {
+			vars["Wait"] = func() string {
+				close(started)
+				<-release
+				return ""
+			}
+			return nil
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-started
+			cancel()
+		}()
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := PromptWithContext(ctx, "{{ .Prompt }}{{ call .Wait }} {{ .Response }}", blocking, false)
+			done <- err
+		}()
+
+		select {
+		case err := <-done:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("PromptWithContext() error = %v, want %v", err, context.Canceled)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("PromptWithContext() did not return after the context was cancelled")
+		}
+	})
+}
+
+func TestPromptBuilder(t *testing.T) {
+	template := "[INST] {{ .System }} {{ .Prompt }} [/INST] {{ .Response }}</s>"
+
+	got, err := NewPromptBuilder().
+		WithTemplate(template).
+		WithSystem("You are a Wizard.").
+		WithPrompt("What are the potion ingredients?").
+		WithResponse("I don't know.").
+		Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+
+	want := "[INST] You are a Wizard. What are the potion ingredients? [/INST] I don't know.</s>"
+	if got != want {
+		t.Errorf("Build() got = %v, want %v", got, want)
+	}
+
+	got, err = NewPromptBuilder().WithTemplate(template).WithPrompt("What are the potion ingredients?").WithCut(true).Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+
+	want = "[INST]  What are the potion ingredients? [/INST] "
+	if got != want {
+		t.Errorf("Build() got = %v, want %v", got, want)
+	}
+
+	if _, err := NewPromptBuilder().WithPrompt("What are the potion ingredients?").Build(); !errors.Is(err, errNoPromptTemplate) {
+		t.Errorf("Build() error = %v, want %v", err, errNoPromptTemplate)
+	}
+}
+
+func TestPromptWithFuncs(t *testing.T) {
+	vars := PromptVars{System: "You are a Wizard.", Prompt: "What are the potion ingredients?"}
+
+	got, err := PromptWithFuncs(`{{ .System | upper }} {{ "=" | repeat 3 }} {{ .Prompt | json }} {{ add 1 2 }}`, vars, false, nil)
+	if err != nil {
+		t.Fatalf("PromptWithFuncs() error = %v", err)
+	}
+
+	want := `YOU ARE A WIZARD. === "What are the potion ingredients?" 3`
+	if got != want {
+		t.Errorf("PromptWithFuncs() got = %q, want %q", got, want)
+	}
+
+	if _, err := PromptWithFuncs(`{{ "=" | repeat -1 }}`, vars, false, nil); err == nil {
+		t.Errorf("PromptWithFuncs() expected an error for a negative repeat count")
+	}
+
+	template := "{{ .Prompt | shout }} [/INST] {{ .Response }}"
+	if _, err := Prompt(template, vars); err == nil {
+		t.Errorf("Prompt() expected an error for an undefined function")
+	}
+
+	// functions with the same name are bound to the template each time it is rendered
+	for _, suffix := range []string{"!", "!!"} {
+		suffix := suffix
+		funcs := map[string]any{
+			"shout": func(s string) string { return strings.ToUpper(s) + suffix },
+		}
+
+		got, err := PromptWithFuncs(template, vars, true, funcs)
+		if err != nil {
+			t.Fatalf("PromptWithFuncs() error = %v", err)
+		}
+
+		if want := "WHAT ARE THE POTION INGREDIENTS?" + suffix + " [/INST] "; got != want {
+			t.Errorf("PromptWithFuncs() got = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestParsePromptTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		want     PromptTemplate
+	}{
+		{
+			template: "[INST] {{ if .System }}{{ .System }} {{ end }}{{ .Prompt }} [/INST]",
+			want:     PromptTemplate{HasSystem: true, HasPrompt: true},
+		},
+		{
+			template: "<|user|>{{ .Prompt }}<|assistant|>{{ .Response }}",
+			want:     PromptTemplate{HasPrompt: true, HasResponse: true},
+		},
+		{
+			template: "{% if system %}{{ system }}{% endif %}",
+			want:     PromptTemplate{HasSystem: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			got, err := ParsePromptTemplate(tt.template)
+			if err != nil {
+				t.Fatalf("ParsePromptTemplate() error = %v", err)
+			}
+
+			if got.HasSystem != tt.want.HasSystem || got.HasPrompt != tt.want.HasPrompt || got.HasResponse != tt.want.HasResponse {
+				t.Errorf("ParsePromptTemplate() got = %+v, want %+v", got, tt.want)
+			}
+
+			if got.Source != tt.template {
+				t.Errorf("ParsePromptTemplate() source = %q, want %q", got.Source, tt.template)
+			}
+
+			vars := PromptVars{System: "You are a Wizard.", Prompt: "What are the potion ingredients?", Response: "I don't know."}
+			want, err := Prompt(tt.template, vars)
+			if err != nil {
+				t.Fatalf("Prompt() error = %v", err)
+			}
+
+			if got, err := got.Prompt(vars); err != nil || got != want {
+				t.Errorf("PromptTemplate.Prompt() got = %q, %v, want %q", got, err, want)
+			}
+		})
+	}
+
+	if _, err := ParsePromptTemplate("{{ .Prompt"); err == nil {
+		t.Errorf("ParsePromptTemplate() expected an error for an invalid template")
+	}
+}
+
+func TestParsePromptTemplateFromModelfile(t *testing.T) {
+	if _, err := ParsePromptTemplateFromModelfile("[INST] {{ .Prompt }} [/INST]", 22); err != nil {
+		t.Fatalf("ParsePromptTemplateFromModelfile() error = %v", err)
+	}
+
+	_, err := ParsePromptTemplateFromModelfile("[INST]\n{{ if .System }}{{ .System }}\n{{ .Prompt }} [/INST]", 22)
+
+	var tmplErr *ModelfileTemplateError
+	if !errors.As(err, &tmplErr) {
+		t.Fatalf("ParsePromptTemplateFromModelfile() error = %v, want a ModelfileTemplateError", err)
+	}
+
+	if want := "Modelfile line 25: unexpected EOF"; err.Error() != want {
+		t.Errorf("ParsePromptTemplateFromModelfile() error = %q, want %q", err, want)
+	}
+}
+
+func TestParseTemplateCache(t *testing.T) {
+	FlushTemplateCache()
+	t.Cleanup(FlushTemplateCache)
+
+	template := "[INST] {{ .System }} {{ .Prompt }} [/INST] {{ .Response }}"
+
+	first, err := parseTemplate(template)
+	if err != nil {
+		t.Fatalf("parseTemplate() error = %v", err)
+	}
+
+	second, err := parseTemplate(template)
+	if err != nil {
+		t.Fatalf("parseTemplate() error = %v", err)
+	}
+
+	if first == second {
+		t.Errorf("parseTemplate() returned the cached template instead of a clone")
+	}
+
+	if first.Tree != second.Tree {
+		t.Errorf("parseTemplate() parsed the template again instead of using the cache")
+	}
+
+	FlushTemplateCache()
+
+	third, err := parseTemplate(template)
+	if err != nil {
+		t.Fatalf("parseTemplate() error = %v", err)
+	}
+
+	if first.Tree == third.Tree {
+		t.Errorf("parseTemplate() used the cache after it was flushed")
+	}
+
+	if _, err := parseTemplate("{{ .Prompt "); err == nil {
+		t.Errorf("parseTemplate() expected error, got nil")
+	}
+}
+
+func TestParseTemplateCacheEviction(t *testing.T) {
+	FlushTemplateCache()
+	t.Cleanup(FlushTemplateCache)
+
+	first, err := parseTemplate("{{ .Prompt }} 0")
+	if err != nil {
+		t.Fatalf("parseTemplate() error = %v", err)
+	}
+
+	for i := 1; i <= 2*maxCachedTemplates; i++ {
+		if _, err := parseTemplate(fmt.Sprintf("{{ .Prompt }} %d", i)); err != nil {
+			t.Fatalf("parseTemplate() error = %v", err)
+		}
+
+		// the first template is used again so it is not evicted
+		if i%(maxCachedTemplates/2) == 0 {
+			if _, err := parseTemplate("{{ .Prompt }} 0"); err != nil {
+				t.Fatalf("parseTemplate() error = %v", err)
+			}
+		}
+	}
+
+	if n := templateCache.size(); n != maxCachedTemplates {
+		t.Errorf("template cache has %d templates, want %d", n, maxCachedTemplates)
+	}
+
+	again, err := parseTemplate("{{ .Prompt }} 0")
+	if err != nil {
+		t.Fatalf("parseTemplate() error = %v", err)
+	}
+
+	if first.Tree != again.Tree {
+		t.Errorf("parseTemplate() evicted a recently used template")
+	}
+
+	// the templates which were not used again were evicted from the oldest
+	if _, ok := templateCache.load(sha256.Sum256([]byte("{{ .Prompt }} 1\x00"))); ok {
+		t.Errorf("template cache kept the least recently used template")
+	}
+}
+
+func TestValidatePromptTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		wantErr  string
+	}{
+		{
+			name:     "Known Variables",
+			template: "{{ if .First }}<s>{{ end }}[INST] {{ if .System }}<<SYS>>{{ .System }}<</SYS>>{{ end }} {{ .Prompt }} [/INST] {{ .Response }}",
+		},
+		{
+			name:     "Tool Variables",
+			template: "{{ .Prompt }}{{ if .Tool }}[TOOL_CALLS] {{ .Tool }}[TOOL_RESULTS] {{ .ToolResult }}{{ end }}",
+		},
+		{
+			name:     "Fields Within With Block",
+			template: "{{ with .System }}{{ .Ignored }}{{ end }}{{ .Prompt }}",
+		},
+		{
+			name:     "Unknown Variables",
+			template: "{{ .Instruct }} {{ if .Context }}{{ .Prompt }}{{ end }} {{ .Instruct }}",
+			wantErr:  "template references unknown variables: .Context, .Instruct",
+		},
+		{
+			name:     "Invalid Template",
+			template: "{{ .Prompt ",
+			wantErr:  "unclosed action",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidatePromptTemplate(tt.template)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("ValidatePromptTemplate() error = %v", err)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ValidatePromptTemplate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRenderSystemPrompt(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{
+			name:     "Llama 2",
+			template: "[INST] {{ if .System }}<<SYS>>{{ .System }}<</SYS>>{{ end }} {{ .Prompt }} [/INST] {{ .Response }}",
+			want:     "[INST] <<SYS>>You are a wizard.<</SYS>> ",
+		},
+		{
+			name:     "ChatML",
+			template: "{{ if .System }}<|im_start|>system\n{{ .System }}<|im_end|>\n{{ end }}{{ if .Prompt }}<|im_start|>user\n{{ .Prompt }}<|im_end|>\n{{ end }}<|im_start|>assistant\n",
+			want:     "<|im_start|>system\nYou are a wizard.<|im_end|>\n",
+		},
+		{
+			name:     "Without System",
+			template: "### User:\n{{ .Prompt }}\n### Assistant:\n",
+			want:     "### User:\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := RenderSystemPrompt(tt.template, "You are a wizard.")
+			if err != nil {
+				t.Fatalf("RenderSystemPrompt() error = %v", err)
+			}
+
+			if got != tt.want {
+				t.Errorf("RenderSystemPrompt() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitPromptAtResponse(t *testing.T) {
+	tests := []struct {
+		name         string
+		template     string
+		prefix       string
+		responsePart string
+		wantErr      bool
+	}{
+		{
+			name:         "Llama 2",
+			template:     "[INST] {{ if .System }}<<SYS>>{{ .System }}<</SYS>> {{ end }}{{ .Prompt }} [/INST] {{ .Response }}</s>",
+			prefix:       "[INST] <<SYS>>You are a wizard.<</SYS>> What are the magic words? [/INST] ",
+			responsePart: "</s>",
+		},
+		{
+			name:         "Response in Condition",
+			template:     "### User:\n{{ .Prompt }}\n### Assistant:\n{{ if true }}{{ .Response }}\n{{ end }}",
+			prefix:       "### User:\nWhat are the magic words?\n### Assistant:\n",
+			responsePart: "\n",
+		},
+		{
+			name:     "No Response",
+			template: "<|user|>{{ .Prompt }}<|assistant|>",
+			prefix:   "<|user|>What are the magic words?<|assistant|>",
+		},
+		{
+			name:     "Response in Range",
+			template: "{{ range 2 }}<|user|>{{ $.Prompt }}<|assistant|>{{ $.Response }}<|end|>{{ end }}",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefix, responsePart, err := SplitPromptAtResponse(tt.template, "You are a wizard.", "What are the magic words?")
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("SplitPromptAtResponse() expected an error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("SplitPromptAtResponse() error = %v", err)
+			}
+
+			if prefix != tt.prefix || responsePart != tt.responsePart {
+				t.Errorf("SplitPromptAtResponse() got = %q, %q, want %q, %q", prefix, responsePart, tt.prefix, tt.responsePart)
+			}
+		})
+	}
+}
+
+func TestPartialPrompt(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		response string
+		want     string
+	}{
+		{
+			name:     "Partial Response",
+			template: "[INST] {{ if .System }}<<SYS>>{{ .System }}<</SYS>> {{ end }}{{ .Prompt }} [/INST] {{ .Response }}</s>",
+			response: "abra",
+			want:     "[INST] <<SYS>>You are a wizard.<</SYS>> What are the magic words? [/INST] abra</s>",
+		},
+		{
+			name:     "Empty Response",
+			template: "[INST] {{ if .System }}<<SYS>>{{ .System }}<</SYS>> {{ end }}{{ .Prompt }} [/INST] {{ .Response }}</s>",
+			want:     "[INST] <<SYS>>You are a wizard.<</SYS>> What are the magic words? [/INST] ",
+		},
+		{
+			name:     "Response in Condition",
+			template: "<|user|>{{ .Prompt }}{{ if .Response }}<|assistant|>{{ .Response }}<|end|>{{ end }}",
+			want:     "<|user|>What are the magic words?<|assistant|>",
+		},
+		{
+			name:     "No Response",
+			template: "<|user|>{{ .Prompt }}<|assistant|>",
+			response: "abra",
+			want:     "<|user|>What are the magic words?<|assistant|>abra",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PartialPrompt(tt.template, "You are a wizard.", "What are the magic words?", tt.response)
+			if err != nil {
+				t.Fatalf("PartialPrompt() error = %v", err)
+			}
+
+			if got != tt.want {
+				t.Errorf("PartialPrompt() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPromptTokenStream(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		response string
+		cut      bool
+	}{
+		{name: "Full", template: "[INST] {{ if .System }}<<SYS>>{{ .System }}<</SYS>> {{ end }}{{ .Prompt }} [/INST] {{ .Response }}</s>", response: "abracadabra"},
+		{name: "Cut", template: "[INST] {{ if .System }}<<SYS>>{{ .System }}<</SYS>> {{ end }}{{ .Prompt }} [/INST] {{ .Response }}</s>", cut: true},
+		{name: "No Response", template: "<|user|>{{ .Prompt }}<|assistant|>", response: "abracadabra"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var chunks int
+			// each byte is a token, so the tokens of the chunks are the tokens of the whole prompt
+			tokenize := func(chunk string) ([]int, error) {
+				chunks++
+
+				var tokens []int
+				for _, b := range []byte(chunk) {
+					tokens = append(tokens, int(b))
+				}
+
+				return tokens, nil
+			}
+
+			got, err := PromptTokenStream(tt.template, "You are a wizard.", "What are the magic words?", tt.response, tt.cut, tokenize)
+			if err != nil {
+				t.Fatalf("PromptTokenStream() error = %v", err)
+			}
+
+			want, err := renderPrompt(tt.template, PromptVars{System: "You are a wizard.", Prompt: "What are the magic words?", Response: tt.response, First: true}, tt.cut)
+			if err != nil {
+				t.Fatalf("renderPrompt() error = %v", err)
+			}
+
+			var rendered []byte
+			for _, token := range got {
+				rendered = append(rendered, byte(token))
+			}
+
+			if string(rendered) != want {
+				t.Errorf("PromptTokenStream() got = %q, want %q", rendered, want)
+			}
+
+			if chunks < 2 {
+				t.Errorf("PromptTokenStream() tokenized %d chunks, want the prompt in chunks", chunks)
+			}
+		})
+	}
+
+	if _, err := PromptTokenStream("{{ .Prompt }}", "", "Hello", "", false, NewMockEncoder(WithErrorOnCall(1))); !errors.Is(err, errMockEncode) {
+		t.Errorf("PromptTokenStream() error = %v, want %v", err, errMockEncode)
+	}
+}
+
+func TestRateLimitedEncoder(t *testing.T) {
+	m := &Model{Template: "[INST] {{ .Prompt }} [/INST] {{ .Response }}"}
+	chat := &ChatHistory{
+		Prompts: []PromptVars{
+			{Prompt: "What are the magic words?", Response: "abracadabra", First: true},
+			{Prompt: "Do you have a magic hat?", Response: "Of course."},
+			{Prompt: "Can you make me invisible?", Response: "Yes."},
+			{Prompt: "What is the spell for invisibility?"},
+		},
+	}
+
+	var calls []string
+	encode := NewMockEncoder(WithCallRecorder(&calls))
+
+	const rps = 50
+
+	start := time.Now()
+	result, err := trimmedPrompt(context.Background(), chat, m, 512, RateLimitedEncoder(encode, rps), ChatPromptOptions{})
+	if err != nil {
+		t.Fatalf("ChatPrompt() error = %v", err)
+	}
+
+	// the first call is allowed straight away, each call after it waits for the limiter
+	if elapsed, want := time.Since(start), time.Duration(len(calls)-1)*time.Second/rps; elapsed < want*9/10 {
+		t.Errorf("ChatPrompt() took %v for %d calls, want at least %v", elapsed, len(calls), want)
+	}
+
+	want, err := trimmedPrompt(context.Background(), chat, m, 512, NewMockEncoder(), ChatPromptOptions{})
+	if err != nil {
+		t.Fatalf("ChatPrompt() error = %v", err)
+	}
+
+	if result.Prompt != want.Prompt || result.Tokens != want.Tokens {
+		t.Errorf("ChatPrompt() with a rate limited encoder got = %q, %d tokens, want %q, %d tokens", result.Prompt, result.Tokens, want.Prompt, want.Tokens)
+	}
+}
+
+func TestTemplateVariables(t *testing.T) {
+	got, err := TemplateVariables("{{ if .First }}<s>{{ end }}[INST] {{ .Instruct }} {{ with .System }}{{ .Ignored }}{{ end }} {{ .Prompt }} [/INST] {{ .Instruct }}")
+	if err != nil {
+		t.Fatalf("TemplateVariables() error = %v", err)
+	}
+
+	if want := []string{"First", "Instruct", "Prompt", "System"}; !slices.Equal(got, want) {
+		t.Errorf("TemplateVariables() got = %v, want %v", got, want)
+	}
+
+	if _, err := TemplateVariables("{{ .Prompt "); err == nil {
+		t.Errorf("TemplateVariables() expected an error for an invalid template")
+	}
+}
+
+func TestPromptTokenCount(t *testing.T) {
+	template := "[INST] {{ .Prompt }} [/INST] {{ .Response }}</s>"
+	vars := PromptVars{Prompt: "What are the potion ingredients?"}
+
+	var calls []string
+	encode := NewMockEncoder(WithCallRecorder(&calls))
+
+	rendered, count, err := PromptTokenCount(template, vars, true, encode)
+	if err != nil {
+		t.Fatalf("PromptTokenCount() error = %v", err)
+	}
+
+	if want := "[INST] What are the potion ingredients? [/INST] "; rendered != want {
+		t.Errorf("PromptTokenCount() rendered = %v, want %v", rendered, want)
+	}
+
+	if count != 7 {
+		t.Errorf("PromptTokenCount() count = %d, want %d", count, 7)
+	}
+
+	if len(calls) != 1 {
+		t.Errorf("PromptTokenCount() encoded %d times, want once", len(calls))
+	}
+
+	failure := errors.New("failed to encode")
+	if _, _, err := PromptTokenCount(template, vars, true, func(string) ([]int, error) { return nil, failure }); !errors.Is(err, failure) {
+		t.Errorf("PromptTokenCount() error = %v, want %v", err, failure)
+	}
+}
+
+func TestTokenCostForImage(t *testing.T) {
+	tests := []struct {
+		name   string
+		width  int
+		height int
+		model  string
+		want   int
+	}{
+		{"Unknown Size", 0, 0, "llava:13b-v1.6", 768},
+		{"Unknown Model", 336, 336, "bakery", 768},
+		{"LLaVA 1.5", 1344, 1344, "llava:13b-v1.5", 576},
+		{"LLaVA 1.6 Small", 224, 224, "llava:13b-v1.6", 1152},
+		{"LLaVA 1.6 Wide", 1008, 336, "llava:34b-v1.6", 2304},
+		{"LLaVA 1.6 Large", 1344, 1344, "llava:7b-v1.6", 2880},
+		{"Moondream", 1344, 1344, "moondream", 729},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := TokenCostForImage(tt.width, tt.height, tt.model); got != tt.want {
+				t.Errorf("TokenCostForImage() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPromptHash(t *testing.T) {
+	rendered := "[INST] What are the magic words? [/INST]abracadabra"
+
+	if PromptHash(rendered) != sha256.Sum256([]byte(rendered)) {
+		t.Errorf("PromptHash() is not the sha256 digest of the prompt")
+	}
+
+	if PromptPrefixHash(rendered, 6) != PromptHash("[INST]") {
+		t.Errorf("PromptPrefixHash() does not match the hash of the prefix")
+	}
+
+	if PromptPrefixHash(rendered, len(rendered)+10) != PromptHash(rendered) || PromptPrefixHash(rendered, -1) != PromptHash("") {
+		t.Errorf("PromptPrefixHash() offset is not limited to the prompt")
+	}
+
+	encode := NewMockEncoder()
+
+	template := "[INST] {{ .Prompt }} [/INST]"
+	got, err := PromptHashForMessages(template, []api.Message{
+		{Role: "user", Content: "What are the magic words?"},
+		{Role: "assistant", Content: "abracadabra"},
+		{Role: "user", Content: "Do you have a magic hat?"},
+	}, encode)
+	if err != nil {
+		t.Fatalf("PromptHashForMessages() error = %v", err)
+	}
+
+	if want := PromptHash(rendered + "[INST] Do you have a magic hat? [/INST]"); got != want {
+		t.Errorf("PromptHashForMessages() got = %x, want %x", got, want)
+	}
+
+	if _, err := PromptHashForMessages(template, []api.Message{{Role: "invalid"}}, encode); err == nil {
+		t.Errorf("PromptHashForMessages() expected an error for an invalid role")
+	}
+}
+
+func TestMessageContentHash(t *testing.T) {
+	msg := api.Message{Role: "user", Content: "What is in these images?", Images: []api.ImageData{api.ImageData("cat"), api.ImageData("dog")}}
+
+	got, err := MessageContentHash(msg)
+	if err != nil {
+		t.Fatalf("MessageContentHash() error = %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		msg   api.Message
+		equal bool
+	}{
+		{name: "Same Message", msg: msg, equal: true},
+		{name: "Images Reordered", msg: api.Message{Role: "user", Content: msg.Content, Images: []api.ImageData{api.ImageData("dog"), api.ImageData("cat")}}, equal: true},
+		{name: "Other Role", msg: api.Message{Role: "assistant", Content: msg.Content, Images: msg.Images}},
+		{name: "Other Content", msg: api.Message{Role: "user", Content: "What is in this image?", Images: msg.Images}},
+		{name: "Other Images", msg: api.Message{Role: "user", Content: msg.Content, Images: []api.ImageData{api.ImageData("cat")}}},
+		{name: "Role In Content", msg: api.Message{Role: "use", Content: "r\x00" + msg.Content, Images: msg.Images}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			digest, err := MessageContentHash(tt.msg)
+			if err != nil {
+				t.Fatalf("MessageContentHash() error = %v", err)
+			}
+
+			if (digest == got) != tt.equal {
+				t.Errorf("MessageContentHash() equal = %v, want %v", digest == got, tt.equal)
+			}
+		})
+	}
+
+	if _, err := MessageContentHash(api.Message{Content: "Hello"}); !errors.Is(err, ErrInvalidRole) {
+		t.Errorf("MessageContentHash() error = %v, want %v", err, ErrInvalidRole)
+	}
+
+	msgs := []api.Message{
+		{Role: "user", Content: "What are the magic words?"},
+		{Role: "assistant", Content: "abracadabra"},
+	}
+
+	first, err := MessagesHash(msgs)
+	if err != nil {
+		t.Fatalf("MessagesHash() error = %v", err)
+	}
+
+	second, err := MessagesHash([]api.Message{msgs[1], msgs[0]})
+	if err != nil {
+		t.Fatalf("MessagesHash() error = %v", err)
+	}
+
+	if first == second {
+		t.Errorf("MessagesHash() is the same for messages in another order")
+	}
+}
+
+func TestNewPromptFromMessages(t *testing.T) {
+	msgs := []api.Message{
+		{Role: "system", Content: "You are a wizard."},
+		{Role: "user", Content: "What are the magic words?"},
+		{Role: "assistant", Content: "abracadabra"},
+	}
+
+	tests := []struct {
+		name       string
+		formatters map[string]string
+		want       string
+		wantErr    error
+	}{
+		{
+			name: "Default Formats",
+			want: "You are a wizard.\n\nUser: What are the magic words?\nAssistant: abracadabra\n",
+		},
+		{
+			name:       "Custom Formats",
+			formatters: map[string]string{"system": "### System:\n%s\n", "user": "### User:\n%s\n", "assistant": "### Assistant:\n%s\n"},
+			want:       "### System:\nYou are a wizard.\n### User:\nWhat are the magic words?\n### Assistant:\nabracadabra\n",
+		},
+		{
+			name:       "Missing Format",
+			formatters: map[string]string{"user": "Q: %s\n"},
+			wantErr:    ErrInvalidRole,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewPromptFromMessages(msgs, tt.formatters)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("NewPromptFromMessages() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("NewPromptFromMessages() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatPromptTokens(t *testing.T) {
+	// each word is a token, numbered by its position in the text
+	encode := NewMockEncoder()
+
+	rendered, tokens, err := ChatPromptTokens("[INST] {{ .System }} {{ .Prompt }} [/INST]", "You are a wizard.", []api.Message{
+		{Role: "user", Content: "What are the magic words?"},
+		{Role: "assistant", Content: "abracadabra"},
+		{Role: "user", Content: "Do you have a magic hat?"},
+	}, 15, encode)
+	if err != nil {
+		t.Fatalf("ChatPromptTokens() error = %v", err)
+	}
+
+	want := "[INST] You are a wizard. Do you have a magic hat? [/INST]"
+	if rendered != want {
+		t.Errorf("ChatPromptTokens() got = %q, want %q", rendered, want)
+	}
+
+	if len(tokens) != 12 || tokens[len(tokens)-1] != 11 {
+		t.Errorf("ChatPromptTokens() got tokens = %v, want the tokens of the whole prompt", tokens)
+	}
+
+	if _, _, err := ChatPromptTokens("{{ .Prompt }}", "", []api.Message{{Role: "invalid"}}, 15, encode); err == nil {
+		t.Errorf("ChatPromptTokens() expected an error for an invalid role")
+	}
+}
+
+func TestPromptReplay(t *testing.T) {
+	messages := []api.Message{
+		{Role: "user", Content: "What are the magic words?"},
+		{Role: "assistant", Content: "abracadabra"},
+		{Role: "user", Content: "Do you have a magic hat?"},
+		{Role: "assistant", Content: "Of course."},
+		{Role: "user", Content: "What is the spell for invisibility?"},
+	}
+
+	tmpl := "[INST] {{ if .System }}{{ .System }} {{ end }}{{ .Prompt }} [/INST] {{ .Response }}</s>"
+
+	got, err := PromptReplay(tmpl, "You are a wizard.", messages, 512, NewMockEncoder())
+	if err != nil {
+		t.Fatalf("PromptReplay() error = %v", err)
+	}
+
+	want := []string{
+		"[INST] You are a wizard. What are the magic words? [/INST] ",
+		"[INST] You are a wizard. What are the magic words? [/INST] abracadabra</s>[INST] Do you have a magic hat? [/INST] ",
+	}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("PromptReplay() got = %q, want %q", got, want)
+	}
+
+	// each prompt is truncated to the window on its own
+	got, err = PromptReplay(tmpl, "", messages, 8, NewMockEncoder())
+	if err != nil {
+		t.Fatalf("PromptReplay() error = %v", err)
+	}
+
+	want = []string{
+		"[INST] What are the magic words? [/INST] ",
+		"[INST] Do you have a magic hat? [/INST] ",
+	}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("PromptReplay() got = %q, want %q", got, want)
+	}
+
+	if _, err := PromptReplay(tmpl, "", []api.Message{{Role: "invalid"}, {Role: "assistant"}}, 512, NewMockEncoder()); !errors.Is(err, ErrInvalidRole) {
+		t.Errorf("PromptReplay() error = %v, want %v", err, ErrInvalidRole)
+	}
+}
+
+func TestCheckContextFit(t *testing.T) {
+	messages := []api.Message{
+		{Role: "system", Content: "You are a wizard."},
+		{Role: "user", Content: "What are the magic words?"},
+	}
+
+	tests := []struct {
+		name          string
+		window        int
+		charsPerToken float64
+		want          bool
+	}{
+		{name: "Fits", window: 11, charsPerToken: 4, want: true},
+		{name: "Overflows", window: 10, charsPerToken: 4},
+		{name: "Fewer Characters Per Token", window: 11, charsPerToken: 2},
+		{name: "Default Characters Per Token", window: 11, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CheckContextFit(messages, tt.window, tt.charsPerToken); got != tt.want {
+				t.Errorf("CheckContextFit() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatPromptDryRun(t *testing.T) {
+	encode := NewMockEncoder()
+
+	msgs := []api.Message{
+		{Role: "user", Content: "What are the magic words?"},
+		{Role: "assistant", Content: "abracadabra"},
+		{Role: "user", Content: "Do you have a magic hat?"},
+	}
+
+	tests := []struct {
+		name         string
+		window       int
+		wantTokens   int
+		wantTruncate bool
+	}{
+		{"Fits", 64, 19, false},
+		{"Truncated", 15, 12, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, truncate, err := ChatPromptDryRun("[INST] {{ .System }} {{ .Prompt }} [/INST]", "You are a wizard.", msgs, tt.window, encode)
+			if err != nil {
+				t.Fatalf("ChatPromptDryRun() error = %v", err)
+			}
+
+			if tokens != tt.wantTokens || truncate != tt.wantTruncate {
+				t.Errorf("ChatPromptDryRun() got = %d, %t, want %d, %t", tokens, truncate, tt.wantTokens, tt.wantTruncate)
+			}
+		})
+	}
+}
+
+// turnWriter records each write as a separate turn
+type turnWriter struct {
+	turns []string
+}
+
+func (w *turnWriter) Write(p []byte) (int, error) {
+	w.turns = append(w.turns, string(p))
+	return len(p), nil
+}
+
+func TestStreamChatPrompt(t *testing.T) {
+	var w turnWriter
+	err := StreamChatPrompt(&w, "[INST] {{ .System }} {{ .Prompt }} [/INST]", "You are a wizard.", []api.Message{
+		{Role: "user", Content: "What are the magic words?"},
+		{Role: "assistant", Content: "abracadabra"},
+		{Role: "user", Content: "Do you have a magic hat?"},
+	}, 2048, NewMockEncoder())
+	if err != nil {
+		t.Fatalf("StreamChatPrompt() error = %v", err)
+	}
+
+	want := []string{
+		"[INST] You are a wizard. What are the magic words? [/INST]abracadabra",
+		"[INST]  Do you have a magic hat? [/INST]",
+	}
+
+	if !slices.Equal(w.turns, want) {
+		t.Errorf("StreamChatPrompt() got = %q, want %q", w.turns, want)
+	}
+
+	if err := StreamChatPrompt(&w, "{{ .Prompt }}", "", []api.Message{{Role: "invalid"}}, 2048, nil); err == nil {
+		t.Errorf("StreamChatPrompt() expected an error for an invalid role")
+	}
+}
+
+func TestPromptDiff(t *testing.T) {
+	tests := []struct {
+		name       string
+		previous   string
+		current    string
+		wantPrefix string
+		wantSuffix string
+	}{
+		{
+			name:       "New Turn",
+			previous:   "[INST] Hello [/INST] Hi there!</s>",
+			current:    "[INST] Hello [/INST] Hi there!</s>[INST] How are you? [/INST]",
+			wantPrefix: "[INST] Hello [/INST] Hi there!</s>",
+			wantSuffix: "[INST] How are you? [/INST]",
+		},
+		{
+			name:       "Changed History",
+			previous:   "[INST] Hello [/INST]",
+			current:    "[INST] Howdy [/INST]",
+			wantPrefix: "[INST] H",
+			wantSuffix: "owdy [/INST]",
+		},
+		{
+			name:       "No Previous Prompt",
+			current:    "[INST] Hello [/INST]",
+			wantSuffix: "[INST] Hello [/INST]",
+		},
+		{
+			name:       "Identical",
+			previous:   "[INST] Hello [/INST]",
+			current:    "[INST] Hello [/INST]",
+			wantPrefix: "[INST] Hello [/INST]",
+		},
+		{
+			name:       "Partial Character",
+			previous:   "こんにちは",
+			current:    "こんばんは",
+			wantPrefix: "こん",
+			wantSuffix: "ばんは",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefix, suffix := PromptDiff(tt.previous, tt.current)
+			if prefix != tt.wantPrefix || suffix != tt.wantSuffix {
+				t.Errorf("PromptDiff() = %q, %q, want %q, %q", prefix, suffix, tt.wantPrefix, tt.wantSuffix)
+			}
+		})
+	}
+}
+
+// tokenCountLLM estimates 4 characters per token when encoding
+type tokenCountLLM struct {
+	MockLLM
+}
+
+func (llm *tokenCountLLM) Encode(ctx context.Context, prompt string) ([]int, error) {
+	return make([]int, len(prompt)/4), nil
+}
+
+func benchmarkChatPrompt(b *testing.B, turns int, images bool) {
+	m := &Model{
+		Name:     "llama2",
+		Template: "[INST] {{ if .System }}<<SYS>>{{ .System }}<</SYS>>\n\n{{ end }}{{ .Prompt }} [/INST] {{ .Response }}</s><s>",
+		System:   "You are a helpful assistant.",
+	}
+
+	if images {
+		m.ProjectorPaths = []string{"projector"}
+	}
+
+	// roughly 200 tokens per message
+	content := strings.Repeat("The quick brown fox jumps over the lazy dog. ", 18)
+
+	var msgs []api.Message
+	for i := 0; i < turns; i++ {
+		msg := api.Message{Role: "user", Content: fmt.Sprintf("%d: %s", i, content)}
+		if images {
+			msg.Images = []api.ImageData{[]byte("image")}
+		}
+
+		msgs = append(msgs, msg, api.Message{Role: "assistant", Content: content})
+	}
+	msgs = append(msgs, api.Message{Role: "user", Content: content})
+
+	runner := &tokenCountLLM{}
+	encode := func(s string) ([]int, error) {
+		return runner.Encode(context.Background(), s)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		chat, err := m.ChatPrompts(msgs, m.System)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if _, err := trimmedPrompt(context.Background(), chat, m, 2048, encode, ChatPromptOptions{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkChatPrompt_10Turns(b *testing.B) {
+	benchmarkChatPrompt(b, 10, false)
+}
+
+func BenchmarkChatPrompt_50Turns(b *testing.B) {
+	benchmarkChatPrompt(b, 50, false)
+}
+
+func BenchmarkChatPrompt_50TurnsWithImages(b *testing.B) {
+	benchmarkChatPrompt(b, 50, true)
+}
+
+func TestStructuredOutput(t *testing.T) {
+	schema := json.RawMessage(`{
+		"type": "object",
+		"properties": {"name": {"type": "string"}}
+	}`)
+
+	instruction := FormatStructuredOutputInstruction(schema)
+	if want := `Respond only with valid JSON matching this schema: {"type":"object","properties":{"name":{"type":"string"}}}`; instruction != want {
+		t.Errorf("FormatStructuredOutputInstruction() = %v, want %v", instruction, want)
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		system   string
+		want     string
+	}{
+		{
+			name:   "With System",
+			system: "You are a Wizard.",
+			want:   "[INST] You are a Wizard.\n\n" + instruction + " Name a potion. [/INST]",
+		},
+		{
+			name: "Without System",
+			want: "[INST] " + instruction + " Name a potion. [/INST]",
+		},
+		{
+			name:     "Template Without System",
+			template: "[INST] {{ .Prompt }} [/INST]",
+			system:   "You are a Wizard.",
+			want:     "[INST] " + instruction + "\n\nName a potion. [/INST]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			template := tt.template
+			if template == "" {
+				template = "[INST] {{ .System }} {{ .Prompt }} [/INST]"
+			}
+
+			got, err := Prompt(template, PromptVars{
+				System:           tt.system,
+				Prompt:           "Name a potion.",
+				StructuredOutput: &schema,
+			})
+			if err != nil {
+				t.Fatalf("Prompt() error = %v", err)
+			}
+
+			if got != tt.want {
+				t.Errorf("Prompt() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTemplateHook(t *testing.T) {
+	errHook := errors.New("no user")
+
+	tests := []struct {
+		name    string
+		hook    func(map[string]any) error
+		want    string
+		wantErr error
+	}{
+		{
+			name: "Add Variables",
+			hook: func(vars map[string]any) error {
+				vars["DateTime"] = "2024-01-02T15:04:05Z"
+				vars["System"] = "You are a wizard."
+				return nil
+			},
+			want: "[INST] You are a wizard. It is 2024-01-02T15:04:05Z. What are the magic words? [/INST]",
+		},
+		{
+			name: "Remove Variables",
+			hook: func(vars map[string]any) error {
+				delete(vars, "System")
+				return nil
+			},
+			want: "[INST] <no value> It is <no value>. What are the magic words? [/INST]",
+		},
+		{
+			name:    "Error",
+			hook:    func(map[string]any) error { return errHook },
+			wantErr: errHook,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Prompt("[INST] {{ .System }} It is {{ .DateTime }}. {{ .Prompt }} [/INST]", PromptVars{
+				System:       "You are a cat.",
+				Prompt:       "What are the magic words?",
+				TemplateHook: tt.hook,
+			})
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Prompt() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Prompt() error = %v", err)
+			}
+
+			if got != tt.want {
+				t.Errorf("Prompt() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLintPromptTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		want     []string
+	}{
+		{
+			name:     "No Warnings",
+			template: "[INST] {{ if .System }}<<SYS>>{{ .System }}<</SYS>>{{ end }} {{ .Prompt }} [/INST] {{ .Response }}",
+		},
+		{
+			name:     "Response in Each Branch",
+			template: "{{ if .System }}{{ .System }} {{ .Prompt }} {{ .Response }}{{ else }}{{ .Prompt }} {{ .Response }}{{ end }}",
+		},
+		{
+			name:     "Response Before Prompt",
+			template: "{{ .System }}\n{{ .Response }} {{ .Prompt }}",
+			want:     []string{"2:4: .Response is used before .Prompt"},
+		},
+		{
+			name:     "Multiple Responses",
+			template: "{{ .System }} {{ .Prompt }} {{ .Response }}\n{{ if .First }}{{ .Response }}{{ end }}",
+			want:     []string{"2:19: .Response is rendered more than once"},
+		},
+		{
+			name:     "Empty Actions",
+			template: "{{ .System }} {{ \"\" }}{{ .Prompt }}{{ if false }}never{{ end }}",
+			want: []string{
+				"1:18: action always renders an empty string",
+				"1:42: if condition is always false",
+			},
+		},
+		{
+			name:     "Without System",
+			template: "[INST] {{ .Prompt }} [/INST]",
+			want:     []string{"template does not use .System, system messages will be ignored"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, warning := range LintPromptTemplate(tt.template) {
+				got = append(got, warning.String())
+			}
+
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("LintPromptTemplate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCutAtStopSequence(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		stops []string
+		want  string
+	}{
+		{"No Stop Sequences", "abracadabra", nil, "abracadabra"},
+		{"Not Found", "abracadabra", []string{"[INST]"}, "abracadabra"},
+		{"Found", "abracadabra[INST] more", []string{"[INST]"}, "abracadabra"},
+		{"First of Many", "abra</s>cadabra[INST]", []string{"[INST]", "</s>"}, "abra"},
+		{"Empty Stop Sequence", "abracadabra", []string{""}, "abracadabra"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CutAtStopSequence(tt.text, tt.stops); got != tt.want {
+				t.Errorf("CutAtStopSequence() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenBudgetManager(t *testing.T) {
+	budget := NewTokenBudgetManager(10)
+
+	if !budget.Reserve(6) {
+		t.Fatalf("Reserve(6) = false, want true")
+	}
+
+	if budget.Reserve(5) {
+		t.Errorf("Reserve(5) = true, want false with %d remaining", budget.Remaining())
+	}
+
+	if budget.Reserve(-1) {
+		t.Errorf("Reserve(-1) = true, want false")
+	}
+
+	if got := budget.Remaining(); got != 4 {
+		t.Errorf("Remaining() = %d, want 4", got)
+	}
+
+	budget.Release(2)
+	if got := budget.Remaining(); got != 6 {
+		t.Errorf("Remaining() = %d, want 6", got)
+	}
+
+	// releasing more than is reserved frees the whole window
+	budget.Release(20)
+	if got := budget.Remaining(); got != 10 {
+		t.Errorf("Remaining() = %d, want 10", got)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if budget.Reserve(1) {
+				budget.Release(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := budget.Remaining(); got != 10 {
+		t.Errorf("Remaining() = %d, want 10", got)
+	}
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"regexp"
+	"strings"
+)
+
+const (
+	thinkingStart = "<think>"
+	thinkingEnd   = "</think>"
+)
+
+// thinkingBlock matches a <think>…</think> block along with the whitespace after it
+var thinkingBlock = regexp.MustCompile(`(?s)` + regexp.QuoteMeta(thinkingStart) + `.*?` + regexp.QuoteMeta(thinkingEnd) + `\s*`)
+
+// StripThinkingBlocks removes the <think>…</think> blocks of reasoning models from a response, so the reasoning of
+// earlier turns does not use up the context window when the response is part of the history
+func StripThinkingBlocks(rendered string) string {
+	if !strings.Contains(rendered, thinkingStart) {
+		return rendered
+	}
+
+	return thinkingBlock.ReplaceAllString(rendered, "")
+}
+
+// withoutThinking returns a copy of the chat history with the thinking blocks removed from its responses. An
+// incomplete response of the most recent prompt is kept as it is, since the model continues from it.
+func (h *ChatHistory) withoutThinking() *ChatHistory {
+	c := *h
+	c.Prompts = make([]PromptVars, len(h.Prompts))
+	for i, prompt := range h.Prompts {
+		if i < len(h.Prompts)-1 || !prompt.Incomplete {
+			prompt.Response = StripThinkingBlocks(prompt.Response)
+		}
+
+		c.Prompts[i] = prompt
+	}
+
+	return &c
+}
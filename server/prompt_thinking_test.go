@@ -0,0 +1,40 @@
+package server
+
+import "testing"
+
+func TestStripThinkingBlocks(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		want     string
+	}{
+		{
+			name:     "No Thinking",
+			response: "abracadabra",
+			want:     "abracadabra",
+		},
+		{
+			name:     "Thinking",
+			response: "<think>\nThe user wants a spell.\n</think>\n\nabracadabra",
+			want:     "abracadabra",
+		},
+		{
+			name:     "Several Blocks",
+			response: "<think>first</think>abra<think>second</think> cadabra",
+			want:     "abracadabra",
+		},
+		{
+			name:     "Unclosed Block",
+			response: "<think>The user wants",
+			want:     "<think>The user wants",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := StripThinkingBlocks(tt.response); got != tt.want {
+				t.Errorf("StripThinkingBlocks() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"crypto/sha256"
+	"sync"
+)
+
+// maxCachedTurns is the most turns a CachedChatHistory remembers, it is cleared when it holds more
+const maxCachedTurns = 4096
+
+// CachedChatHistory remembers the number of tokens of each turn of a conversation, so when the conversation gains a
+// turn at a time only the turns which changed are tokenized again. Turns are identified by a hash of their rendered
+// text, and the cache is cleared when the template changes. A cache should only be used with one model, since the
+// number of tokens depends on its tokenizer.
+type CachedChatHistory struct {
+	mu       sync.Mutex
+	template string
+	tokens   map[[32]byte]int
+
+	hits, misses int
+}
+
+// NewCachedChatHistory returns an empty cache of token counts
+func NewCachedChatHistory() *CachedChatHistory {
+	return &CachedChatHistory{tokens: make(map[[32]byte]int)}
+}
+
+// Stats returns the number of turns whose tokens were found in the cache and the number which were tokenized
+func (c *CachedChatHistory) Stats() (hits, misses int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+// use clears the cache if the turns are rendered with a different template than before
+func (c *CachedChatHistory) use(renderer PromptRenderer) {
+	if c == nil {
+		return
+	}
+
+	var template string
+	if r, ok := renderer.(goTemplateRenderer); ok {
+		template = r.template
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if template != c.template {
+		clear(c.tokens)
+		c.template = template
+	}
+}
+
+// lookup returns the number of tokens of a rendered turn, if it is cached
+func (c *CachedChatHistory) lookup(text string) (int, bool) {
+	if c == nil {
+		return 0, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	tokens, ok := c.tokens[sha256.Sum256([]byte(text))]
+	if ok {
+		c.hits++
+	} else {
+		c.misses++
+	}
+
+	return tokens, ok
+}
+
+// store caches the number of tokens of a rendered turn
+func (c *CachedChatHistory) store(text string, tokens int) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.tokens) >= maxCachedTurns {
+		clear(c.tokens)
+	}
+
+	c.tokens[sha256.Sum256([]byte(text))] = tokens
+}
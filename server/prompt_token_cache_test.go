@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestCachedChatHistory(t *testing.T) {
+	m := &Model{Template: "[INST] {{ .Prompt }} [/INST] {{ .Response }}</s>"}
+
+	var encoded []string
+	encode := NewMockEncoder(WithCallRecorder(&encoded))
+
+	cache := NewCachedChatHistory()
+	opts := ChatPromptOptions{TokenCache: cache}
+
+	var msgs []api.Message
+	build := func() ChatPromptResult {
+		t.Helper()
+
+		chat, err := m.ChatPrompts(msgs, "")
+		if err != nil {
+			t.Fatalf("ChatPrompts() error = %v", err)
+		}
+
+		encoded = nil
+		result, err := trimmedPrompt(context.Background(), chat, m, 512, encode, opts)
+		if err != nil {
+			t.Fatalf("ChatPrompt() error = %v", err)
+		}
+
+		return result
+	}
+
+	for i := 0; i < 10; i++ {
+		msgs = append(msgs, api.Message{Role: "user", Content: fmt.Sprintf("Say the magic words %d times", i)})
+		want := build()
+
+		// the turns before the most recent two are the same as in the last prompt
+		if i > 1 && len(encoded) != 2 {
+			t.Errorf("prompt %d encoded %d turns, want 2", i, len(encoded))
+		}
+
+		opts.TokenCache = nil
+		if got := build(); got.Tokens != want.Tokens {
+			t.Errorf("prompt %d has %d tokens, want %d without the cache", i, want.Tokens, got.Tokens)
+		}
+		opts.TokenCache = cache
+
+		msgs = append(msgs, api.Message{Role: "assistant", Content: "abracadabra"})
+	}
+
+	if hits, misses := cache.Stats(); hits != 36 || misses != 19 {
+		t.Errorf("Stats() = %d hits, %d misses, want 36 hits, 19 misses", hits, misses)
+	}
+
+	// the cache is cleared when the template changes
+	m = &Model{Template: "<|user|>{{ .Prompt }}<|assistant|>{{ .Response }}<|end|>"}
+	msgs = msgs[:4]
+	build()
+	if len(encoded) != 2 {
+		t.Errorf("encoded %d turns after the template changed, want 2", len(encoded))
+	}
+
+	if len(cache.tokens) != 2 {
+		t.Errorf("cache holds %d turns, want 2", len(cache.tokens))
+	}
+}
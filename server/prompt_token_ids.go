@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// responseTokensMarker is rendered in place of a response with token ids, so the text around the response can be
+// encoded without it
+const responseTokensMarker = "\x00response-tokens\x00"
+
+// responseTokens are the token ids of a response along with the response they are the tokens of
+type responseTokens struct {
+	ids      []int
+	response string
+}
+
+// responseTokenIDs returns the token ids given for the response of the prompt. They are only returned while the
+// response is the one they were given with, since the response may be changed before it is rendered, such as
+// when it is cut at a stop sequence.
+func (p PromptVars) responseTokenIDs() ([]int, bool) {
+	if p.responseTokens == nil || p.Response == "" || p.Response != p.responseTokens.response {
+		return nil, false
+	}
+
+	return p.responseTokens.ids, true
+}
+
+// decodedResponses returns a copy of the chat history with each response which has token ids replaced by the
+// decoded token ids, so the rendered prompt matches the tokens which are counted. Without decode the token ids
+// are dropped and the responses are encoded, since the token ids can't be checked against them.
+func (h *ChatHistory) decodedResponses(decode func([]int) (string, error)) (*ChatHistory, error) {
+	c := *h
+	c.Prompts = make([]PromptVars, len(h.Prompts))
+	for i, prompt := range h.Prompts {
+		if prompt.responseTokens != nil && decode == nil {
+			prompt.responseTokens = nil
+		} else if prompt.responseTokens != nil {
+			response, err := decode(prompt.responseTokens.ids)
+			if err != nil {
+				return nil, fmt.Errorf("%w: decode response tokens: %w", ErrTokenization, err)
+			}
+
+			prompt.Response = response
+			prompt.responseTokens = &responseTokens{ids: prompt.responseTokens.ids, response: response}
+		}
+
+		c.Prompts[i] = prompt
+	}
+
+	return &c, nil
+}
+
+// countTurnTokens counts the tokens of the rendered text of a prompt. The response is counted by its token ids
+// when it has them, only the text around it is encoded.
+func countTurnTokens(ctx context.Context, encode func(string) ([]int, error), cache *SystemPromptCache, renderer PromptRenderer, vars PromptVars, text string, isMostRecent bool) (int, error) {
+	ids, ok := vars.responseTokenIDs()
+	if !ok {
+		return countPromptTokens(encode, cache, renderer, vars, text)
+	}
+
+	marked := vars
+	marked.Response = responseTokensMarker
+	markedText, err := promptString(ctx, renderer, marked, isMostRecent)
+	if err != nil {
+		return 0, err
+	}
+
+	parts := strings.Split(markedText, responseTokensMarker)
+	if len(parts) == 1 {
+		// the response is not rendered, such as when the template is cut before it
+		return countPromptTokens(encode, cache, renderer, vars, text)
+	}
+
+	tokens := len(ids) * (len(parts) - 1)
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+
+		var n int
+		if i == 0 {
+			n, err = countPromptTokens(encode, cache, renderer, vars, part)
+		} else {
+			n, err = countTokens(encode, part)
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		tokens += n
+	}
+
+	return tokens, nil
+}
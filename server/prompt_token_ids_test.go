@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+func TestChatPromptTokenIDs(t *testing.T) {
+	m := &Model{Template: "[INST] {{ .Prompt }} [/INST] {{ .Response }}</s>"}
+	msgs := []api.Message{
+		{Role: "user", Content: "What are the magic words?"},
+		{Role: "assistant", Content: "abracadabra", TokenIDs: []int{1, 2, 3, 4, 5, 6, 7, 8}},
+		{Role: "user", Content: "Do you have a hat?"},
+	}
+
+	decode := func(response string) func([]int) (string, error) {
+		return func([]int) (string, error) { return response, nil }
+	}
+
+	tests := []struct {
+		name       string
+		opts       ChatPromptOptions
+		wantPrompt string
+		wantTokens int
+		// encoded is whether the response is encoded instead of counting its token ids
+		encoded bool
+	}{
+		{
+			name:       "Token IDs Counted",
+			opts:       ChatPromptOptions{DecodeTokenIDs: decode("abracadabra"), TokenizeMessages: true},
+			wantPrompt: "[INST] What are the magic words? [/INST] abracadabra</s>[INST] Do you have a hat? [/INST] ",
+			wantTokens: 7 + 8 + 1 + 7,
+		},
+		{
+			name:       "Decoded",
+			opts:       ChatPromptOptions{DecodeTokenIDs: decode("hocus pocus")},
+			wantPrompt: "[INST] What are the magic words? [/INST] hocus pocus</s>[INST] Do you have a hat? [/INST] ",
+			wantTokens: 7 + 8 + 1 + 7,
+		},
+		{
+			name:       "Changed Response Encoded",
+			opts:       ChatPromptOptions{DecodeTokenIDs: decode("abracadabra"), StopSequences: []string{"cad"}},
+			wantPrompt: "[INST] What are the magic words? [/INST] abra</s>[INST] Do you have a hat? [/INST] ",
+			wantTokens: 8 + 7,
+			encoded:    true,
+		},
+		{
+			name:       "Without Decoder Encoded",
+			opts:       ChatPromptOptions{},
+			wantPrompt: "[INST] What are the magic words? [/INST] abracadabra</s>[INST] Do you have a hat? [/INST] ",
+			wantTokens: 8 + 7,
+			encoded:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chat, err := m.ChatPrompts(msgs, "")
+			if err != nil {
+				t.Fatalf("ChatPrompts() error = %v", err)
+			}
+
+			var encoded []string
+			encode := NewMockEncoder(WithCallRecorder(&encoded))
+
+			result, err := trimmedPrompt(context.Background(), chat, m, 512, encode, tt.opts)
+			if err != nil {
+				t.Fatalf("ChatPrompt() error = %v", err)
+			}
+
+			if result.Prompt != tt.wantPrompt {
+				t.Errorf("ChatPrompt() got = %q, want %q", result.Prompt, tt.wantPrompt)
+			}
+
+			if result.Tokens != tt.wantTokens {
+				t.Errorf("ChatPrompt() got %d tokens, want %d", result.Tokens, tt.wantTokens)
+			}
+
+			if !tt.encoded {
+				for _, s := range encoded {
+					if strings.Contains(s, "abracadabra") || strings.Contains(s, "hocus") {
+						t.Errorf("ChatPrompt() encoded the response with token ids in %q", s)
+					}
+				}
+			}
+
+			if tt.opts.TokenizeMessages && len(result.Messages) != 3 {
+				t.Errorf("ChatPrompt() got %d messages, want 3", len(result.Messages))
+			}
+
+			for _, msg := range result.Messages {
+				if msg.Role == "assistant" && msg.Tokens != 8 {
+					t.Errorf("ChatPrompt() got %d tokens for the response, want 8", msg.Tokens)
+				}
+			}
+		})
+	}
+}
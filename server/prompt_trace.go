@@ -0,0 +1,17 @@
+//go:build !otelprompt
+
+package server
+
+import "context"
+
+// promptSpan is a tracing span around building a prompt. Spans are only recorded when built with the
+// otelprompt tag.
+type promptSpan struct{}
+
+func startPromptSpan(ctx context.Context, name string) (context.Context, promptSpan) {
+	return ctx, promptSpan{}
+}
+
+func (promptSpan) SetInt(key string, value int) {}
+
+func (promptSpan) End() {}
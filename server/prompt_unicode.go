@@ -0,0 +1,10 @@
+package server
+
+import "golang.org/x/text/unicode/norm"
+
+// NormalizePromptUnicode returns s in Unicode normalization form C. Text from some clients and from files on
+// macOS is decomposed, such as が as か followed by a combining mark, which tokenizers expecting composed text
+// encode as more tokens.
+func NormalizePromptUnicode(s string) string {
+	return norm.NFC.String(s)
+}
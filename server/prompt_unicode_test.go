@@ -0,0 +1,41 @@
+package server
+
+import (
+	"testing"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+func TestNormalizePromptUnicode(t *testing.T) {
+	nfc := "プログラミングが好きです"
+	nfd := norm.NFD.String(nfc)
+	if nfd == nfc {
+		t.Fatalf("NFD form of %q is the same as its NFC form", nfc)
+	}
+
+	if got := NormalizePromptUnicode(nfd); got != nfc {
+		t.Errorf("NormalizePromptUnicode() got = %q, want %q", got, nfc)
+	}
+
+	tmpl := "[INST] {{ .System }} {{ .Prompt }} [/INST] {{ .Response }}"
+	encode := NewMockEncoder(WithTokensPerChar(1))
+
+	count := func(system, prompt, response string) int {
+		t.Helper()
+		rendered, err := Prompt(tmpl, PromptVars{System: system, Prompt: prompt, Response: response})
+		if err != nil {
+			t.Fatalf("Prompt() error = %v", err)
+		}
+
+		tokens, err := encode(rendered)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return len(tokens)
+	}
+
+	if got, want := count(nfd, nfd, nfd), count(nfc, nfc, nfc); got != want {
+		t.Errorf("Prompt() got %d tokens for NFD text, want %d as for NFC text", got, want)
+	}
+}
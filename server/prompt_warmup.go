@@ -0,0 +1,91 @@
+package server
+
+import (
+	"strings"
+	"sync"
+)
+
+// warmUpPromptMarker stands in for the prompt when rendering the system-only prompt, the text before it is the
+// prefix shared by every first prompt with the same system message
+const warmUpPromptMarker = "\x00prompt\x00"
+
+// systemPromptKey identifies a system message rendered with a template
+type systemPromptKey struct {
+	system, template string
+}
+
+// systemPromptPrefix is the rendered text before the prompt of a system-only prompt, with its number of tokens
+type systemPromptPrefix struct {
+	text   string
+	tokens int
+}
+
+// SystemPromptCache holds the tokens of the system prompts warmed up with WarmUp, so prompts which start with the
+// same text only encode the rest of the prompt when their tokens are counted. A cache should only be used with one
+// model, since the number of tokens depends on its tokenizer.
+type SystemPromptCache struct {
+	mu       sync.Mutex
+	prefixes map[systemPromptKey]systemPromptPrefix
+}
+
+// NewSystemPromptCache returns an empty cache of system prompts
+func NewSystemPromptCache() *SystemPromptCache {
+	return &SystemPromptCache{prefixes: make(map[systemPromptKey]systemPromptPrefix)}
+}
+
+// WarmUp renders the system message with the template and tokenizes the text before the prompt with the encoder
+// of the model the cache is used with. If the template does not render the prompt after the system message
+// nothing is cached.
+func (c *SystemPromptCache) WarmUp(system string, tmpl string, encode func(string) ([]int, error)) error {
+	rendered, err := Prompt(tmpl, PromptVars{System: system, Prompt: warmUpPromptMarker, First: true})
+	if err != nil {
+		return err
+	}
+
+	text, _, found := strings.Cut(rendered, warmUpPromptMarker)
+	if !found || text == "" {
+		return nil
+	}
+
+	tokens, err := countTokens(encode, text)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.prefixes[systemPromptKey{system, tmpl}] = systemPromptPrefix{text: text, tokens: tokens}
+	return nil
+}
+
+// lookup returns the system prompt prefix of the system message rendered with the template, if it is cached
+func (c *SystemPromptCache) lookup(system, tmpl string) (systemPromptPrefix, bool) {
+	if c == nil {
+		return systemPromptPrefix{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prefix, ok := c.prefixes[systemPromptKey{system, tmpl}]
+	return prefix, ok
+}
+
+// countPromptTokens returns the number of tokens in a prompt rendered from vars by the renderer. When it is rendered
+// with a template the tokens of a system prompt prefix in the cache are reused, the remaining text is encoded on its
+// own so the count may differ slightly from encoding the whole prompt.
+func countPromptTokens(encode func(string) ([]int, error), cache *SystemPromptCache, renderer PromptRenderer, vars PromptVars, text string) (int, error) {
+	if r, ok := renderer.(goTemplateRenderer); ok && vars.System != "" {
+		if prefix, ok := cache.lookup(vars.System, r.template); ok {
+			if rest, ok := strings.CutPrefix(text, prefix.text); ok {
+				tokens, err := countTokens(encode, rest)
+				if err != nil {
+					return 0, err
+				}
+
+				return prefix.tokens + tokens, nil
+			}
+		}
+	}
+
+	return countTokens(encode, text)
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestSystemPromptCacheWarmUp(t *testing.T) {
+	tmpl := "[INST] <<SYS>>{{ .System }}<</SYS>> {{ .Prompt }} [/INST]"
+	system := "You are a wizard who answers every question with a spell."
+
+	var encoded []string
+	encode := NewMockEncoder(WithCallRecorder(&encoded))
+
+	cache := NewSystemPromptCache()
+	if err := cache.WarmUp(system, tmpl, encode); err != nil {
+		t.Fatalf("WarmUp() error = %v", err)
+	}
+
+	if len(encoded) != 1 || encoded[0] != "[INST] <<SYS>>"+system+"<</SYS>> " {
+		t.Fatalf("WarmUp() encoded %q, want the text before the prompt", encoded)
+	}
+
+	prompts := []promptInfo{
+		{vars: PromptVars{System: system, Prompt: "What are the magic words?", First: true}},
+		{vars: PromptVars{System: "You are a cat.", Prompt: "Meow?"}},
+	}
+
+	encoded = nil
+	if err := countTokensBatch(context.Background(), NewGoTemplateRenderer(tmpl), prompts, encode, nil, cache, 0, math.MaxInt); err != nil {
+		t.Fatalf("countTokensBatch() error = %v", err)
+	}
+
+	for i, want := range []int{18, 7} {
+		if got := prompts[i].tokenLen; got != want {
+			t.Errorf("prompt %d tokenLen = %d, want %d", i, got, want)
+		}
+	}
+
+	for _, s := range encoded {
+		if strings.Contains(s, system) {
+			t.Errorf("countTokensBatch() encoded the warmed up system prompt again: %q", s)
+		}
+	}
+
+	// another model with the same template counts the system prompt with its own tokenizer
+	prompts[0].tokenLen = 0
+	encoded = nil
+	if err := countTokensBatch(context.Background(), NewGoTemplateRenderer(tmpl), prompts[:1], encode, nil, NewSystemPromptCache(), 0, math.MaxInt); err != nil {
+		t.Fatalf("countTokensBatch() error = %v", err)
+	}
+
+	if len(encoded) != 1 || !strings.Contains(encoded[0], system) {
+		t.Errorf("countTokensBatch() used the system prompt warmed up for another model: %q", encoded)
+	}
+}
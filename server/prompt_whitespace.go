@@ -0,0 +1,46 @@
+package server
+
+import (
+	"context"
+	"regexp"
+	"strings"
+)
+
+// blankLines matches runs of three or more newlines
+var blankLines = regexp.MustCompile(`\n{3,}`)
+
+// NormalizePromptWhitespace removes the whitespace at the end of each line of a rendered prompt and collapses
+// runs of three or more newlines to two, such as the blank lines left by conditional blocks of a template
+func NormalizePromptWhitespace(rendered string) string {
+	lines := strings.Split(rendered, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r\f\v")
+	}
+
+	return blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+}
+
+// whitespaceRenderer normalizes the whitespace of the prompts rendered by another renderer, see
+// NormalizePromptWhitespace
+type whitespaceRenderer struct {
+	PromptRenderer
+}
+
+func (r whitespaceRenderer) Render(p PromptVars, cut bool) (string, error) {
+	rendered, err := r.PromptRenderer.Render(p, cut)
+	if err != nil {
+		return "", err
+	}
+
+	return NormalizePromptWhitespace(rendered), nil
+}
+
+// render applies the wrapped renderer with promptString, so templates can still be stopped early if ctx is done
+func (r whitespaceRenderer) render(ctx context.Context, vars PromptVars, isMostRecent bool) (string, error) {
+	rendered, err := promptString(ctx, r.PromptRenderer, vars, isMostRecent)
+	if err != nil {
+		return "", err
+	}
+
+	return NormalizePromptWhitespace(rendered), nil
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNormalizePromptWhitespace(t *testing.T) {
+	tests := []struct {
+		name     string
+		rendered string
+		want     string
+	}{
+		{
+			name:     "Blank Lines",
+			rendered: "<|system|>\n\n\n\nYou are a wizard.\n\n\n<|user|>\nWhat are the magic words?",
+			want:     "<|system|>\n\nYou are a wizard.\n\n<|user|>\nWhat are the magic words?",
+		},
+		{
+			name:     "Trailing Whitespace",
+			rendered: "<|user|>  \t\nWhat are the magic words? \r\n \n \n<|assistant|>\n",
+			want:     "<|user|>\nWhat are the magic words?\n\n<|assistant|>\n",
+		},
+		{
+			name:     "Unchanged",
+			rendered: "[INST]  What are the magic words? [/INST]\n\nabracadabra",
+			want:     "[INST]  What are the magic words? [/INST]\n\nabracadabra",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NormalizePromptWhitespace(tt.rendered); got != tt.want {
+				t.Errorf("NormalizePromptWhitespace() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatPromptNormalizeWhitespace(t *testing.T) {
+	m := &Model{Template: "{{ if .System }}<|system|>\n{{ .System }}\n\n\n{{ end }}<|user|>\n{{ .Prompt }}   \n<|assistant|>\n{{ .Response }}"}
+	chat := &ChatHistory{
+		Prompts: []PromptVars{
+			{System: "You are a wizard.", Prompt: "What are the magic words?", First: true},
+		},
+	}
+
+	for _, normalize := range []bool{false, true} {
+		result, err := trimmedPrompt(context.Background(), chat, m, 100, NewMockEncoder(), ChatPromptOptions{NormalizeWhitespace: normalize})
+		if err != nil {
+			t.Fatalf("ChatPrompt() error = %v", err)
+		}
+
+		want := "<|system|>\nYou are a wizard.\n\n\n<|user|>\nWhat are the magic words?   \n<|assistant|>\n"
+		if normalize {
+			want = "<|system|>\nYou are a wizard.\n\n<|user|>\nWhat are the magic words?\n<|assistant|>\n"
+		}
+
+		if result.Prompt != want {
+			t.Errorf("ChatPrompt() NormalizeWhitespace = %v, got = %q, want %q", normalize, result.Prompt, want)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// defaultDisplayWidth is the width prompts are wrapped to by WrapPromptForDisplay when no width is given
+const defaultDisplayWidth = 80
+
+// continuationMarker ends each line which WrapPromptForDisplay wrapped
+const continuationMarker = "↩"
+
+// WrapPromptForDisplay wraps the lines of a rendered prompt which are longer than width columns at word boundaries,
+// for printing it to a terminal. Each wrapped line ends with a ↩ marker, the newlines of the prompt are kept. Words
+// longer than a line are split. The width defaults to 80 columns, the result is only meant to be displayed.
+func WrapPromptForDisplay(rendered string, width int) string {
+	if width <= 0 {
+		width = defaultDisplayWidth
+	}
+
+	// a column is left for the continuation marker
+	limit := max(width-utf8.RuneCountInString(continuationMarker), 1)
+
+	lines := strings.Split(rendered, "\n")
+	for i, line := range lines {
+		lines[i] = wrapLine(line, limit)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// wrapLine wraps a single line to limit runes, with the continuation marker after each line but the last
+func wrapLine(line string, limit int) string {
+	if utf8.RuneCountInString(line) <= limit {
+		return line
+	}
+
+	var wrapped []string
+	var current []rune
+	// words are split on single spaces, so runs of spaces such as indentation are kept
+	for i, word := range strings.Split(line, " ") {
+		runes := []rune(word)
+		if i > 0 {
+			if len(current) > 0 && len(current)+1+len(runes) > limit {
+				// the space the line is wrapped at is dropped
+				wrapped = append(wrapped, string(current))
+				current = nil
+			} else {
+				current = append(current, ' ')
+			}
+		}
+
+		for len(current)+len(runes) > limit {
+			n := limit - len(current)
+			wrapped = append(wrapped, string(append(current, runes[:n]...)))
+			current, runes = nil, runes[n:]
+		}
+
+		current = append(current, runes...)
+	}
+
+	return strings.Join(append(wrapped, string(current)), continuationMarker+"\n")
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWrapPromptForDisplay(t *testing.T) {
+	tests := []struct {
+		name     string
+		rendered string
+		width    int
+		want     string
+	}{
+		{
+			name:     "Short Lines",
+			rendered: "[INST] What are the magic words? [/INST]\nabracadabra",
+			width:    80,
+			want:     "[INST] What are the magic words? [/INST]\nabracadabra",
+		},
+		{
+			name:     "Word Boundaries",
+			rendered: "[INST] What are the magic words? [/INST]\nabracadabra",
+			width:    16,
+			want:     "[INST] What are↩\nthe magic↩\nwords? [/INST]\nabracadabra",
+		},
+		{
+			name:     "Long Word",
+			rendered: "spell: abracadabra",
+			width:    8,
+			want:     "spell:↩\nabracad↩\nabra",
+		},
+		{
+			name:     "Indentation",
+			rendered: "    return spell in spells",
+			width:    12,
+			want:     "    return↩\nspell in↩\nspells",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := WrapPromptForDisplay(tt.rendered, tt.width); got != tt.want {
+				t.Errorf("WrapPromptForDisplay() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// lines are wrapped to 80 columns by default
+	for _, line := range strings.Split(WrapPromptForDisplay(strings.Repeat("abracadabra ", 20), 0), "\n") {
+		if n := len([]rune(line)); n > 80 {
+			t.Errorf("WrapPromptForDisplay() line has %d columns, want at most 80", n)
+		}
+	}
+}
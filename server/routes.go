@@ -59,6 +59,10 @@ var loaded struct {
 
 	*Model
 	*api.Options
+
+	// tokenCache and systemPrompts hold token counts for the runner, which depend on its tokenizer
+	tokenCache    *CachedChatHistory
+	systemPrompts *SystemPromptCache
 }
 
 var defaultSessionDuration = 5 * time.Minute
@@ -93,9 +97,30 @@ func load(c *gin.Context, model *Model, opts api.Options, sessionDuration time.D
 			return err
 		}
 
+		if err := ValidatePromptTemplate(model.Template); err != nil {
+			slog.Warn("invalid model template", "model", model.ShortName, "error", err)
+		}
+
+		// the warnings are about how the template was written, which only matters to whoever wrote it
+		for _, warning := range LintPromptTemplate(model.Template) {
+			slog.Debug("model template", "model", model.ShortName, "warning", warning.String())
+		}
+
 		loaded.Model = model
 		loaded.runner = llmRunner
 		loaded.Options = &opts
+
+		loaded.tokenCache = NewCachedChatHistory()
+		loaded.systemPrompts = NewSystemPromptCache()
+		if model.System != "" {
+			encode := func(s string) ([]int, error) {
+				return llmRunner.Encode(c.Request.Context(), s)
+			}
+
+			if err := loaded.systemPrompts.WarmUp(model.System, model.Template, encode); err != nil {
+				slog.Debug("system prompt warm up failed", "model", model.ShortName, "error", err)
+			}
+		}
 	}
 
 	loaded.expireAt = time.Now().Add(sessionDuration)
@@ -246,7 +271,7 @@ func GenerateHandler(c *gin.Context) {
 		}
 
 		for i := range req.Images {
-			promptVars.Prompt += fmt.Sprintf(" [img-%d]", i)
+			promptVars.Prompt += " " + model.imagePlaceholder(i)
 		}
 
 		p, err := model.PreResponsePrompt(promptVars)
@@ -281,6 +306,7 @@ func GenerateHandler(c *gin.Context) {
 				CreatedAt: time.Now().UTC(),
 				Done:      r.Done,
 				Response:  r.Content,
+				Logprobs:  r.Logprobs,
 				Metrics: api.Metrics{
 					PromptEvalCount:    r.PromptEvalCount,
 					PromptEvalDuration: r.PromptEvalDuration,
@@ -323,10 +349,12 @@ func GenerateHandler(c *gin.Context) {
 
 		// Start prediction
 		predictReq := llm.PredictOpts{
-			Prompt:  prompt,
-			Format:  req.Format,
-			Images:  images,
-			Options: opts,
+			Prompt:          prompt,
+			Format:          req.Format,
+			Images:          images,
+			Options:         opts,
+			RequestLogprobs: req.Logprobs,
+			TopLogprobs:     req.TopLogprobs,
 		}
 		if err := loaded.runner.Predict(c.Request.Context(), predictReq, fn); err != nil {
 			ch <- gin.H{"error": err.Error()}
@@ -337,10 +365,12 @@ func GenerateHandler(c *gin.Context) {
 		// Accumulate responses into the final response
 		var final api.GenerateResponse
 		var sb strings.Builder
+		var logprobs []api.TokenLogprob
 		for resp := range ch {
 			switch r := resp.(type) {
 			case api.GenerateResponse:
 				sb.WriteString(r.Response)
+				logprobs = append(logprobs, r.Logprobs...)
 				final = r
 			case gin.H:
 				if errorMsg, ok := r["error"].(string); ok {
@@ -357,6 +387,7 @@ func GenerateHandler(c *gin.Context) {
 		}
 
 		final.Response = sb.String()
+		final.Logprobs = logprobs
 		c.JSON(http.StatusOK, final)
 		return
 	}
@@ -1138,18 +1169,52 @@ func ChatHandler(c *gin.Context) {
 
 	checkpointLoaded := time.Now()
 
-	chat, err := model.ChatPrompts(req.Messages)
+	var imageHosts []string
+	if h := os.Getenv("OLLAMA_IMAGE_URL_HOSTS"); h != "" {
+		imageHosts = strings.Split(h, ",")
+	}
+
+	promptOpts := ChatPromptOptions{
+		// leave room for the response when the number of tokens to predict is limited
+		ResponseReservation: max(opts.NumPredict, 0),
+		StopSequences:       opts.Stop,
+		ImageURLHosts:       imageHosts,
+		TokenCache:          loaded.tokenCache,
+		SystemPromptCache:   loaded.systemPrompts,
+		// the token ids of assistant messages are rendered as they decode, so they match the tokens counted
+		DecodeTokenIDs: func(ids []int) (string, error) {
+			return loaded.runner.Decode(c.Request.Context(), ids)
+		},
+	}
+
+	chat, err := model.ChatPrompts(req.Messages, model.System)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	prompt, images, err := trimmedPrompt(c.Request.Context(), chat, model)
+	encode := func(s string) ([]int, error) {
+		return loaded.runner.Encode(c.Request.Context(), s)
+	}
+
+	result, err := trimmedPrompt(c.Request.Context(), chat, model, loaded.NumCtx, encode, promptOpts)
 	if err != nil {
+		// the messages of the request can't be built into a prompt, such as when pinned messages do not fit
+		if errors.Is(err, ErrContextWindowExhausted) || errors.Is(err, ErrTooManyImages) || errors.Is(err, ErrInvalidRole) ||
+			errors.Is(err, ErrEmptyPrompt) || errors.Is(err, ErrImageTooLarge) || errors.Is(err, ErrImageURLNotAllowed) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	if result.TruncatedPrompts > 0 || result.TruncatedImages > 0 {
+		slog.Info("chat history truncated to fit context window", "prompts", result.TruncatedPrompts, "images", result.TruncatedImages, "system", result.SystemPreserved)
+	}
+
+	prompt, images := result.Prompt, result.Images
+
 	// an empty request loads the model
 	if len(prompt) == 0 {
 		resp := api.ChatResponse{
@@ -1178,6 +1243,7 @@ func ChatHandler(c *gin.Context) {
 				Model:     req.Model,
 				CreatedAt: time.Now().UTC(),
 				Message:   api.Message{Role: "assistant", Content: r.Content},
+				Logprobs:  r.Logprobs,
 				Done:      r.Done,
 				Metrics: api.Metrics{
 					PromptEvalCount:    r.PromptEvalCount,
@@ -1197,10 +1263,12 @@ func ChatHandler(c *gin.Context) {
 
 		// Start prediction
 		predictReq := llm.PredictOpts{
-			Prompt:  prompt,
-			Format:  req.Format,
-			Images:  images,
-			Options: opts,
+			Prompt:          prompt,
+			Format:          req.Format,
+			Images:          images,
+			Options:         opts,
+			RequestLogprobs: req.Logprobs,
+			TopLogprobs:     req.TopLogprobs,
 		}
 		if err := loaded.runner.Predict(c.Request.Context(), predictReq, fn); err != nil {
 			ch <- gin.H{"error": err.Error()}
@@ -1211,10 +1279,12 @@ func ChatHandler(c *gin.Context) {
 		// Accumulate responses into the final response
 		var final api.ChatResponse
 		var sb strings.Builder
+		var logprobs []api.TokenLogprob
 		for resp := range ch {
 			switch r := resp.(type) {
 			case api.ChatResponse:
 				sb.WriteString(r.Message.Content)
+				logprobs = append(logprobs, r.Logprobs...)
 				final = r
 			case gin.H:
 				if errorMsg, ok := r["error"].(string); ok {
@@ -1231,121 +1301,10 @@ func ChatHandler(c *gin.Context) {
 		}
 
 		final.Message = api.Message{Role: "assistant", Content: sb.String()}
+		final.Logprobs = logprobs
 		c.JSON(http.StatusOK, final)
 		return
 	}
 
 	streamResponse(c, ch)
 }
-
-// promptInfo stores the variables used to template a prompt, and the token length of the resulting template for some model
-type promptInfo struct {
-	vars     PromptVars
-	tokenLen int
-}
-
-// trimmedPrompt builds a prompt to send to a running model. It ensures the prompt fits within the max context length,
-// while preserving the most recent system message.
-func trimmedPrompt(ctx context.Context, chat *ChatHistory, model *Model) (string, []llm.ImageData, error) {
-	if len(chat.Prompts) == 0 {
-		return "", nil, nil
-	}
-
-	var promptsToAdd []promptInfo
-	var totalTokenLength int
-	var systemPromptIncluded bool
-
-	var images []llm.ImageData
-	// reverse iterate through the prompts to build the prompt string in a way that fits the max context length
-	for i := len(chat.Prompts) - 1; i >= 0; i-- {
-		prompt := chat.Prompts[i]
-		promptText, err := promptString(model, prompt, i == len(chat.Prompts)-1)
-		if err != nil {
-			return "", nil, err
-		}
-
-		encodedTokens, err := loaded.runner.Encode(ctx, promptText)
-		if err != nil {
-			return "", nil, err
-		}
-
-		if totalTokenLength+len(encodedTokens) > loaded.NumCtx && i != len(chat.Prompts)-1 {
-			break // reached max context length, stop adding more prompts
-		}
-
-		for j := range prompt.Images {
-			if totalTokenLength+768 > loaded.NumCtx {
-				// this decreases the token length but overestimating is fine
-				prompt.Prompt = strings.ReplaceAll(prompt.Prompt, fmt.Sprintf(" [img-%d]", prompt.Images[j].ID), "")
-				continue
-			}
-
-			totalTokenLength += 768
-			images = append(images, prompt.Images[j])
-		}
-
-		totalTokenLength += len(encodedTokens)
-		systemPromptIncluded = systemPromptIncluded || prompt.System != ""
-		promptsToAdd = append(promptsToAdd, promptInfo{vars: prompt, tokenLen: len(encodedTokens)})
-	}
-
-	// ensure the system prompt is included, if not already
-	if chat.LastSystem != "" && !systemPromptIncluded {
-		var err error
-		promptsToAdd, err = includeSystemPrompt(ctx, chat.LastSystem, totalTokenLength, promptsToAdd)
-		if err != nil {
-			return "", nil, err
-		}
-	}
-
-	promptsToAdd[len(promptsToAdd)-1].vars.First = true
-
-	// construct the final prompt string from the prompts which fit within the context window
-	var result string
-	for i, prompt := range promptsToAdd {
-		promptText, err := promptString(model, prompt.vars, i == 0)
-		if err != nil {
-			return "", nil, err
-		}
-		result = promptText + result
-	}
-
-	return result, images, nil
-}
-
-// promptString applies the model template to the prompt
-func promptString(model *Model, vars PromptVars, isMostRecent bool) (string, error) {
-	if isMostRecent {
-		p, err := model.PreResponsePrompt(vars)
-		if err != nil {
-			return "", fmt.Errorf("pre-response template: %w", err)
-		}
-		return p, nil
-	}
-	p, err := Prompt(model.Template, vars)
-	if err != nil {
-		return "", err
-	}
-	return p, nil
-}
-
-// includeSystemPrompt adjusts the prompts to include the system prompt.
-func includeSystemPrompt(ctx context.Context, systemPrompt string, totalTokenLength int, promptsToAdd []promptInfo) ([]promptInfo, error) {
-	systemTokens, err := loaded.runner.Encode(ctx, systemPrompt)
-	if err != nil {
-		return nil, err
-	}
-
-	for i := len(promptsToAdd) - 1; i >= 0; i-- {
-		if totalTokenLength+len(systemTokens) <= loaded.NumCtx {
-			promptsToAdd[i].vars.System = systemPrompt
-			return promptsToAdd[:i+1], nil
-		}
-		totalTokenLength -= promptsToAdd[i].tokenLen
-	}
-
-	// if got here, system did not fit anywhere, so return the most recent prompt with the system message set
-	recent := promptsToAdd[len(promptsToAdd)-1]
-	recent.vars.System = systemPrompt
-	return []promptInfo{recent}, nil
-}
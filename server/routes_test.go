@@ -241,235 +241,168 @@ func Test_Routes(t *testing.T) {
 	}
 }
 
-func Test_ChatPrompt(t *testing.T) {
-	tests := []struct {
-		name     string
-		template string
-		chat     *ChatHistory
-		numCtx   int
-		runner   MockLLM
-		want     string
-		wantErr  string
-	}{
-		{
-			name:     "Single Message",
-			template: "[INST] {{ .System }} {{ .Prompt }} [/INST]",
-			chat: &ChatHistory{
-				Prompts: []PromptVars{
-					{
-						System: "You are a Wizard.",
-						Prompt: "What are the potion ingredients?",
-						First:  true,
-					},
-				},
-				LastSystem: "You are a Wizard.",
-			},
-			numCtx: 1,
-			runner: MockLLM{
-				encoding: []int{1}, // fit the ctxLen
-			},
-			want: "[INST] You are a Wizard. What are the potion ingredients? [/INST]",
-		},
-		{
-			name:     "First Message",
-			template: "[INST] {{if .First}}Hello!{{end}} {{ .System }} {{ .Prompt }} [/INST]",
-			chat: &ChatHistory{
-				Prompts: []PromptVars{
-					{
-						System:   "You are a Wizard.",
-						Prompt:   "What are the potion ingredients?",
-						Response: "eye of newt",
-						First:    true,
-					},
-					{
-						Prompt: "Anything else?",
-					},
-				},
-				LastSystem: "You are a Wizard.",
-			},
-			numCtx: 2,
-			runner: MockLLM{
-				encoding: []int{1}, // fit the ctxLen
-			},
-			want: "[INST] Hello! You are a Wizard. What are the potion ingredients? [/INST]eye of newt[INST]   Anything else? [/INST]",
-		},
-		{
-			name:     "Message History",
-			template: "[INST] {{ .System }} {{ .Prompt }} [/INST]",
-			chat: &ChatHistory{
-				Prompts: []PromptVars{
-					{
-						System:   "You are a Wizard.",
-						Prompt:   "What are the potion ingredients?",
-						Response: "sugar",
-						First:    true,
-					},
-					{
-						Prompt: "Anything else?",
-					},
-				},
-				LastSystem: "You are a Wizard.",
-			},
-			numCtx: 4,
-			runner: MockLLM{
-				encoding: []int{1}, // fit the ctxLen, 1 for each message
-			},
-			want: "[INST] You are a Wizard. What are the potion ingredients? [/INST]sugar[INST]  Anything else? [/INST]",
-		},
-		{
-			name:     "Assistant Only",
-			template: "[INST] {{ .System }} {{ .Prompt }} [/INST]",
-			chat: &ChatHistory{
-				Prompts: []PromptVars{
-					{
-						Response: "everything nice",
-						First:    true,
-					},
-				},
-			},
-			numCtx: 1,
-			runner: MockLLM{
-				encoding: []int{1},
-			},
-			want: "[INST]   [/INST]everything nice",
-		},
-		{
-			name:     "Message History Truncated, No System",
-			template: "[INST] {{ .System }} {{ .Prompt }} [/INST]",
-			chat: &ChatHistory{
-				Prompts: []PromptVars{
-					{
-						Prompt:   "What are the potion ingredients?",
-						Response: "sugar",
-						First:    true,
-					},
-					{
-						Prompt:   "Anything else?",
-						Response: "spice",
-					},
-					{
-						Prompt: "... and?",
-					},
-				},
-			},
-			numCtx: 2, // only 1 message from history and most recent message
-			runner: MockLLM{
-				encoding: []int{1},
-			},
-			want: "[INST]  Anything else? [/INST]spice[INST]  ... and? [/INST]",
-		},
-		{
-			name:     "System is Preserved when Truncated",
-			template: "[INST] {{ .System }} {{ .Prompt }} [/INST]",
-			chat: &ChatHistory{
-				Prompts: []PromptVars{
-					{
-						Prompt:   "What are the magic words?",
-						Response: "abracadabra",
-					},
-					{
-						Prompt: "What is the spell for invisibility?",
-					},
-				},
-				LastSystem: "You are a wizard.",
-			},
-			numCtx: 2,
-			runner: MockLLM{
-				encoding: []int{1},
-			},
-			want: "[INST] You are a wizard. What is the spell for invisibility? [/INST]",
-		},
-		{
-			name:     "System is Preserved when Length Exceeded",
-			template: "[INST] {{ .System }} {{ .Prompt }} [/INST]",
-			chat: &ChatHistory{
-				Prompts: []PromptVars{
-					{
-						Prompt:   "What are the magic words?",
-						Response: "abracadabra",
-					},
-					{
-						Prompt: "What is the spell for invisibility?",
-					},
-				},
-				LastSystem: "You are a wizard.",
-			},
-			numCtx: 1,
-			runner: MockLLM{
-				encoding: []int{1},
-			},
-			want: "[INST] You are a wizard. What is the spell for invisibility? [/INST]",
-		},
-		{
-			name:     "First is Preserved when Truncated",
-			template: "[INST] {{ if .First }}{{ .System }} {{ end }}{{ .Prompt }} [/INST]",
-
-			chat: &ChatHistory{
-				Prompts: []PromptVars{
-					// first message omitted for test
-					{
-						Prompt:   "Do you have a magic hat?",
-						Response: "Of course.",
-					},
-					{
-						Prompt: "What is the spell for invisibility?",
-					},
-				},
-				LastSystem: "You are a wizard.",
-			},
-			numCtx: 3, // two most recent messages and room for system message
-			runner: MockLLM{
-				encoding: []int{1},
-			},
-			want: "[INST] You are a wizard. Do you have a magic hat? [/INST]Of course.[INST] What is the spell for invisibility? [/INST]",
-		},
-		{
-			name:     "Most recent message is returned when longer than ctxLen",
-			template: "[INST] {{ .Prompt }} [/INST]",
-
-			chat: &ChatHistory{
-				Prompts: []PromptVars{
-					{
-						Prompt: "What is the spell for invisibility?",
-						First:  true,
-					},
-				},
-			},
-			numCtx: 1, // two most recent messages
-			runner: MockLLM{
-				encoding: []int{1, 2},
-			},
-			want: "[INST] What is the spell for invisibility? [/INST]",
+// chatHandlerLLM is a runner for ChatHandler tests which counts each word as a token, decodes any token ids to
+// decoded, and records the prompt it is asked to predict
+type chatHandlerLLM struct {
+	decoded string
+	prompt  string
+}
+
+func (r *chatHandlerLLM) Predict(ctx context.Context, pred llm.PredictOpts, fn func(llm.PredictResult)) error {
+	r.prompt = pred.Prompt
+	fn(llm.PredictResult{Content: "hocus pocus", Done: true})
+	return nil
+}
+
+func (r *chatHandlerLLM) Encode(ctx context.Context, prompt string) ([]int, error) {
+	return NewMockEncoder()(prompt)
+}
+
+func (r *chatHandlerLLM) Decode(ctx context.Context, tokens []int) (string, error) {
+	return r.decoded, nil
+}
+
+func (r *chatHandlerLLM) Embedding(ctx context.Context, input string) ([]float64, error) {
+	return []float64{}, nil
+}
+
+func (r *chatHandlerLLM) Close() {}
+
+// loadChatModel creates a model from the modelfile commands and loads it with the runner, as if the model had
+// been loaded by an earlier request
+func loadChatModel(t *testing.T, name, modelfile string, runner llm.LLM) {
+	t.Helper()
+	t.Setenv("OLLAMA_MODELS", t.TempDir())
+
+	f, err := os.Create(t.TempDir() + "/ollama-model")
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("GGUF\x02\x00"))
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	commands, err := parser.Parse(strings.NewReader(fmt.Sprintf("FROM %s\n%s", f.Name(), modelfile)))
+	assert.Nil(t, err)
+	assert.Nil(t, CreateModel(context.TODO(), name, "", commands, func(api.ProgressResponse) {}))
+
+	model, err := GetModel(name)
+	assert.Nil(t, err)
+	opts, err := modelOptions(model, nil)
+	assert.Nil(t, err)
+
+	loaded.mu.Lock()
+	defer loaded.mu.Unlock()
+	loaded.runner, loaded.Model, loaded.Options = runner, model, &opts
+	t.Cleanup(func() {
+		loaded.mu.Lock()
+		defer loaded.mu.Unlock()
+		if loaded.expireTimer != nil {
+			loaded.expireTimer.Stop()
+			loaded.expireTimer = nil
+		}
+		loaded.runner, loaded.Model, loaded.Options = nil, nil, nil
+		loaded.tokenCache, loaded.systemPrompts = nil, nil
+	})
+}
+
+// postChat sends the chat request to ChatHandler and returns the response
+func postChat(t *testing.T, req api.ChatRequest) *httptest.ResponseRecorder {
+	t.Helper()
+
+	s, err := setupServer(t)
+	assert.Nil(t, err)
+
+	body, err := json.Marshal(req)
+	assert.Nil(t, err)
+
+	w := httptest.NewRecorder()
+	s.GenerateRoutes().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/chat", bytes.NewReader(body)))
+	return w
+}
+
+func Test_ChatHandlerTokenIDs(t *testing.T) {
+	runner := &chatHandlerLLM{decoded: "abracadabra"}
+	loadChatModel(t, "token-ids", "TEMPLATE \"[INST] {{ .Prompt }} [/INST] {{ .Response }}</s>\"\nPARAMETER num_ctx 64", runner)
+
+	// the content is far longer than the window, while its token ids fit
+	stream := false
+	w := postChat(t, api.ChatRequest{
+		Model: "token-ids",
+		Messages: []api.Message{
+			{Role: "user", Content: "What are the magic words?"},
+			{Role: "assistant", Content: strings.Repeat("hocus pocus ", 100), TokenIDs: []int{1}},
+			{Role: "user", Content: "Do you have a hat?"},
 		},
+		Stream: &stream,
+	})
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// the decoded token ids are rendered in place of the content
+	assert.Equal(t, "[INST] What are the magic words? [/INST] abracadabra</s>[INST] Do you have a hat? [/INST] ", runner.prompt)
+
+	tokens, err := runner.Encode(context.Background(), runner.prompt)
+	assert.Nil(t, err)
+	assert.LessOrEqual(t, len(tokens), 64)
+}
+
+func Test_ChatHandlerSystem(t *testing.T) {
+	runner := &chatHandlerLLM{}
+	loadChatModel(t, "system", "TEMPLATE \"[INST] {{ .System }} {{ .Prompt }} [/INST]\"\nSYSTEM You are a wizard.", runner)
+
+	// the model was created again with a new system message, but the same weights are still loaded
+	loaded.Model.System = "You are a cat."
+
+	stream := false
+	w := postChat(t, api.ChatRequest{
+		Model:    "system",
+		Messages: []api.Message{{Role: "user", Content: "What are the magic words?"}},
+		Stream:   &stream,
+	})
+
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "[INST] You are a wizard. What are the magic words? [/INST]", runner.prompt)
+}
+
+func Test_ChatHandlerTokenCache(t *testing.T) {
+	runner := &chatHandlerLLM{}
+	loadChatModel(t, "cached", "TEMPLATE \"[INST] {{ .Prompt }} [/INST] {{ .Response }}</s>\"", runner)
+	loaded.tokenCache = NewCachedChatHistory()
+
+	messages := []api.Message{
+		{Role: "user", Content: "What are the magic words?"},
+		{Role: "assistant", Content: "abracadabra"},
+		{Role: "user", Content: "Do you have a hat?"},
 	}
 
-	for _, testCase := range tests {
-		tt := testCase
-		m := &Model{
-			Template: tt.template,
-		}
-		t.Run(tt.name, func(t *testing.T) {
-			loaded.runner = &tt.runner
-			loaded.Options = &api.Options{
-				Runner: api.Runner{
-					NumCtx: tt.numCtx,
-				},
-			}
-			// TODO: add tests for trimming images
-			got, _, err := trimmedPrompt(context.Background(), tt.chat, m)
-			if tt.wantErr != "" {
-				if err == nil {
-					t.Errorf("ChatPrompt() expected error, got nil")
-				}
-				if !strings.Contains(err.Error(), tt.wantErr) {
-					t.Errorf("ChatPrompt() error = %v, wantErr %v", err, tt.wantErr)
-				}
-			}
-			if got != tt.want {
-				t.Errorf("ChatPrompt() got = %v, want %v", got, tt.want)
-			}
-		})
+	stream := false
+	for i := 0; i < 2; i++ {
+		w := postChat(t, api.ChatRequest{Model: "cached", Messages: messages, Stream: &stream})
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
 	}
+
+	// the turns of the second request were counted by the first
+	hits, misses := loaded.tokenCache.Stats()
+	assert.Equal(t, 2, hits)
+	assert.Equal(t, 2, misses)
+}
+
+func Test_ChatHandlerPinnedMessagesExhaustWindow(t *testing.T) {
+	runner := &chatHandlerLLM{}
+	loadChatModel(t, "pinned", "TEMPLATE \"[INST] {{ .Prompt }} [/INST] {{ .Response }}</s>\"\nPARAMETER num_ctx 16", runner)
+
+	stream := false
+	w := postChat(t, api.ChatRequest{
+		Model: "pinned",
+		Messages: []api.Message{
+			{Role: "user", Content: strings.Repeat("abracadabra ", 32), Priority: 1},
+			{Role: "assistant", Content: "hocus pocus"},
+			{Role: "user", Content: "Do you have a hat?"},
+		},
+		Stream: &stream,
+	})
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), ErrContextWindowExhausted.Error())
+	assert.Empty(t, runner.prompt)
 }
 
 type MockLLM struct {
@@ -0,0 +1,38 @@
+package tokenizers
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pkoukk/tiktoken-go"
+)
+
+// tiktokenEncoding is the encoding of a model, loaded once the first time an encoder for the model is created
+type tiktokenEncoding struct {
+	once sync.Once
+	tke  *tiktoken.Tiktoken
+	err  error
+}
+
+// tiktokenEncodings maps model names to their *tiktokenEncoding
+var tiktokenEncodings sync.Map
+
+// NewTiktokenEncoder returns an encode function which counts tokens the way the OpenAI model modelName does,
+// for GPT models served through an Ollama compatible API. The encoding of each model is loaded once, which
+// downloads its vocabulary to TIKTOKEN_CACHE_DIR the first time, and shared by all of its encoders. Special
+// tokens in the text are encoded as ordinary text.
+func NewTiktokenEncoder(modelName string) (func(string) ([]int, error), error) {
+	v, _ := tiktokenEncodings.LoadOrStore(modelName, &tiktokenEncoding{})
+	e := v.(*tiktokenEncoding)
+	e.once.Do(func() {
+		e.tke, e.err = tiktoken.EncodingForModel(modelName)
+	})
+
+	if e.err != nil {
+		return nil, fmt.Errorf("tiktoken encoding for %s: %w", modelName, e.err)
+	}
+
+	return func(s string) ([]int, error) {
+		return e.tke.EncodeOrdinary(s), nil
+	}, nil
+}
@@ -0,0 +1,71 @@
+package tokenizers
+
+import (
+	"testing"
+
+	"github.com/pkoukk/tiktoken-go"
+	"golang.org/x/exp/slices"
+)
+
+// byteLoader is a vocabulary of single bytes, ranked by their value, so encodings can be loaded without
+// downloading them
+type byteLoader struct {
+	calls int
+}
+
+func (l *byteLoader) LoadTiktokenBpe(string) (map[string]int, error) {
+	l.calls++
+
+	ranks := make(map[string]int, 256)
+	for i := 0; i < 256; i++ {
+		ranks[string([]byte{byte(i)})] = i
+	}
+
+	return ranks, nil
+}
+
+func TestNewTiktokenEncoder(t *testing.T) {
+	loader := &byteLoader{}
+	tiktoken.SetBpeLoader(loader)
+	t.Cleanup(func() { tiktoken.SetBpeLoader(tiktoken.NewDefaultBpeLoader()) })
+
+	encode, err := NewTiktokenEncoder("gpt-4")
+	if err != nil {
+		t.Fatalf("NewTiktokenEncoder() error = %v", err)
+	}
+
+	tests := []struct {
+		text string
+		want []int
+	}{
+		{"", nil},
+		{"hi", []int{'h', 'i'}},
+		{"<|endoftext|>", []int{'<', '|', 'e', 'n', 'd', 'o', 'f', 't', 'e', 'x', 't', '|', '>'}},
+	}
+
+	for _, tt := range tests {
+		got, err := encode(tt.text)
+		if err != nil {
+			t.Fatalf("encode(%q) error = %v", tt.text, err)
+		}
+
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("encode(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+
+	v, _ := tiktokenEncodings.Load("gpt-4")
+	tke := v.(*tiktokenEncoding).tke
+
+	if _, err := NewTiktokenEncoder("gpt-4"); err != nil {
+		t.Fatalf("NewTiktokenEncoder() error = %v", err)
+	}
+
+	if v, _ := tiktokenEncodings.Load("gpt-4"); v.(*tiktokenEncoding).tke != tke || loader.calls != 1 {
+		t.Errorf("NewTiktokenEncoder() loaded the encoding again, loader calls = %d", loader.calls)
+	}
+
+	if _, err := NewTiktokenEncoder("llama2"); err == nil {
+		t.Errorf("NewTiktokenEncoder(%q) expected an error", "llama2")
+	}
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"strings"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// TruncationStrategy shortens a list of chat messages to fit within a number of tokens before the
+// messages are built into a prompt
+type TruncationStrategy interface {
+	Truncate(msgs []api.Message, maxTokens int) ([]api.Message, error)
+}
+
+// DropOldestStrategy drops the oldest turns which do not fit, keeping the most recent turn and the most
+// recent system message. A turn is a user message with the assistant and tool messages which follow it. This is the same as the truncation applied to every chat prompt, but done
+// on the messages before they are built into a prompt.
+type DropOldestStrategy struct {
+	// CountTokens returns the number of tokens in a message. When it is not set the number of tokens is
+	// estimated from the length of the message.
+	CountTokens func(api.Message) (int, error)
+}
+
+func (s DropOldestStrategy) Truncate(msgs []api.Message, maxTokens int) ([]api.Message, error) {
+	dropped, kept, err := splitMessages(msgs, maxTokens, s.CountTokens)
+	if err != nil {
+		return nil, err
+	}
+
+	if system, ok := lastSystemMessage(dropped); ok {
+		kept = append([]api.Message{system}, kept...)
+	}
+
+	return kept, nil
+}
+
+// SummarizeStrategy replaces the oldest turns which do not fit with a system message summarizing them,
+// so the conversation keeps some context of what was said earlier
+type SummarizeStrategy struct {
+	// Summarize returns a summary of the messages, usually by asking a model to summarize them
+	Summarize func([]api.Message) (string, error)
+
+	// CountTokens returns the number of tokens in a message. When it is not set the number of tokens is
+	// estimated from the length of the message.
+	CountTokens func(api.Message) (int, error)
+}
+
+func (s SummarizeStrategy) Truncate(msgs []api.Message, maxTokens int) ([]api.Message, error) {
+	dropped, kept, err := splitMessages(msgs, maxTokens, s.CountTokens)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(dropped) == 0 {
+		return kept, nil
+	}
+
+	var conversation []api.Message
+	for _, msg := range dropped {
+		if !strings.EqualFold(msg.Role, "system") {
+			conversation = append(conversation, msg)
+		}
+	}
+
+	var content []string
+	// the summary is added to the system message, a second system message would replace it
+	if system, ok := lastSystemMessage(dropped); ok {
+		content = append(content, system.Content)
+	}
+
+	if len(conversation) > 0 {
+		summary, err := s.Summarize(conversation)
+		if err != nil {
+			return nil, err
+		}
+
+		content = append(content, summary)
+	}
+
+	if len(content) == 0 {
+		return kept, nil
+	}
+
+	system := api.Message{Role: "system", Content: strings.Join(content, "\n\n")}
+	return append([]api.Message{system}, kept...), nil
+}
+
+// splitMessages splits the messages into the oldest messages which do not fit within maxTokens and the
+// most recent messages which do. Messages are dropped a turn at a time, a user message along with the
+// assistant and tool messages which follow it, so a reply is never kept without the message it answers.
+// The most recent turn is always kept.
+func splitMessages(msgs []api.Message, maxTokens int, countTokens func(api.Message) (int, error)) (dropped, kept []api.Message, err error) {
+	if countTokens == nil {
+		countTokens = estimateMessageTokens
+	}
+
+	// start is the first of the messages which fit
+	start := len(msgs)
+
+	var total, turn int
+	for i := len(msgs) - 1; i >= 0; i-- {
+		tokens, err := countTokens(msgs[i])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		turn += tokens
+		if i > 0 && continuesTurn(msgs[i]) {
+			continue
+		}
+
+		// msgs[i] starts a turn, which is kept whole or dropped along with every turn before it
+		if total+turn > maxTokens && start < len(msgs) {
+			return msgs[:start], msgs[start:], nil
+		}
+
+		total += turn
+		turn = 0
+		start = i
+	}
+
+	return nil, msgs, nil
+}
+
+// continuesTurn reports whether the message is part of the turn of the message before it, such as the reply
+// of the assistant to a user message
+func continuesTurn(msg api.Message) bool {
+	switch strings.ToLower(msg.Role) {
+	case "assistant", "tool", "tool_result":
+		return true
+	default:
+		return false
+	}
+}
+
+// lastSystemMessage returns the most recent system message
+func lastSystemMessage(msgs []api.Message) (api.Message, bool) {
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if strings.EqualFold(msgs[i].Role, "system") {
+			return msgs[i], true
+		}
+	}
+
+	return api.Message{}, false
+}
+
+// PruneRedundantSystemMessages removes system messages which repeat the system message already in effect, such as
+// from clients which send the same system message every few turns. A system message which repeats an earlier one
+// after a different system message is kept, since it changes the system message back.
+func PruneRedundantSystemMessages(messages []api.Message) []api.Message {
+	pruned := make([]api.Message, 0, len(messages))
+
+	var system string
+	var hasSystem bool
+	for _, msg := range messages {
+		if strings.EqualFold(msg.Role, "system") {
+			if hasSystem && msg.Content == system {
+				continue
+			}
+
+			system, hasSystem = msg.Content, true
+		}
+
+		pruned = append(pruned, msg)
+	}
+
+	return pruned
+}
+
+// estimateMessageTokens estimates the number of tokens in a message as one token for every four bytes
+func estimateMessageTokens(msg api.Message) (int, error) {
+	return len(msg.Content)/4 + 1, nil
+}
+
+// limitedToRoles returns a copy of the chat history with the content of each message cut to the token limit of its
+// role, counted with encode. Roles without a positive limit are not cut.
+func (h *ChatHistory) limitedToRoles(limits map[string]int, encode func(string) ([]int, error)) (*ChatHistory, error) {
+	limit := func(role, content string) (string, error) {
+		if n, ok := limits[role]; ok && n > 0 {
+			return truncateToTokens(content, n, encode)
+		}
+
+		return content, nil
+	}
+
+	c := *h
+	c.Prompts = make([]PromptVars, len(h.Prompts))
+	for i, prompt := range h.Prompts {
+		fields := []struct {
+			role    string
+			content *string
+		}{
+			{"system", &prompt.System},
+			{"developer", &prompt.Developer},
+			{"user", &prompt.Prompt},
+			{"tool", &prompt.Tool},
+			{"tool_result", &prompt.ToolResult},
+			{"assistant", &prompt.Response},
+		}
+
+		for _, field := range fields {
+			var err error
+			if *field.content, err = limit(field.role, *field.content); err != nil {
+				return nil, err
+			}
+		}
+
+		c.Prompts[i] = prompt
+	}
+
+	// the cut system message is still the most recent one
+	var err error
+	if c.LastSystem, err = limit("system", h.LastSystem); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// truncateToTokens returns the longest prefix of s, cut between characters, which encodes to at most maxTokens
+// tokens. Shorter prefixes are encoded until one fits.
+func truncateToTokens(s string, maxTokens int, encode func(string) ([]int, error)) (string, error) {
+	tokens, err := countTokens(encode, s)
+	if err != nil || tokens <= maxTokens {
+		return s, err
+	}
+
+	runes := []rune(s)
+
+	// the prefix of lo runes fits and the prefix of hi runes does not
+	lo, hi := 0, len(runes)
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		tokens, err := countTokens(encode, string(runes[:mid]))
+		if err != nil {
+			return "", err
+		}
+
+		if tokens <= maxTokens {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+
+	return string(runes[:lo]), nil
+}
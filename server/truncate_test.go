@@ -0,0 +1,234 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jmorganca/ollama/api"
+)
+
+// countWords counts each word of a message as a token
+func countWords(msg api.Message) (int, error) {
+	return len(strings.Fields(msg.Content)), nil
+}
+
+func TestDropOldestStrategy(t *testing.T) {
+	msgs := []api.Message{
+		{Role: "system", Content: "You are a wizard."},
+		{Role: "user", Content: "What are the magic words?"},
+		{Role: "assistant", Content: "abracadabra"},
+		{Role: "user", Content: "Do you have a magic hat?"},
+	}
+
+	tests := []struct {
+		name      string
+		maxTokens int
+		want      []api.Message
+	}{
+		{
+			name:      "Fits",
+			maxTokens: 16,
+			want:      msgs,
+		},
+		{
+			name:      "Drops Oldest",
+			maxTokens: 12,
+			want:      msgs,
+		},
+		{
+			// the reply is dropped along with the message it answers
+			name:      "Drops Whole Turns",
+			maxTokens: 7,
+			want:      []api.Message{msgs[0], msgs[3]},
+		},
+		{
+			name:      "Keeps Most Recent",
+			maxTokens: 1,
+			want:      []api.Message{msgs[0], msgs[3]},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DropOldestStrategy{CountTokens: countWords}.Truncate(msgs, tt.maxTokens)
+			if err != nil {
+				t.Fatalf("Truncate() error = %v", err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Truncate() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSummarizeStrategy(t *testing.T) {
+	msgs := []api.Message{
+		{Role: "system", Content: "You are a wizard."},
+		{Role: "user", Content: "What are the magic words?"},
+		{Role: "assistant", Content: "abracadabra"},
+		{Role: "user", Content: "Do you have a magic hat?"},
+	}
+
+	var summarized []api.Message
+	strategy := SummarizeStrategy{
+		Summarize: func(msgs []api.Message) (string, error) {
+			summarized = msgs
+			return "The user asked for the magic words.", nil
+		},
+		CountTokens: countWords,
+	}
+
+	got, err := strategy.Truncate(msgs, 7)
+	if err != nil {
+		t.Fatalf("Truncate() error = %v", err)
+	}
+
+	want := []api.Message{
+		{Role: "system", Content: "You are a wizard.\n\nThe user asked for the magic words."},
+		msgs[3],
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Truncate() got = %v, want %v", got, want)
+	}
+
+	if !reflect.DeepEqual(summarized, msgs[1:3]) {
+		t.Errorf("Summarize() got = %v, want %v", summarized, msgs[1:3])
+	}
+
+	// nothing is summarized when the messages fit
+	summarized = nil
+	if got, err := strategy.Truncate(msgs, 16); err != nil || !reflect.DeepEqual(got, msgs) || summarized != nil {
+		t.Errorf("Truncate() got = %v, %v, want %v", got, err, msgs)
+	}
+
+	failing := SummarizeStrategy{
+		Summarize: func([]api.Message) (string, error) {
+			return "", errors.New("summarize failed")
+		},
+		CountTokens: countWords,
+	}
+
+	if _, err := failing.Truncate(msgs, 7); err == nil {
+		t.Errorf("Truncate() expected the summarize error")
+	}
+}
+
+func TestChatPromptTruncation(t *testing.T) {
+	m := &Model{Template: "[INST] {{ .System }} {{ .Prompt }} [/INST] {{ .Response }}"}
+	msgs := []api.Message{
+		{Role: "system", Content: "You are a wizard."},
+		{Role: "user", Content: "What are the magic words?"},
+		{Role: "assistant", Content: "abracadabra"},
+		{Role: "user", Content: "Do you have a magic hat?"},
+		{Role: "assistant", Content: "Of course."},
+		{Role: "user", Content: "Can you make me invisible?"},
+	}
+
+	chat, err := m.ChatPrompts(msgs, "")
+	if err != nil {
+		t.Fatalf("ChatPrompts() error = %v", err)
+	}
+
+	// each message is counted as a quarter of the window, so only the two most recent turns fit
+	opts := ChatPromptOptions{
+		Truncation: DropOldestStrategy{CountTokens: func(api.Message) (int, error) { return 16, nil }},
+	}
+
+	result, err := trimmedPrompt(context.Background(), chat, m, 64, NewMockEncoder(), opts)
+	if err != nil {
+		t.Fatalf("ChatPrompt() error = %v", err)
+	}
+
+	// the oldest turn is dropped along with its reply
+	want := "[INST] You are a wizard. Do you have a magic hat? [/INST] Of course.[INST]  Can you make me invisible? [/INST] "
+	if result.Prompt != want {
+		t.Errorf("ChatPrompt() got = %q, want %q", result.Prompt, want)
+	}
+
+	// the chat history itself is not truncated
+	if got := chat.Prompts[0].Prompt; got != msgs[1].Content {
+		t.Errorf("ChatPrompt() changed the chat history, first prompt = %q, want %q", got, msgs[1].Content)
+	}
+}
+
+func TestPruneRedundantSystemMessages(t *testing.T) {
+	wizard := api.Message{Role: "system", Content: "You are a wizard."}
+	cat := api.Message{Role: "system", Content: "You are a cat."}
+	user := api.Message{Role: "user", Content: "What are the magic words?"}
+	assistant := api.Message{Role: "assistant", Content: "abracadabra"}
+
+	tests := []struct {
+		name     string
+		messages []api.Message
+		want     []api.Message
+	}{
+		{
+			name:     "Repeated",
+			messages: []api.Message{wizard, user, assistant, wizard, user, {Role: "System", Content: wizard.Content}, user},
+			want:     []api.Message{wizard, user, assistant, user, user},
+		},
+		{
+			name:     "Changed Back",
+			messages: []api.Message{wizard, user, cat, user, wizard, user},
+			want:     []api.Message{wizard, user, cat, user, wizard, user},
+		},
+		{
+			name:     "Empty System",
+			messages: []api.Message{{Role: "system"}, user, {Role: "system"}, user},
+			want:     []api.Message{{Role: "system"}, user, user},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := PruneRedundantSystemMessages(tt.messages); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("PruneRedundantSystemMessages() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatHistoryLimitedToRoles(t *testing.T) {
+	encode := NewMockEncoder()
+
+	chat := &ChatHistory{
+		Prompts: []PromptVars{
+			{
+				System:   "You are a wizard who only speaks in riddles.",
+				Prompt:   "What are the magic words?",
+				Response: "abracadabra",
+				First:    true,
+			},
+		},
+		LastSystem: "You are a wizard who only speaks in riddles.",
+	}
+
+	got, err := chat.limitedToRoles(map[string]int{"system": 4, "user": 0}, encode)
+	if err != nil {
+		t.Fatalf("limitedToRoles() error = %v", err)
+	}
+
+	want := PromptVars{
+		System:   "You are a wizard ",
+		Prompt:   "What are the magic words?",
+		Response: "abracadabra",
+		First:    true,
+	}
+
+	if !reflect.DeepEqual(got.Prompts[0], want) {
+		t.Errorf("limitedToRoles() got = %#v, want %#v", got.Prompts[0], want)
+	}
+
+	if got.LastSystem != want.System {
+		t.Errorf("limitedToRoles() LastSystem = %q, want %q", got.LastSystem, want.System)
+	}
+
+	if chat.Prompts[0].System != chat.LastSystem {
+		t.Errorf("limitedToRoles() changed the chat history")
+	}
+}